@@ -0,0 +1,22 @@
+// Package actor identifies who makes a request, for the records kept of who
+// changed what.
+package actor
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header names the person or service on whose behalf a request is made.
+const Header = "X-Actor"
+
+// FromContext returns the actor of the request, or nil when it does not name
+// one.
+func FromContext(ctx *gin.Context) *string {
+	name := strings.TrimSpace(ctx.GetHeader(Header))
+	if name == "" {
+		return nil
+	}
+	return &name
+}
@@ -4,8 +4,15 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
+	"time"
+
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -14,8 +21,11 @@ import (
 )
 
 type audienceResponse struct {
-	Name        *string `json:"name" db:"name"`
-	Description *string `json:"description,omitempty" db:"description"`
+	Name        *string    `json:"name" db:"name"`
+	Description *string    `json:"description,omitempty" db:"description"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy   *string    `json:"deleted_by,omitempty" db:"deleted_by"`
+	UpdatedAt   *time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type audience struct {
@@ -29,22 +39,31 @@ type Audience interface {
 	CreateNewAudience(ctx *gin.Context)
 	UpdateAudienceByName(ctx *gin.Context)
 	DeleteAudienceByName(ctx *gin.Context)
+	RestoreAudienceByName(ctx *gin.Context)
+	GetAllAudienceRule(ctx *gin.Context)
+	CreateNewAudienceRule(ctx *gin.Context)
+	DeleteAudienceRuleByID(ctx *gin.Context)
+	CheckAudienceEligibility(ctx *gin.Context)
 }
 
 type AudienceDB struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	evaluator *Evaluator
 }
 
-func NewAudience(db *pgxpool.Pool) Audience {
+func NewAudience(db *pgxpool.Pool, evaluator *Evaluator) Audience {
 	return &AudienceDB{
 		db,
+		evaluator,
 	}
 }
 
+// GetAudienceByName returns the audience, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *AudienceDB) GetAudienceByName(ctx *gin.Context) {
 	name := ctx.Param("name")
 
-	u, err := getAudienceByName(r, ctx, name)
+	u, err := getAudienceByName(r, ctx, name, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -60,9 +79,14 @@ func (r *AudienceDB) GetAudienceByName(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllAudience lists the audiences, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *AudienceDB) GetAllAudience(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -89,7 +113,7 @@ func (r *AudienceDB) GetAllAudience(ctx *gin.Context) {
 		return
 	}
 
-	u, err := GetAllAudience(r, ctx, intSkip, intLimit)
+	u, err := GetAllAudience(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -121,7 +145,8 @@ func (r *AudienceDB) CreateNewAudience(ctx *gin.Context) {
 		return
 	}
 
-	if err := CreateNewAudience(r, ctx, s); err != nil {
+	name, err := CreateNewAudience(r, ctx, s)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -129,7 +154,18 @@ func (r *AudienceDB) CreateNewAudience(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new audience!", "data": s, "success": true})
+	u, err := getAudienceByName(r, ctx, name, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, url.PathEscape(name)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new audience!", "data": u, "success": true})
 }
 
 func (r *AudienceDB) UpdateAudienceByName(ctx *gin.Context) {
@@ -144,7 +180,7 @@ func (r *AudienceDB) UpdateAudienceByName(ctx *gin.Context) {
 
 	name := ctx.Param("name")
 
-	if err := UpdateAudienceByName(r, ctx, u, name); err != nil {
+	if err := UpdateAudienceByName(r, ctx, u, name, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -154,6 +190,14 @@ func (r *AudienceDB) UpdateAudienceByName(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -168,14 +212,44 @@ func (r *AudienceDB) UpdateAudienceByName(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Audience updated successfully", "data": u, "success": true})
+
+	if u.Name != nil {
+		name = *u.Name
+	}
+	updated, err := getAudienceByName(r, ctx, name, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Audience updated successfully", "data": updated, "success": true})
 }
 
+// DeleteAudienceByName soft deletes the audience. Its rules are kept, and so
+// is the audience of the events restricted to it.
 func (r *AudienceDB) DeleteAudienceByName(ctx *gin.Context) {
 
 	name := ctx.Param("name")
 
-	if err := DeleteAudienceByName(r, ctx, name); err != nil {
+	if err := DeleteAudienceByName(r, ctx, name, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -186,13 +260,45 @@ func (r *AudienceDB) DeleteAudienceByName(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Audience deleted successfully!", "success": true})
 }
 
-func getAudienceByName(r *AudienceDB, ctx *gin.Context, name string) (audienceResponse, error) {
+func (r *AudienceDB) RestoreAudienceByName(ctx *gin.Context) {
+
+	name := ctx.Param("name")
+
+	if err := RestoreAudienceByName(r, ctx, name); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Audience restored successfully!", "success": true})
+}
+
+func getAudienceByName(r *AudienceDB, ctx *gin.Context, name string, includeDeleted bool) (audienceResponse, error) {
 	u := audienceResponse{}
 	if err := r.db.QueryRow(ctx, `select 
-	name, description  
-	from audience where name = $1`, name).Scan(
+	name, description, deleted_at, deleted_by, updated_at 
+	from audience where name = $1 and ($2 or coalesce(deleted, false) = false)`, name, includeDeleted).Scan(
 		&u.Name,
 		&u.Description,
+		&u.DeletedAt,
+		&u.DeletedBy,
+		&u.UpdatedAt,
 	); err != nil {
 		if err == pgx.ErrNoRows {
 			return audienceResponse{}, fmt.Errorf("not found")
@@ -202,15 +308,15 @@ func getAudienceByName(r *AudienceDB, ctx *gin.Context, name string) (audienceRe
 	return u, nil
 }
 
-func GetAllAudience(r *AudienceDB, ctx *gin.Context, skip int, limit int) (*[]audienceResponse, error) {
+func GetAllAudience(r *AudienceDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]audienceResponse, error) {
 
 	u := []audienceResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
-	name, description 
-	from audience LIMIT %d OFFSET %d`, limit, skip))
+	name, description, deleted_at, deleted_by, updated_at 
+	from audience where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d audienceResponse
-		err := rows.Scan(&d.Name, &d.Description)
+		err := rows.Scan(&d.Name, &d.Description, &d.DeletedAt, &d.DeletedBy, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -219,19 +325,19 @@ func GetAllAudience(r *AudienceDB, ctx *gin.Context, skip int, limit int) (*[]au
 	return &u, rows.Err()
 }
 
-func UpdateAudienceByName(r *AudienceDB, ctx *gin.Context, req audience, name string) error {
+func UpdateAudienceByName(r *AudienceDB, ctx *gin.Context, req audience, name string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareAudienceUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE audience SET %s WHERE name=%s`, toUpdate, name),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE audience SET %s WHERE name=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, name, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating audience: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from audience where name = $1)`, name)
 		}
 
 		return nil
@@ -240,25 +346,48 @@ func UpdateAudienceByName(r *AudienceDB, ctx *gin.Context, req audience, name st
 	}
 }
 
-func CreateNewAudience(r *AudienceDB, ctx *gin.Context, req audience) error {
+func CreateNewAudience(r *AudienceDB, ctx *gin.Context, req audience) (string, error) {
 
 	createString, numString, createQueryArgs := prepareAudienceCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO audience (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating item: %w", err)
+		var name string
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO audience (%s) VALUES (%s) RETURNING name`, createString, numString),
+			createQueryArgs...).Scan(&name); err != nil {
+			return "", fmt.Errorf("problem creating item: %w", err)
 		}
 
-		return nil
+		return name, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return "", fmt.Errorf("invalid values")
+	}
+}
+
+func DeleteAudienceByName(r *AudienceDB, ctx context.Context, name string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE audience SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE name = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), name, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from audience where name = $1 and coalesce(deleted, false) = false)`, name)
 	}
+	return nil
 }
 
-func DeleteAudienceByName(r *AudienceDB, ctx context.Context, name string) error {
-	_, err := r.db.Exec(ctx, "delete from audience where name=$1", name)
+func RestoreAudienceByName(r *AudienceDB, ctx context.Context, name string) error {
+	var deleted bool
+	if err := r.db.QueryRow(ctx, `select coalesce(deleted, false) from audience where name = $1`, name).Scan(&deleted); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("not found")
+		}
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("not deleted")
+	}
+
+	_, err := audit.Exec(ctx, r.db, `UPDATE audience SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE name = $1`, name)
 	return err
 }
 
@@ -275,6 +404,11 @@ func prepareAudienceUpdateQuery(req audience) (string, []interface{}) {
 		args = append(args, *req.Description)
 	}
 
+	if len(args) != 0 {
+		updateStrings = append(updateStrings, fmt.Sprintf("updated_at=$%d", len(updateStrings)+1))
+		args = append(args, time.Now())
+	}
+
 	updateArgument := strings.Join(updateStrings, ",")
 
 	return updateArgument, args
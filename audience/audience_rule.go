@@ -0,0 +1,206 @@
+package audience
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vh-srv-event/audit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+)
+
+type audienceRuleResponse struct {
+	ID        *int             `json:"id" db:"id"`
+	Audience  *string          `json:"audience" db:"audience"`
+	Kind      *string          `json:"kind" db:"kind"`
+	Params    *json.RawMessage `json:"params" db:"params"`
+	CreatedAt *time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+type audienceRule struct {
+	Kind   *string     `json:"kind" db:"kind" validate:"required"`
+	Params *ruleParams `json:"params" db:"params" validate:"required"`
+}
+
+func (r *AudienceDB) GetAllAudienceRule(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	u, err := getAllAudienceRule(r, ctx, name)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func (r *AudienceDB) CreateNewAudienceRule(ctx *gin.Context) {
+	s := audienceRule{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if err := validateRuleParams(*s.Kind, *s.Params); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	name := ctx.Param("name")
+
+	u, err := createNewAudienceRule(r, ctx, name, s)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new audience rule!", "data": u, "success": true})
+}
+
+func (r *AudienceDB) DeleteAudienceRuleByID(ctx *gin.Context) {
+
+	name := ctx.Param("name")
+	id := ctx.Param("ruleId")
+
+	if _, err := audit.Exec(ctx, r.db, "delete from audience_rule where id=$1 and audience=$2", id, name); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Audience rule deleted successfully!", "success": true})
+}
+
+// CheckAudienceEligibility tells whether a participant belongs to the
+// audience and, when not, which rules they fail.
+func (r *AudienceDB) CheckAudienceEligibility(ctx *gin.Context) {
+	name := ctx.Param("name")
+	participantID := ctx.Param("participantId")
+
+	u, err := r.evaluator.Check(ctx, name, participantID)
+
+	if err != nil {
+		if err.Error() == "not found" || err.Error() == "participant not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func getAllAudienceRule(r *AudienceDB, ctx *gin.Context, name string) (*[]audienceRuleResponse, error) {
+	if _, err := getAudienceByName(r, ctx, name, ctx.Query("include_deleted") == "true"); err != nil {
+		return nil, err
+	}
+
+	u := []audienceRuleResponse{}
+	rows, err := r.db.Query(ctx, `select 
+	id,
+	audience,
+	kind,
+	params,
+	created_at,
+	updated_at 
+	from audience_rule where audience = $1 order by id asc`, name)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d audienceRuleResponse
+		err := rows.Scan(&d.ID, &d.Audience, &d.Kind, &d.Params, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return &u, err
+		}
+		u = append(u, d)
+	}
+	return &u, rows.Err()
+}
+
+func createNewAudienceRule(r *AudienceDB, ctx *gin.Context, name string, req audienceRule) (audienceRuleResponse, error) {
+	if _, err := getAudienceByName(r, ctx, name, false); err != nil {
+		return audienceRuleResponse{}, err
+	}
+
+	params, err := json.Marshal(req.Params)
+	if err != nil {
+		return audienceRuleResponse{}, err
+	}
+
+	u := audienceRuleResponse{}
+	if err := audit.QueryRow(ctx, r.db, `INSERT INTO audience_rule (
+			audience,
+			kind,
+			params)
+		VALUES (
+			$1,
+			$2,
+			$3)
+		RETURNING id, audience, kind, params, created_at, updated_at`,
+		name, *req.Kind, json.RawMessage(params)).Scan(
+		&u.ID,
+		&u.Audience,
+		&u.Kind,
+		&u.Params,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return audienceRuleResponse{}, fmt.Errorf("not found")
+		}
+		return audienceRuleResponse{}, fmt.Errorf("problem creating audience rule: %w", err)
+	}
+	return u, nil
+}
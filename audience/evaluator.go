@@ -0,0 +1,340 @@
+package audience
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Rule kinds. A participant belongs to an audience when every rule of the
+// audience matches; an audience without rules includes everybody.
+const (
+	RuleCountry       = "country"
+	RuleAge           = "age"
+	RuleKeycloakGroup = "keycloak_group"
+	RuleKeycloakRole  = "keycloak_role"
+	RuleParticipant   = "participant"
+)
+
+var ruleKinds = []string{RuleCountry, RuleAge, RuleKeycloakGroup, RuleKeycloakRole, RuleParticipant}
+
+// ruleParams holds the parameters of every rule kind; each kind only reads
+// its own fields.
+type ruleParams struct {
+	Countries      []string `json:"countries,omitempty"`
+	Min            *int     `json:"min,omitempty"`
+	Max            *int     `json:"max,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	ParticipantIDs []int    `json:"participant_ids,omitempty"`
+}
+
+// Membership looks up the Keycloak groups and realm roles of a user.
+type Membership interface {
+	UserGroups(ctx context.Context, userID string) ([]string, error)
+	UserRealmRoles(ctx context.Context, userID string) ([]string, error)
+}
+
+// Evaluator decides whether participants belong to audiences.
+type Evaluator struct {
+	db         *pgxpool.Pool
+	membership Membership
+}
+
+// NewEvaluator returns an evaluator. membership may be nil, in which case
+// Keycloak group and role rules never match.
+func NewEvaluator(db *pgxpool.Pool, membership Membership) *Evaluator {
+	return &Evaluator{
+		db,
+		membership,
+	}
+}
+
+type Result struct {
+	Audience      string       `json:"audience"`
+	ParticipantID int          `json:"participant_id"`
+	Eligible      bool         `json:"eligible"`
+	FailedRules   []RuleResult `json:"failed_rules,omitempty"`
+}
+
+type RuleResult struct {
+	RuleID int    `json:"rule_id"`
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+}
+
+type participantFacts struct {
+	id         int
+	keycloakID string
+	country    *string
+	dob        *time.Time
+
+	groups []string
+	roles  []string
+	// Errors from Keycloak are kept so that they are reported by every rule
+	// that needed the lookup, without asking again.
+	groupsErr error
+	rolesErr  error
+	fetched   map[string]bool
+}
+
+type rule struct {
+	id       int
+	audience string
+	kind     string
+	params   ruleParams
+}
+
+// Check evaluates one audience for a participant. It returns "not found"
+// when the audience does not exist and "participant not found" when the
+// participant does not.
+func (e *Evaluator) Check(ctx context.Context, audienceName string, participantID string) (Result, error) {
+	var exists bool
+	if err := e.db.QueryRow(ctx, `select exists(select 1 from audience where name = $1)`, audienceName).Scan(&exists); err != nil {
+		return Result{}, err
+	}
+	if !exists {
+		return Result{}, fmt.Errorf("not found")
+	}
+
+	p, err := e.loadParticipant(ctx, participantID)
+	if err != nil {
+		return Result{}, err
+	}
+
+	rules, err := e.loadRules(ctx, `where audience = $1`, audienceName)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return e.evaluate(ctx, audienceName, p, rules), nil
+}
+
+// EligibleAudiences returns the names of every audience the participant
+// belongs to.
+func (e *Evaluator) EligibleAudiences(ctx context.Context, participantID string) ([]string, error) {
+	p, err := e.loadParticipant(ctx, participantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := e.loadRules(ctx, ``)
+	if err != nil {
+		return nil, err
+	}
+	byAudience := map[string][]rule{}
+	for _, r := range rules {
+		byAudience[r.audience] = append(byAudience[r.audience], r)
+	}
+
+	rows, err := e.db.Query(ctx, `select name from audience order by name`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	eligible := []string{}
+	for _, name := range names {
+		if e.evaluate(ctx, name, p, byAudience[name]).Eligible {
+			eligible = append(eligible, name)
+		}
+	}
+	return eligible, nil
+}
+
+func (e *Evaluator) loadParticipant(ctx context.Context, participantID string) (*participantFacts, error) {
+	p := &participantFacts{fetched: map[string]bool{}}
+	if err := e.db.QueryRow(ctx, `select id, keycloak_id, country, dob from participant where id = $1`, participantID).Scan(
+		&p.id, &p.keycloakID, &p.country, &p.dob); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("participant not found")
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func (e *Evaluator) loadRules(ctx context.Context, where string, args ...interface{}) ([]rule, error) {
+	rows, err := e.db.Query(ctx, `select id, audience, kind, params from audience_rule `+where+` order by id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []rule
+	for rows.Next() {
+		var r rule
+		var raw []byte
+		if err := rows.Scan(&r.id, &r.audience, &r.kind, &raw); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &r.params); err != nil {
+			return nil, fmt.Errorf("audience rule %d has invalid params: %w", r.id, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (e *Evaluator) evaluate(ctx context.Context, audienceName string, p *participantFacts, rules []rule) Result {
+	res := Result{Audience: audienceName, ParticipantID: p.id, Eligible: true}
+	for _, r := range rules {
+		if reason := e.evaluateRule(ctx, p, r); reason != "" {
+			res.Eligible = false
+			res.FailedRules = append(res.FailedRules, RuleResult{r.id, r.kind, reason})
+		}
+	}
+	return res
+}
+
+// evaluateRule returns why the participant fails the rule, or "" when the
+// rule matches.
+func (e *Evaluator) evaluateRule(ctx context.Context, p *participantFacts, r rule) string {
+	switch r.kind {
+	case RuleCountry:
+		if p.country == nil {
+			return "participant has no country"
+		}
+		for _, c := range r.params.Countries {
+			if strings.EqualFold(c, *p.country) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("country %s is not one of %s", *p.country, strings.Join(r.params.Countries, ", "))
+
+	case RuleAge:
+		if p.dob == nil {
+			return "participant has no date of birth"
+		}
+		age := ageOn(*p.dob, time.Now())
+		if r.params.Min != nil && age < *r.params.Min {
+			return fmt.Sprintf("age %d is below %d", age, *r.params.Min)
+		}
+		if r.params.Max != nil && age > *r.params.Max {
+			return fmt.Sprintf("age %d is above %d", age, *r.params.Max)
+		}
+		return ""
+
+	case RuleKeycloakGroup:
+		groups, err := e.groups(ctx, p)
+		if err != nil {
+			return "could not read keycloak groups: " + err.Error()
+		}
+		if intersects(groups, r.params.Groups) {
+			return ""
+		}
+		return "not a member of any of the groups " + strings.Join(r.params.Groups, ", ")
+
+	case RuleKeycloakRole:
+		roles, err := e.roles(ctx, p)
+		if err != nil {
+			return "could not read keycloak roles: " + err.Error()
+		}
+		if intersects(roles, r.params.Roles) {
+			return ""
+		}
+		return "has none of the roles " + strings.Join(r.params.Roles, ", ")
+
+	case RuleParticipant:
+		for _, id := range r.params.ParticipantIDs {
+			if id == p.id {
+				return ""
+			}
+		}
+		return "participant is not on the allowlist"
+	}
+	return "unknown rule kind " + r.kind
+}
+
+func (e *Evaluator) groups(ctx context.Context, p *participantFacts) ([]string, error) {
+	if e.membership == nil {
+		return nil, fmt.Errorf("keycloak is not configured")
+	}
+	if !p.fetched["groups"] {
+		p.groups, p.groupsErr = e.membership.UserGroups(ctx, p.keycloakID)
+		p.fetched["groups"] = true
+	}
+	return p.groups, p.groupsErr
+}
+
+func (e *Evaluator) roles(ctx context.Context, p *participantFacts) ([]string, error) {
+	if e.membership == nil {
+		return nil, fmt.Errorf("keycloak is not configured")
+	}
+	if !p.fetched["roles"] {
+		p.roles, p.rolesErr = e.membership.UserRealmRoles(ctx, p.keycloakID)
+		p.fetched["roles"] = true
+	}
+	return p.roles, p.rolesErr
+}
+
+// ageOn returns the age in whole years of someone born on dob at date t.
+func ageOn(dob time.Time, t time.Time) int {
+	dob, t = dob.UTC(), t.UTC()
+	age := t.Year() - dob.Year()
+	if t.Month() < dob.Month() || (t.Month() == dob.Month() && t.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+func intersects(have []string, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateRuleParams checks that a rule of the given kind has the parameters
+// it needs.
+func validateRuleParams(kind string, p ruleParams) error {
+	switch kind {
+	case RuleCountry:
+		if len(p.Countries) == 0 {
+			return fmt.Errorf("country rules need countries")
+		}
+	case RuleAge:
+		if p.Min == nil && p.Max == nil {
+			return fmt.Errorf("age rules need min or max")
+		}
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return fmt.Errorf("min must not be greater than max")
+		}
+	case RuleKeycloakGroup:
+		if len(p.Groups) == 0 {
+			return fmt.Errorf("keycloak_group rules need groups")
+		}
+	case RuleKeycloakRole:
+		if len(p.Roles) == 0 {
+			return fmt.Errorf("keycloak_role rules need roles")
+		}
+	case RuleParticipant:
+		if len(p.ParticipantIDs) == 0 {
+			return fmt.Errorf("participant rules need participant_ids")
+		}
+	default:
+		return fmt.Errorf("Invalid kind value! Accepted values are %s", strings.Join(ruleKinds, ", "))
+	}
+	return nil
+}
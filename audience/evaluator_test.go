@@ -0,0 +1,171 @@
+package audience
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testMembership struct {
+	groups, roles []string
+	err           error
+	calls         int
+}
+
+func (m *testMembership) UserGroups(ctx context.Context, userID string) ([]string, error) {
+	m.calls++
+	return m.groups, m.err
+}
+
+func (m *testMembership) UserRealmRoles(ctx context.Context, userID string) ([]string, error) {
+	m.calls++
+	return m.roles, m.err
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func newFacts(country string, age int) *participantFacts {
+	dob := time.Now().UTC().AddDate(-age, 0, -1)
+	return &participantFacts{id: 7, keycloakID: "user", country: &country, dob: &dob, fetched: map[string]bool{}}
+}
+
+func TestEvaluate(t *testing.T) {
+	ctx := context.Background()
+	m := &testMembership{groups: []string{"staff"}, roles: []string{"speaker"}}
+	e := NewEvaluator(nil, m)
+
+	tests := []struct {
+		name   string
+		kind   string
+		params ruleParams
+		facts  *participantFacts
+		want   string
+	}{
+		{"country", RuleCountry, ruleParams{Countries: []string{"de", "AT"}}, newFacts("at", 30), ""},
+		{"other country", RuleCountry, ruleParams{Countries: []string{"de"}}, newFacts("fr", 30), "country fr is not one of de"},
+		{"no country", RuleCountry, ruleParams{Countries: []string{"de"}}, &participantFacts{id: 7}, "participant has no country"},
+		{"age", RuleAge, ruleParams{Min: intPtr(18), Max: intPtr(30)}, newFacts("de", 30), ""},
+		{"too young", RuleAge, ruleParams{Min: intPtr(18)}, newFacts("de", 17), "age 17 is below 18"},
+		{"too old", RuleAge, ruleParams{Max: intPtr(30)}, newFacts("de", 31), "age 31 is above 30"},
+		{"no date of birth", RuleAge, ruleParams{Min: intPtr(18)}, &participantFacts{id: 7}, "participant has no date of birth"},
+		{"group", RuleKeycloakGroup, ruleParams{Groups: []string{"admins", "staff"}}, newFacts("de", 30), ""},
+		{"other group", RuleKeycloakGroup, ruleParams{Groups: []string{"admins"}}, newFacts("de", 30), "not a member of any of the groups admins"},
+		{"role", RuleKeycloakRole, ruleParams{Roles: []string{"speaker"}}, newFacts("de", 30), ""},
+		{"other role", RuleKeycloakRole, ruleParams{Roles: []string{"admin"}}, newFacts("de", 30), "has none of the roles admin"},
+		{"allowlist", RuleParticipant, ruleParams{ParticipantIDs: []int{3, 7}}, newFacts("de", 30), ""},
+		{"not on the allowlist", RuleParticipant, ruleParams{ParticipantIDs: []int{3}}, newFacts("de", 30), "participant is not on the allowlist"},
+		{"unknown kind", "team", ruleParams{}, newFacts("de", 30), "unknown rule kind team"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.evaluateRule(ctx, tt.facts, rule{id: 1, kind: tt.kind, params: tt.params}); got != tt.want {
+				t.Errorf("evaluateRule = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateResult(t *testing.T) {
+	e := NewEvaluator(nil, nil)
+	p := newFacts("de", 30)
+
+	if res := e.evaluate(context.Background(), "everybody", p, nil); !res.Eligible || res.FailedRules != nil {
+		t.Errorf("audience without rules: %+v, want eligible", res)
+	}
+
+	res := e.evaluate(context.Background(), "staff", p, []rule{
+		{id: 1, kind: RuleCountry, params: ruleParams{Countries: []string{"de"}}},
+		{id: 2, kind: RuleKeycloakGroup, params: ruleParams{Groups: []string{"staff"}}},
+		{id: 3, kind: RuleAge, params: ruleParams{Max: intPtr(20)}},
+	})
+	want := Result{"staff", 7, false, []RuleResult{
+		{2, RuleKeycloakGroup, "could not read keycloak groups: keycloak is not configured"},
+		{3, RuleAge, "age 30 is above 20"},
+	}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("evaluate = %+v, want %+v", res, want)
+	}
+}
+
+func TestMembershipLookedUpOnce(t *testing.T) {
+	ctx := context.Background()
+	m := &testMembership{err: errors.New("unavailable")}
+	e := NewEvaluator(nil, m)
+	p := newFacts("de", 30)
+
+	res := e.evaluate(ctx, "staff", p, []rule{
+		{id: 1, kind: RuleKeycloakGroup, params: ruleParams{Groups: []string{"staff"}}},
+		{id: 2, kind: RuleKeycloakGroup, params: ruleParams{Groups: []string{"admins"}}},
+		{id: 3, kind: RuleKeycloakRole, params: ruleParams{Roles: []string{"admin"}}},
+	})
+	if m.calls != 2 {
+		t.Errorf("Keycloak was asked %d times, want once for the groups and once for the roles", m.calls)
+	}
+	if len(res.FailedRules) != 3 {
+		t.Fatalf("got %d failed rules, want 3", len(res.FailedRules))
+	}
+	if got := res.FailedRules[1].Reason; got != "could not read keycloak groups: unavailable" {
+		t.Errorf("second group rule failed with %q, want the error of the first lookup", got)
+	}
+}
+
+func TestAgeOn(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		dob, on string
+		want    int
+	}{
+		{"2000-03-04", "2024-03-03", 23},
+		{"2000-03-04", "2024-03-04", 24},
+		{"2000-12-31", "2024-01-01", 23},
+		{"2000-02-29", "2023-02-28", 22},
+		{"2000-02-29", "2023-03-01", 23},
+		{"2000-02-29", "2024-02-29", 24},
+	}
+
+	for _, tt := range tests {
+		if got := ageOn(date(tt.dob), date(tt.on)); got != tt.want {
+			t.Errorf("ageOn(%s, %s) = %d, want %d", tt.dob, tt.on, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRuleParams(t *testing.T) {
+	tests := []struct {
+		kind   string
+		params ruleParams
+		valid  bool
+	}{
+		{RuleCountry, ruleParams{Countries: []string{"de"}}, true},
+		{RuleCountry, ruleParams{}, false},
+		{RuleAge, ruleParams{Min: intPtr(18)}, true},
+		{RuleAge, ruleParams{Min: intPtr(18), Max: intPtr(18)}, true},
+		{RuleAge, ruleParams{Min: intPtr(30), Max: intPtr(18)}, false},
+		{RuleAge, ruleParams{Countries: []string{"de"}}, false},
+		{RuleKeycloakGroup, ruleParams{Groups: []string{"staff"}}, true},
+		{RuleKeycloakGroup, ruleParams{Roles: []string{"staff"}}, false},
+		{RuleKeycloakRole, ruleParams{Roles: []string{"admin"}}, true},
+		{RuleKeycloakRole, ruleParams{}, false},
+		{RuleParticipant, ruleParams{ParticipantIDs: []int{1}}, true},
+		{RuleParticipant, ruleParams{}, false},
+		{"team", ruleParams{}, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateRuleParams(tt.kind, tt.params); (err == nil) != tt.valid {
+			t.Errorf("validateRuleParams(%s, %+v) = %v, want valid %v", tt.kind, tt.params, err, tt.valid)
+		}
+	}
+}
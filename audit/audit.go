@@ -0,0 +1,145 @@
+// Package audit serves the log of the changes made to the data, which the
+// audit_row trigger of db/initial.sql records.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type auditResponse struct {
+	ID        *int64          `json:"id" db:"id"`
+	Entity    *string         `json:"entity" db:"entity"`
+	EntityID  *string         `json:"entity_id" db:"entity_id"`
+	Action    *string         `json:"action" db:"action"`
+	Before    json.RawMessage `json:"before" db:"before"`
+	After     json.RawMessage `json:"after" db:"after"`
+	Actor     *string         `json:"actor,omitempty" db:"actor"`
+	RequestID *string         `json:"request_id,omitempty" db:"request_id"`
+	CreatedAt *time.Time      `json:"created_at" db:"created_at"`
+}
+
+type Audit interface {
+	GetAllAudit(ctx *gin.Context)
+}
+
+type AuditDB struct {
+	db *pgxpool.Pool
+}
+
+func NewAudit(db *pgxpool.Pool) Audit {
+	return &AuditDB{
+		db,
+	}
+}
+
+// GetAllAudit lists the recorded changes, latest first. ?entity takes the
+// table name (event, participation_status, ...) and ?id the id, or the name
+// of platforms, audiences, participation options and content schemas, which
+// needs entity. They can also be filtered by action, actor and request_id.
+func (r *AuditDB) GetAllAudit(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	if ctx.Query("id") != "" && ctx.Query("entity") == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "id needs an entity", "success": false})
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, filter := range []struct{ param, column string }{
+		{"entity", "entity"},
+		{"id", "entity_id"},
+		{"action", "action"},
+		{"actor", "actor"},
+		{"request_id", "request_id"},
+	} {
+		if s := ctx.Query(filter.param); s != "" {
+			args = append(args, s)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.column, len(args)))
+		}
+	}
+
+	u, err := getAllAudit(r, ctx, intSkip, intLimit, conditions, args)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func getAllAudit(r *AuditDB, ctx context.Context, skip int, limit int, conditions []string, args []interface{}) (*[]auditResponse, error) {
+	where := ""
+	if len(conditions) != 0 {
+		where = "where " + strings.Join(conditions, " and ")
+	}
+
+	u := []auditResponse{}
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select
+	id,
+	entity,
+	entity_id,
+	action,
+	before::text,
+	after::text,
+	actor,
+	request_id,
+	created_at
+	from audit_log %s order by id desc LIMIT %d OFFSET %d`, where, limit, skip), args...)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d auditResponse
+		var before, after *string
+		err := rows.Scan(&d.ID, &d.Entity, &d.EntityID, &d.Action, &before, &after, &d.Actor, &d.RequestID, &d.CreatedAt)
+		if err != nil {
+			return &u, err
+		}
+		if before != nil {
+			d.Before = json.RawMessage(*before)
+		}
+		if after != nil {
+			d.After = json.RawMessage(*after)
+		}
+		u = append(u, d)
+	}
+	return &u, rows.Err()
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"vh-srv-event/actor"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// RequestIDHeader carries the id of a request. It is taken from the caller
+// when set and generated otherwise, and is always sent back.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request ids accepted from callers.
+const maxRequestIDLength = 128
+
+// The keys the middleware stores the actor and request id under. They are
+// plain strings because gin.Context only looks those up in Value.
+const (
+	actorKey     = "audit.actor"
+	requestIDKey = "audit.request_id"
+)
+
+// Middleware gives every request an id. For the requests that may change
+// data it also keeps the id and the actor for the transactions the request
+// runs, see Tag and Exec.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		ctx.Header(RequestIDHeader, id)
+
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			ctx.Set(requestIDKey, id)
+			if a := actor.FromContext(ctx); a != nil {
+				ctx.Set(actorKey, *a)
+			}
+		}
+
+		ctx.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// setLocal sets the actor and request id for the rest of the current
+// transaction, where the audit_row trigger reads them.
+const setLocal = `select set_config('audit.actor', $1, true), set_config('audit.request_id', $2, true)`
+
+// settings returns the actor and request id the middleware kept for ctx,
+// and false when it kept none.
+func settings(ctx context.Context) (string, string, bool) {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	if requestID == "" {
+		return "", "", false
+	}
+	a, _ := ctx.Value(actorKey).(string)
+	return a, requestID, true
+}
+
+// Tag sets the actor and request id of the request in ctx on tx, so that the
+// changes made in it are recorded with them.
+func Tag(ctx context.Context, tx pgx.Tx) error {
+	a, requestID, ok := settings(ctx)
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(ctx, setLocal, a, requestID)
+	return err
+}
+
+// Exec runs a single statement that changes data outside of a transaction.
+// With the context of a request it is sent in one batch after setLocal;
+// postgres runs the batch as one implicit transaction, so the settings hold
+// for the statement without another round trip.
+func Exec(ctx context.Context, db *pgxpool.Pool, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	a, requestID, ok := settings(ctx)
+	if !ok {
+		return db.Exec(ctx, sql, args...)
+	}
+	br := db.SendBatch(ctx, tagged(sql, args, a, requestID))
+	tag, err := br.Exec()
+	if err == nil {
+		tag, err = br.Exec()
+	}
+	if closeErr := br.Close(); err == nil {
+		err = closeErr
+	}
+	return tag, err
+}
+
+// QueryRow is Exec for the statements that return a row.
+func QueryRow(ctx context.Context, db *pgxpool.Pool, sql string, args ...interface{}) pgx.Row {
+	a, requestID, ok := settings(ctx)
+	if !ok {
+		return db.QueryRow(ctx, sql, args...)
+	}
+	return batchRow{db.SendBatch(ctx, tagged(sql, args, a, requestID))}
+}
+
+func tagged(sql string, args []interface{}, a string, requestID string) *pgx.Batch {
+	b := &pgx.Batch{}
+	b.Queue(setLocal, a, requestID)
+	b.Queue(sql, args...)
+	return b
+}
+
+// batchRow is the row of the statement queued after setLocal.
+type batchRow struct {
+	results pgx.BatchResults
+}
+
+func (r batchRow) Scan(dest ...interface{}) error {
+	_, err := r.results.Exec()
+	if err == nil {
+		err = r.results.QueryRow().Scan(dest...)
+	}
+	if closeErr := r.results.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
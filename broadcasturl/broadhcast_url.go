@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -19,6 +25,8 @@ type broadcastURLResponse struct {
 	URL       *string    `json:"url" db:"url"`
 	Platform  *string    `json:"platform" db:"platform"`
 	Language  *string    `json:"language" db:"language"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy *string    `json:"deleted_by,omitempty" db:"deleted_by"`
 	CreatedAt *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -35,6 +43,7 @@ type BroadcastURL interface {
 	CreateNewBroadcastURL(ctx *gin.Context)
 	UpdateBroadcastURLByID(ctx *gin.Context)
 	DeleteBroadcastURLByID(ctx *gin.Context)
+	RestoreBroadcastURLByID(ctx *gin.Context)
 }
 
 type BroadcastURLDB struct {
@@ -47,10 +56,12 @@ func NewBroadcastURL(db *pgxpool.Pool) BroadcastURL {
 	}
 }
 
+// GetBroadcastURLByID returns the broadcast url, or 404 when it is deleted
+// unless ?include_deleted=true.
 func (r *BroadcastURLDB) GetBroadcastURLByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getURLByID(r, ctx, id)
+	u, err := getURLByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -66,9 +77,14 @@ func (r *BroadcastURLDB) GetBroadcastURLByID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllBroadcastURL lists the broadcast urls, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *BroadcastURLDB) GetAllBroadcastURL(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -95,7 +111,7 @@ func (r *BroadcastURLDB) GetAllBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllURL(r, ctx, intSkip, intLimit)
+	u, err := getAllURL(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -127,7 +143,17 @@ func (r *BroadcastURLDB) CreateNewBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewURL(r, ctx, s); err != nil {
+	id, err := createNewURL(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getURLByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -135,7 +161,9 @@ func (r *BroadcastURLDB) CreateNewBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Broadcast url!", "data": s, "success": true})
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Broadcast url!", "data": u, "success": true})
 }
 
 func (r *BroadcastURLDB) UpdateBroadcastURLByID(ctx *gin.Context) {
@@ -150,7 +178,7 @@ func (r *BroadcastURLDB) UpdateBroadcastURLByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := updateURLByID(r, ctx, u, id); err != nil {
+	if err := updateURLByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -160,6 +188,14 @@ func (r *BroadcastURLDB) UpdateBroadcastURLByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -174,14 +210,41 @@ func (r *BroadcastURLDB) UpdateBroadcastURLByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Broadcast url updated successfully", "data": u, "success": true})
+
+	updated, err := getURLByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Broadcast url updated successfully", "data": updated, "success": true})
 }
 
+// DeleteBroadcastURLByID soft deletes the broadcast url along with its links
+// to items.
 func (r *BroadcastURLDB) DeleteBroadcastURLByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteURLByID(r, ctx, id); err != nil {
+	if err := deleteURLByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -192,20 +255,55 @@ func (r *BroadcastURLDB) DeleteBroadcastURLByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Broadcast url deleted successfully!", "success": true})
 }
 
-func getURLByID(r *BroadcastURLDB, ctx *gin.Context, id string) (broadcastURLResponse, error) {
+// RestoreBroadcastURLByID restores the broadcast url along with the links to
+// items deleted with it.
+func (r *BroadcastURLDB) RestoreBroadcastURLByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreURLByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Broadcast url restored successfully!", "success": true})
+}
+
+func getURLByID(r *BroadcastURLDB, ctx *gin.Context, id string, includeDeleted bool) (broadcastURLResponse, error) {
 	u := broadcastURLResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
 	url,
 	platform,
 	language,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from broadcast_url where id = $1`, id).Scan(
+	from broadcast_url where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.URL,
 		&u.Platform,
 		&u.Language,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -217,7 +315,7 @@ func getURLByID(r *BroadcastURLDB, ctx *gin.Context, id string) (broadcastURLRes
 	return u, nil
 }
 
-func getAllURL(r *BroadcastURLDB, ctx *gin.Context, skip int, limit int) (*[]broadcastURLResponse, error) {
+func getAllURL(r *BroadcastURLDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]broadcastURLResponse, error) {
 
 	u := []broadcastURLResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
@@ -225,12 +323,14 @@ func getAllURL(r *BroadcastURLDB, ctx *gin.Context, skip int, limit int) (*[]bro
 	url,
 	platform,
 	language,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from broadcast_url LIMIT %d OFFSET %d`, limit, skip))
+	from broadcast_url where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d broadcastURLResponse
-		err := rows.Scan(&d.ID, &d.URL, &d.Platform, &d.Language, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.URL, &d.Platform, &d.Language, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -239,19 +339,19 @@ func getAllURL(r *BroadcastURLDB, ctx *gin.Context, skip int, limit int) (*[]bro
 	return &u, rows.Err()
 }
 
-func updateURLByID(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL, id string) error {
+func updateURLByID(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareURLUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE broadcast_url SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE broadcast_url SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating broadcast url: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from broadcast_url where id = $1)`, id)
 		}
 
 		return nil
@@ -260,8 +360,9 @@ func updateURLByID(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL, id str
 	}
 }
 
-func createNewURL(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL) error {
-	_, err := r.db.Exec(ctx,
+func createNewURL(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL) (int, error) {
+	var id int
+	err := audit.QueryRow(ctx, r.db,
 		`INSERT INTO broadcast_url (
 			url,
 			platform,
@@ -269,17 +370,68 @@ func createNewURL(r *BroadcastURLDB, ctx *gin.Context, req broadcastURL) error {
 		VALUES (
 			$1,
 			$2,
-			$3)  `,
+			$3)
+		RETURNING id`,
 		*req.URL,
 		*req.Platform,
-		*req.Language)
+		*req.Language).Scan(&id)
 
-	return err
+	return id, err
 }
 
-func deleteURLByID(r *BroadcastURLDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from broadcast_url where id=$1", id)
-	return err
+// deleteURLByID marks the url and its item links deleted in one transaction,
+// so that they share the deletion time restoreURLByID goes by.
+func deleteURLByID(r *BroadcastURLDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, `UPDATE broadcast_url SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return etag.Missed(ctx, tx, ifMatch, `select exists(select 1 from broadcast_url where id = $1 and coalesce(deleted, false) = false)`, id)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE item_broadcast_url SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE broadcast_url_id = $1 AND coalesce(deleted, false) = false`, id, by); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// restoreURLByID restores the url and the item links deleted along with it,
+// except those to an item deleted since. Links deleted on their own before
+// stay deleted.
+func restoreURLByID(r *BroadcastURLDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted bool
+		var deletedAt *time.Time
+		if err := tx.QueryRow(ctx, `select coalesce(deleted, false), deleted_at from broadcast_url where id = $1 for update`, id).Scan(&deleted, &deletedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+
+		// The items are locked so that none is deleted while its link is
+		// restored.
+		if _, err := tx.Exec(ctx, `select 1 from item where id in (select item_id from item_broadcast_url where broadcast_url_id = $1) for share`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE item_broadcast_url ib SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ib.broadcast_url_id = $1 AND coalesce(ib.deleted, false) = true AND ib.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from item i where i.id = ib.item_id and coalesce(i.deleted, false) = true)`, id, deletedAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE broadcast_url SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 func prepareURLUpdateQuery(req broadcastURL) (string, []interface{}) {
@@ -0,0 +1,503 @@
+package checkin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"vh-srv-event/audit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// payloadVersion prefixes the QR payloads, so that their format can change
+// without accepting old payloads under new rules.
+const payloadVersion = "v1"
+
+type ticketResponse struct {
+	ParticipationStatusID *int    `json:"participation_status_id"`
+	EventID               *int    `json:"event_id"`
+	Payload               *string `json:"payload"`
+}
+
+type checkIn struct {
+	Payload     *string `json:"payload" validate:"required"`
+	ItemID      *int    `json:"item_id,omitempty"`
+	Location    *string `json:"location,omitempty"`
+	CheckedInBy *string `json:"checked_in_by,omitempty"`
+}
+
+type checkInResponse struct {
+	ID                    *int       `json:"id" db:"id"`
+	ParticipationStatusID *int       `json:"participation_status_id" db:"participation_status_id"`
+	EventID               *int       `json:"event_id" db:"event_id"`
+	ItemID                *int       `json:"item_id,omitempty" db:"item_id"`
+	ParticipantID         *int       `json:"participant_id" db:"participant_id"`
+	Location              *string    `json:"location,omitempty" db:"location"`
+	CheckedInBy           *string    `json:"checked_in_by,omitempty" db:"checked_in_by"`
+	CheckedInAt           *time.Time `json:"checked_in_at" db:"checked_in_at"`
+}
+
+type attendanceResponse struct {
+	EventID        int                  `json:"event_id"`
+	Confirmed      int                  `json:"confirmed"`
+	CheckedIn      int                  `json:"checked_in"`
+	AttendanceRate float64              `json:"attendance_rate"`
+	Items          []itemAttendanceResp `json:"items"`
+}
+
+type itemAttendanceResp struct {
+	ItemID         int     `json:"item_id"`
+	Name           string  `json:"name"`
+	CheckedIn      int     `json:"checked_in"`
+	AttendanceRate float64 `json:"attendance_rate"`
+}
+
+// checkInError is a check-in refused for a reason the scanner should show
+// to the staff, along with the check-in that already exists if any.
+type checkInError struct {
+	Message  string
+	Status   int
+	Existing *checkInResponse
+}
+
+func (e checkInError) Error() string {
+	return e.Message
+}
+
+type CheckIn interface {
+	GetTicketByParticipationStatusID(ctx *gin.Context)
+	CheckInToEvent(ctx *gin.Context)
+	GetAllCheckIn(ctx *gin.Context)
+	GetEventAttendance(ctx *gin.Context)
+}
+
+type CheckInDB struct {
+	db     *pgxpool.Pool
+	secret []byte
+	early  time.Duration
+}
+
+// NewCheckIn returns the check-in controller. QR payloads are signed with
+// secret, and check-ins are accepted from early before the start of the
+// event or item until its end.
+func NewCheckIn(db *pgxpool.Pool, secret []byte, early time.Duration) CheckIn {
+	return &CheckInDB{
+		db,
+		secret,
+		early,
+	}
+}
+
+// GetTicketByParticipationStatusID returns the signed QR payload of a
+// confirmed registration. The payload only identifies the registration and
+// its event; clients render it as a QR code.
+func (r *CheckInDB) GetTicketByParticipationStatusID(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	var eventID int
+	var confirmed, deleted bool
+	if err := r.db.QueryRow(ctx, `select event_id, confirmed, coalesce(deleted, false) from participation_status where id = $1`, id).Scan(&eventID, &confirmed, &deleted); err != nil {
+		if err == pgx.ErrNoRows {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   "not found",
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if deleted || !confirmed {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":   "only confirmed registrations have a ticket",
+			"success": false,
+		})
+		return
+	}
+
+	payload := r.sign(id, eventID)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": ticketResponse{&id, &eventID, &payload}, "success": true})
+}
+
+// CheckInToEvent records the check-in of the registration in the scanned
+// payload, to the event or to one of its items when item_id is given.
+func (r *CheckInDB) CheckInToEvent(ctx *gin.Context) {
+	s := checkIn{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	eventID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	u, err := checkInToEvent(r, ctx, eventID, s)
+
+	if err != nil {
+		if cerr, ok := err.(checkInError); ok {
+			ctx.JSON(cerr.Status, gin.H{
+				"error":    cerr.Message,
+				"existing": cerr.Existing,
+				"success":  false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Checked in!", "data": u, "success": true})
+}
+
+// GetAllCheckIn lists the check-ins of an event, latest first. ?item_id
+// restricts them to an item, ?item_id=none to the event itself.
+func (r *CheckInDB) GetAllCheckIn(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	condition := "c.event_id = $1"
+	args := []interface{}{ctx.Param("id")}
+	switch itemID := ctx.Query("item_id"); itemID {
+	case "":
+	case "none":
+		condition += " and c.item_id is null"
+	default:
+		if _, err := strconv.Atoi(itemID); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item_id value! Accepted value is INTEGER or none", "success": false})
+			return
+		}
+		condition += " and c.item_id = $2"
+		args = append(args, itemID)
+	}
+
+	u, err := getAllCheckIn(r, ctx, condition, args, intSkip, intLimit)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetEventAttendance summarizes how many confirmed registrations checked in
+// to the event and to each of its items.
+func (r *CheckInDB) GetEventAttendance(ctx *gin.Context) {
+	eventID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	u, err := getEventAttendance(r, ctx, eventID)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// sign returns the payload for a registration: its version, id and event id
+// followed by their HMAC-SHA256, all separated by dots.
+func (r *CheckInDB) sign(participationStatusID int, eventID int) string {
+	message := fmt.Sprintf("%s.%d.%d", payloadVersion, participationStatusID, eventID)
+	return message + "." + r.mac(message)
+}
+
+func (r *CheckInDB) mac(message string) string {
+	h := hmac.New(sha256.New, r.secret)
+	h.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verify checks the signature of a payload and returns the registration and
+// event it was issued for.
+func (r *CheckInDB) verify(payload string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(payload), ".")
+	if len(parts) != 4 || parts[0] != payloadVersion {
+		return 0, 0, fmt.Errorf("malformed payload")
+	}
+	message := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(r.mac(message))) {
+		return 0, 0, fmt.Errorf("invalid signature")
+	}
+
+	participationStatusID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed payload")
+	}
+	eventID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed payload")
+	}
+	return participationStatusID, eventID, nil
+}
+
+func checkInToEvent(r *CheckInDB, ctx context.Context, eventID int, req checkIn) (checkInResponse, error) {
+	participationStatusID, payloadEventID, err := r.verify(*req.Payload)
+	if err != nil {
+		return checkInResponse{}, checkInError{err.Error(), http.StatusBadRequest, nil}
+	}
+	if payloadEventID != eventID {
+		return checkInResponse{}, checkInError{"ticket is for another event", http.StatusConflict, nil}
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return checkInResponse{}, err
+	}
+	defer tx.Rollback(ctx)
+	if err := audit.Tag(ctx, tx); err != nil {
+		return checkInResponse{}, err
+	}
+
+	// The registration is locked so that two scanners reading the same
+	// ticket at once cannot both check it in.
+	var participantID int
+	var confirmed, deleted bool
+	if err := tx.QueryRow(ctx, `select participant_id, confirmed, coalesce(deleted, false) from participation_status
+	where id = $1 and event_id = $2 for update`, participationStatusID, eventID).Scan(&participantID, &confirmed, &deleted); err != nil {
+		if err == pgx.ErrNoRows {
+			return checkInResponse{}, checkInError{"registration not found", http.StatusNotFound, nil}
+		}
+		return checkInResponse{}, err
+	}
+	if deleted || !confirmed {
+		return checkInResponse{}, checkInError{"registration is not confirmed", http.StatusConflict, nil}
+	}
+
+	var startsAt, endsAt time.Time
+	if req.ItemID == nil {
+		if err := tx.QueryRow(ctx, `select starts_on, ends_on from event where id = $1 and coalesce(deleted, false) = false`,
+			eventID).Scan(&startsAt, &endsAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return checkInResponse{}, checkInError{"event not found", http.StatusNotFound, nil}
+			}
+			return checkInResponse{}, err
+		}
+	} else {
+		if err := tx.QueryRow(ctx, `select i.start_date, i.start_date + i.duration * interval '1 minute' from event_item ei
+		join item i on i.id = ei.item_id
+		where ei.event_id = $1 and ei.item_id = $2 and coalesce(ei.deleted, false) = false and coalesce(i.deleted, false) = false
+		limit 1`, eventID, *req.ItemID).Scan(&startsAt, &endsAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return checkInResponse{}, checkInError{"item is not part of this event", http.StatusBadRequest, nil}
+			}
+			return checkInResponse{}, err
+		}
+	}
+
+	now := time.Now()
+	if now.Before(startsAt.Add(-r.early)) {
+		return checkInResponse{}, checkInError{"check-in is not open yet", http.StatusConflict, nil}
+	}
+	if now.After(endsAt) {
+		return checkInResponse{}, checkInError{"check-in is closed", http.StatusConflict, nil}
+	}
+
+	existing, err := getCheckIn(ctx, tx, participationStatusID, req.ItemID)
+	if err == nil {
+		return checkInResponse{}, checkInError{"already checked in", http.StatusConflict, &existing}
+	}
+	if err.Error() != "not found" {
+		return checkInResponse{}, err
+	}
+
+	u := checkInResponse{}
+	if err := tx.QueryRow(ctx, `INSERT INTO check_in (participation_status_id, event_id, item_id, location, checked_in_by)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id, checked_in_at`,
+		participationStatusID, eventID, req.ItemID, req.Location, req.CheckedInBy).Scan(&u.ID, &u.CheckedInAt); err != nil {
+		return checkInResponse{}, fmt.Errorf("problem creating check-in: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return checkInResponse{}, err
+	}
+
+	u.ParticipationStatusID = &participationStatusID
+	u.EventID = &eventID
+	u.ItemID = req.ItemID
+	u.ParticipantID = &participantID
+	u.Location = req.Location
+	u.CheckedInBy = req.CheckedInBy
+	return u, nil
+}
+
+func getCheckIn(ctx context.Context, tx pgx.Tx, participationStatusID int, itemID *int) (checkInResponse, error) {
+	u := checkInResponse{}
+	if err := tx.QueryRow(ctx, `select
+	c.id,
+	c.participation_status_id,
+	c.event_id,
+	c.item_id,
+	ps.participant_id,
+	c.location,
+	c.checked_in_by,
+	c.checked_in_at
+	from check_in c
+	join participation_status ps on ps.id = c.participation_status_id
+	where c.participation_status_id = $1 and c.item_id is not distinct from $2`, participationStatusID, itemID).Scan(
+		&u.ID,
+		&u.ParticipationStatusID,
+		&u.EventID,
+		&u.ItemID,
+		&u.ParticipantID,
+		&u.Location,
+		&u.CheckedInBy,
+		&u.CheckedInAt,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return checkInResponse{}, fmt.Errorf("not found")
+		}
+		return checkInResponse{}, err
+	}
+	return u, nil
+}
+
+func getAllCheckIn(r *CheckInDB, ctx context.Context, condition string, args []interface{}, skip int, limit int) ([]checkInResponse, error) {
+	u := []checkInResponse{}
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select
+	c.id,
+	c.participation_status_id,
+	c.event_id,
+	c.item_id,
+	ps.participant_id,
+	c.location,
+	c.checked_in_by,
+	c.checked_in_at
+	from check_in c
+	join participation_status ps on ps.id = c.participation_status_id
+	where %s order by c.checked_in_at desc, c.id desc LIMIT %d OFFSET %d`, condition, limit, skip), args...)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d checkInResponse
+		err := rows.Scan(&d.ID, &d.ParticipationStatusID, &d.EventID, &d.ItemID, &d.ParticipantID, &d.Location, &d.CheckedInBy, &d.CheckedInAt)
+		if err != nil {
+			return u, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
+
+func getEventAttendance(r *CheckInDB, ctx context.Context, eventID int) (attendanceResponse, error) {
+	u := attendanceResponse{EventID: eventID, Items: []itemAttendanceResp{}}
+
+	// Check-ins of registrations deleted or unconfirmed since then are not
+	// counted.
+	if err := r.db.QueryRow(ctx, `select
+	(select count(*) from participation_status ps where ps.event_id = e.id and ps.confirmed and coalesce(ps.deleted, false) = false),
+	(select count(*) from check_in c join participation_status ps on ps.id = c.participation_status_id
+		where c.event_id = e.id and c.item_id is null and ps.confirmed and coalesce(ps.deleted, false) = false)
+	from event e where e.id = $1`, eventID).Scan(&u.Confirmed, &u.CheckedIn); err != nil {
+		if err == pgx.ErrNoRows {
+			return attendanceResponse{}, fmt.Errorf("not found")
+		}
+		return attendanceResponse{}, err
+	}
+	u.AttendanceRate = rate(u.CheckedIn, u.Confirmed)
+
+	rows, err := r.db.Query(ctx, `select i.id, i.name, count(ps.id)
+	from item i
+	left join check_in c on c.event_id = $1 and c.item_id = i.id
+	left join participation_status ps on ps.id = c.participation_status_id and ps.confirmed and coalesce(ps.deleted, false) = false
+	where i.id in (select item_id from event_item where event_id = $1 and coalesce(deleted, false) = false)
+	and coalesce(i.deleted, false) = false
+	group by i.id, i.name, i.start_date
+	order by i.start_date asc, i.id asc`, eventID)
+	if err != nil {
+		return attendanceResponse{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d itemAttendanceResp
+		if err := rows.Scan(&d.ItemID, &d.Name, &d.CheckedIn); err != nil {
+			return attendanceResponse{}, err
+		}
+		d.AttendanceRate = rate(d.CheckedIn, u.Confirmed)
+		u.Items = append(u.Items, d)
+	}
+	return u, rows.Err()
+}
+
+func rate(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
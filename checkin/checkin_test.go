@@ -0,0 +1,53 @@
+package checkin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	r := &CheckInDB{secret: []byte("secret")}
+
+	payload := r.sign(12, 34)
+	participationStatusID, eventID, err := r.verify(" " + payload + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if participationStatusID != 12 || eventID != 34 {
+		t.Errorf("verify = %d, %d, want 12, 34", participationStatusID, eventID)
+	}
+
+	other := &CheckInDB{secret: []byte("other secret")}
+	if _, _, err := other.verify(payload); err == nil || err.Error() != "invalid signature" {
+		t.Errorf("payload signed with another secret: %v, want invalid signature", err)
+	}
+
+	parts := strings.Split(payload, ".")
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"other registration", strings.Join([]string{parts[0], "13", parts[2], parts[3]}, "."), "invalid signature"},
+		{"other event", strings.Join([]string{parts[0], parts[1], "35", parts[3]}, "."), "invalid signature"},
+		{"other version", strings.Join([]string{"v0", parts[1], parts[2], parts[3]}, "."), "malformed payload"},
+		{"missing signature", strings.Join(parts[:3], "."), "malformed payload"},
+		{"empty", "", "malformed payload"},
+		{"signed non-numeric id", payloadVersion + ".a.34." + r.mac(payloadVersion+".a.34"), "malformed payload"},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := r.verify(tt.payload); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: verify = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	if got := rate(0, 0); got != 0 {
+		t.Errorf("rate(0, 0) = %v, want 0", got)
+	}
+	if got := rate(1, 4); got != 0.25 {
+		t.Errorf("rate(1, 4) = %v, want 0.25", got)
+	}
+}
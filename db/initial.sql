@@ -439,18 +439,54 @@ INSERT INTO country_list VALUES
     ('Virgin Islands, U.S.','VI');
 
 CREATE TABLE IF NOT EXISTS participation_option (
-    name TEXT NOT NULL UNIQUE
+    name TEXT NOT NULL UNIQUE,
+    deleted BOOLEAN DEFAULT false,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    deleted_by TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
 );
 
 CREATE TABLE IF NOT EXISTS platform (
-    name TEXT NOT NULL UNIQUE
+    name TEXT NOT NULL UNIQUE,
+    deleted BOOLEAN DEFAULT false,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    deleted_by TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
 );
 
 CREATE TABLE IF NOT EXISTS audience (
     name TEXT NOT NULL UNIQUE, 
-    description TEXT 
+    description TEXT,
+    deleted BOOLEAN DEFAULT false,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    deleted_by TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
 );
 
+INSERT INTO audience (name, description)
+VALUES ('all', 'Everyone');
+
+CREATE TABLE IF NOT EXISTS audience_rule (
+    id                      SERIAL PRIMARY KEY,
+    audience                TEXT NOT NULL,
+    kind                    TEXT NOT NULL CHECK (kind IN ('country', 'age', 'keycloak_group', 'keycloak_role', 'participant')),
+    params                  JSON NOT NULL,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CONSTRAINT fk_audience_name FOREIGN KEY(audience) REFERENCES audience(name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS content_schema (
+    name                    TEXT PRIMARY KEY,
+    schema                  JSON NOT NULL,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+INSERT INTO content_schema (name, schema)
+VALUES ('event', '{}'),
+       ('item', '{}');
+
 CREATE TABLE IF NOT EXISTS participant (
 	id                      SERIAL PRIMARY KEY,
     keycloak_id             TEXT NOT NULL UNIQUE,
@@ -462,6 +498,10 @@ CREATE TABLE IF NOT EXISTS participant (
     country                 TEXT,
     first_name              TEXT NOT NULL,
     last_name               TEXT NOT NULL,
+    erased_at               TIMESTAMP WITH TIME ZONE,
+    deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
 	created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
 	updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     CONSTRAINT fk_country_code FOREIGN KEY(country) REFERENCES country_list(code),
@@ -474,6 +514,9 @@ CREATE TABLE IF NOT EXISTS broadcast_url (
     url                     TEXT NOT NULL,
     platform                TEXT NOT NULL,
     language                TEXT NOT NULL,
+    deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
 	created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
 	updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     CONSTRAINT fk_language_code FOREIGN KEY(language) REFERENCES language_list(code),
@@ -486,17 +529,37 @@ CREATE TABLE IF NOT EXISTS item (
     duration                INT NOT NULL,
     name                    TEXT NOT NULL,
     content                 JSON,
+    content_type            TEXT NOT NULL DEFAULT 'item',
     original_language       TEXT NOT NULL,
-    translated              BOOLEAN NOT NULL DEFAULT true,
+    deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
 	created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
 	updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    CONSTRAINT fk_original_language_code FOREIGN KEY(original_language) REFERENCES language_list(code)
+    CONSTRAINT fk_original_language_code FOREIGN KEY(original_language) REFERENCES language_list(code),
+    CONSTRAINT fk_content_type FOREIGN KEY(content_type) REFERENCES content_schema(name)
+);
+
+CREATE TABLE IF NOT EXISTS item_translation (
+    id                      SERIAL PRIMARY KEY,
+    item_id                 INT NOT NULL,
+    language                TEXT NOT NULL,
+    name                    TEXT,
+    content                 JSON,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CONSTRAINT uq_item_translation UNIQUE(item_id, language),
+    CONSTRAINT fk_item_id FOREIGN KEY(item_id) REFERENCES item(id) ON DELETE CASCADE,
+    CONSTRAINT fk_language_code FOREIGN KEY(language) REFERENCES language_list(code)
 );
 
 CREATE TABLE IF NOT EXISTS item_broadcast_url (
     id                      SERIAL PRIMARY KEY,
     item_id                 INT NOT NULL,
     broadcast_url_id        INT NOT NULL,
+    deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
     created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     CONSTRAINT fk_item_id FOREIGN KEY(item_id) REFERENCES item(id),
@@ -507,19 +570,78 @@ CREATE TABLE IF NOT EXISTS item_broadcast_url (
 CREATE TABLE IF NOT EXISTS event (
 	id                      SERIAL PRIMARY KEY,
 	registration_required   BOOLEAN NOT NULL DEFAULT false,
-	registration_status     TEXT NOT NULL DEFAULT 'open',
+	registration_status     TEXT NOT NULL DEFAULT 'open' CHECK (registration_status IN ('open', 'closed', 'cancelled')),
+    registration_opens_at   TIMESTAMP WITH TIME ZONE,
+    registration_closes_at  TIMESTAMP WITH TIME ZONE,
+    registration_status_changed_at TIMESTAMP WITH TIME ZONE,
 	audience                TEXT NOT NULL DEFAULT 'all',
 	slug                    TEXT NOT NULL UNIQUE,
 	name                    TEXT NOT NULL,
     logo                    TEXT,
     content                 JSON,
+    content_type            TEXT NOT NULL DEFAULT 'event',
+    original_language       TEXT NOT NULL DEFAULT 'en',
     deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
 	starts_on               TIMESTAMP WITH TIME ZONE NOT NULL,
 	ends_on                 TIMESTAMP WITH TIME ZONE NOT NULL,
+    timezone                TEXT NOT NULL DEFAULT 'UTC',
     date_confirmed          BOOLEAN NOT NULL DEFAULT false,
+    is_template             BOOLEAN NOT NULL DEFAULT false,
+    publication_status      TEXT NOT NULL DEFAULT 'draft' CHECK (publication_status IN ('draft', 'scheduled', 'published', 'archived')),
+    publish_at              TIMESTAMP WITH TIME ZONE,
+    published_at            TIMESTAMP WITH TIME ZONE,
+    preview_token           TEXT UNIQUE,
+    series_id               INT,
+    occurrence_date         TIMESTAMP WITH TIME ZONE,
 	created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
 	updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
-    CONSTRAINT fk_audience_name FOREIGN KEY(audience) REFERENCES audience(name)
+    CONSTRAINT fk_audience_name FOREIGN KEY(audience) REFERENCES audience(name),
+    CONSTRAINT fk_original_language_code FOREIGN KEY(original_language) REFERENCES language_list(code),
+    CONSTRAINT fk_content_type FOREIGN KEY(content_type) REFERENCES content_schema(name)
+);
+
+CREATE TABLE IF NOT EXISTS event_translation (
+    id                      SERIAL PRIMARY KEY,
+    event_id                INT NOT NULL,
+    language                TEXT NOT NULL,
+    name                    TEXT,
+    content                 JSON,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CONSTRAINT uq_event_translation UNIQUE(event_id, language),
+    CONSTRAINT fk_event_id FOREIGN KEY(event_id) REFERENCES event(id) ON DELETE CASCADE,
+    CONSTRAINT fk_language_code FOREIGN KEY(language) REFERENCES language_list(code)
+);
+
+CREATE TABLE IF NOT EXISTS event_series (
+    id                      SERIAL PRIMARY KEY,
+    template_event_id       INT NOT NULL,
+    slug                    TEXT NOT NULL UNIQUE,
+    rrule                   TEXT NOT NULL,
+    starts_on               TIMESTAMP WITH TIME ZONE NOT NULL,
+    materialized_until      TIMESTAMP WITH TIME ZONE NOT NULL,
+    deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CONSTRAINT fk_template_event_id FOREIGN KEY(template_event_id) REFERENCES event(id)
+);
+
+ALTER TABLE event ADD CONSTRAINT fk_series_id FOREIGN KEY(series_id) REFERENCES event_series(id) ON DELETE SET NULL;
+ALTER TABLE event ADD CONSTRAINT uq_series_occurrence UNIQUE(series_id, occurrence_date);
+
+CREATE TABLE IF NOT EXISTS event_series_exception (
+    id                      SERIAL PRIMARY KEY,
+    series_id               INT NOT NULL,
+    occurrence_date         TIMESTAMP WITH TIME ZONE NOT NULL,
+    moved_to                TIMESTAMP WITH TIME ZONE,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    CONSTRAINT uq_event_series_exception UNIQUE(series_id, occurrence_date),
+    CONSTRAINT fk_series_id FOREIGN KEY(series_id) REFERENCES event_series(id) ON DELETE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS event_item (
@@ -527,6 +649,8 @@ CREATE TABLE IF NOT EXISTS event_item (
     event_id                INT NOT NULL,
     item_id                 INT NOT NULL,
     deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
     created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     CONSTRAINT fk_event_id FOREIGN KEY(event_id) REFERENCES event(id) ON DELETE CASCADE,
@@ -538,7 +662,13 @@ CREATE TABLE IF NOT EXISTS event_participation_option (
     id                      SERIAL PRIMARY KEY,
     event_id                INT NOT NULL,
     participation_option    TEXT NOT NULL,
+    registration_status     TEXT NOT NULL DEFAULT 'open' CHECK (registration_status IN ('open', 'closed', 'cancelled')),
+    registration_opens_at   TIMESTAMP WITH TIME ZONE,
+    registration_closes_at  TIMESTAMP WITH TIME ZONE,
+    registration_status_changed_at TIMESTAMP WITH TIME ZONE,
     deleted                 BOOLEAN DEFAULT false,
+    deleted_at              TIMESTAMP WITH TIME ZONE,
+    deleted_by              TEXT,
     created_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     updated_at              TIMESTAMP WITH TIME ZONE DEFAULT now(),
     CONSTRAINT fk_event_id FOREIGN KEY(event_id) REFERENCES event(id) ON DELETE CASCADE,
@@ -551,6 +681,8 @@ CREATE TABLE IF NOT EXISTS participation_status (
     participant_id       INT NOT NULL,
     event_id             INT NOT NULL,
     deleted              BOOLEAN DEFAULT false,
+    deleted_at           TIMESTAMP WITH TIME ZONE,
+    deleted_by           TEXT,
     confirmed            BOOLEAN NOT NULL DEFAULT false,
     registration_date    TIMESTAMP WITH TIME ZONE NOT NULL,
     created_at           TIMESTAMP WITH TIME ZONE DEFAULT now(),
@@ -560,4 +692,250 @@ CREATE TABLE IF NOT EXISTS participation_status (
     CONSTRAINT fk_event_id FOREIGN KEY(event_id) REFERENCES event(id)  ON DELETE CASCADE
 );
 
+CREATE INDEX IF NOT EXISTS idx_participation_status_event ON participation_status(event_id, registration_date);
+
+CREATE TABLE IF NOT EXISTS check_in (
+    id                      SERIAL PRIMARY KEY,
+    participation_status_id INT NOT NULL,
+    event_id                INT NOT NULL,
+    item_id                 INT,
+    location                TEXT,
+    checked_in_by           TEXT,
+    checked_in_at           TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    CONSTRAINT fk_participation_status_id FOREIGN KEY(participation_status_id) REFERENCES participation_status(id) ON DELETE CASCADE,
+    CONSTRAINT fk_event_id FOREIGN KEY(event_id) REFERENCES event(id) ON DELETE CASCADE,
+    CONSTRAINT fk_item_id FOREIGN KEY(item_id) REFERENCES item(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uq_check_in_event ON check_in(participation_status_id) WHERE item_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS uq_check_in_item ON check_in(participation_status_id, item_id) WHERE item_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS view_session (
+    id                      BIGSERIAL PRIMARY KEY,
+    participant_id          INT NOT NULL,
+    item_id                 INT NOT NULL,
+    broadcast_url_id        INT NOT NULL,
+    language                TEXT NOT NULL,
+    started_at              TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_heartbeat_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    ended_at                TIMESTAMP WITH TIME ZONE,
+    watched_seconds         INT NOT NULL DEFAULT 0,
+    CONSTRAINT fk_participant_id FOREIGN KEY(participant_id) REFERENCES participant(id) ON DELETE CASCADE,
+    CONSTRAINT fk_item_id FOREIGN KEY(item_id) REFERENCES item(id) ON DELETE CASCADE,
+    CONSTRAINT fk_broadcast_url_id FOREIGN KEY(broadcast_url_id) REFERENCES broadcast_url(id) ON DELETE CASCADE
+) WITH (fillfactor = 70);
+
+CREATE INDEX IF NOT EXISTS idx_view_session_item ON view_session(item_id, started_at);
+
+CREATE TABLE IF NOT EXISTS participant_merge (
+    id                      SERIAL PRIMARY KEY,
+    survivor_id             INT NOT NULL,
+    merged_id               INT NOT NULL,
+    merged_snapshot         JSON NOT NULL,
+    moved_statuses          INT NOT NULL DEFAULT 0,
+    resolved_conflicts      JSON NOT NULL,
+    merged_by               TEXT,
+    created_at              TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+-- text_search_config_name maps a language code to the name of the text
+-- search configuration its content is indexed with; search/search.go lists
+-- the same configurations.
+CREATE OR REPLACE FUNCTION text_search_config_name(lang TEXT) RETURNS TEXT AS $$
+    SELECT 'pg_catalog.' || CASE split_part(lower(coalesce(lang, '')), '-', 1)
+        WHEN 'da' THEN 'danish'
+        WHEN 'nl' THEN 'dutch'
+        WHEN 'en' THEN 'english'
+        WHEN 'fi' THEN 'finnish'
+        WHEN 'fr' THEN 'french'
+        WHEN 'de' THEN 'german'
+        WHEN 'hu' THEN 'hungarian'
+        WHEN 'it' THEN 'italian'
+        WHEN 'no' THEN 'norwegian'
+        WHEN 'nb' THEN 'norwegian'
+        WHEN 'nn' THEN 'norwegian'
+        WHEN 'pt' THEN 'portuguese'
+        WHEN 'ro' THEN 'romanian'
+        WHEN 'ru' THEN 'russian'
+        WHEN 'es' THEN 'spanish'
+        WHEN 'sv' THEN 'swedish'
+        WHEN 'tr' THEN 'turkish'
+        ELSE 'simple'
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- text_search_config is the configuration itself, for the search queries.
+-- Casting a name to regconfig looks it up in the catalog, which makes it
+-- stable only.
+CREATE OR REPLACE FUNCTION text_search_config(lang TEXT) RETURNS regconfig AS $$
+    SELECT text_search_config_name(lang)::regconfig
+$$ LANGUAGE SQL STABLE;
+
+-- json_plain_text keeps the values of a JSON document, without its keys and
+-- punctuation, for indexing and highlighting.
+CREATE OR REPLACE FUNCTION json_plain_text(doc JSON) RETURNS TEXT AS $$
+    SELECT regexp_replace(coalesce(doc::text, ''), '"[^"]*"\s*:|[{}\[\]",]', ' ', 'g')
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- search_document is what the search indexes below are built on, so it has
+-- to be immutable and cannot call text_search_config. It casts the name
+-- itself: the built-in configurations qualified with pg_catalog cannot be
+-- shadowed through search_path and never change, so the lookup always
+-- gives the same result.
+CREATE OR REPLACE FUNCTION search_document(name TEXT, content JSON, lang TEXT) RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector(text_search_config_name(lang)::regconfig, coalesce(name, '')), 'A') ||
+           setweight(to_tsvector(text_search_config_name(lang)::regconfig, json_plain_text(content)), 'B')
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE INDEX IF NOT EXISTS idx_event_search ON event USING GIN (search_document(name, content, original_language));
+CREATE INDEX IF NOT EXISTS idx_event_translation_search ON event_translation USING GIN (search_document(name, content, language));
+CREATE INDEX IF NOT EXISTS idx_item_search ON item USING GIN (search_document(name, content, original_language));
+CREATE INDEX IF NOT EXISTS idx_item_translation_search ON item_translation USING GIN (search_document(name, content, language));
+
+-- pg_trgm backs the partial and fuzzy matching of the participant search.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_participant_name_trgm ON participant USING GIN (lower(first_name || ' ' || last_name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_participant_email_trgm ON participant USING GIN (lower(email) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_participant_email_domain ON participant(lower(split_part(email, '@', 2)));
+
+-- audit_log records every change made to the tables audited below, with who
+-- made it and in which request. The actor and request id are set in the
+-- transaction of each change by the service, see audit/conn.go; they are
+-- empty for the changes its schedulers make.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id                      BIGSERIAL PRIMARY KEY,
+    entity                  TEXT NOT NULL,
+    entity_id               TEXT NOT NULL,
+    action                  TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete', 'restore')),
+    before                  JSONB,
+    after                   JSONB,
+    actor                   TEXT,
+    request_id              TEXT,
+    created_at              TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity, entity_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_request ON audit_log(request_id) WHERE request_id IS NOT NULL;
+
+-- audit_row is the trigger recording a change of a row in audit_log. Its
+-- argument names the column identifying the row. An update keeps in before
+-- and after only the columns that changed, updated_at aside, and is not
+-- recorded when nothing else changed. Setting deleted is recorded as a
+-- delete and clearing it as a restore. The values of secret columns, such as
+-- the preview token of an event, are never copied: a change of one is
+-- recorded with the value replaced by "redacted".
+CREATE OR REPLACE FUNCTION audit_row() RETURNS trigger AS $$
+DECLARE
+    old_row JSONB;
+    new_row JSONB;
+    row_id TEXT;
+    row_action TEXT;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        old_row := to_jsonb(OLD);
+        row_id := old_row ->> TG_ARGV[0];
+        row_action := 'delete';
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        new_row := to_jsonb(NEW);
+        row_id := new_row ->> TG_ARGV[0];
+        row_action := 'create';
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        row_action := CASE
+            WHEN coalesce((new_row ->> 'deleted')::boolean, false) AND NOT coalesce((old_row ->> 'deleted')::boolean, false) THEN 'delete'
+            WHEN coalesce((old_row ->> 'deleted')::boolean, false) AND NOT coalesce((new_row ->> 'deleted')::boolean, false) THEN 'restore'
+            ELSE 'update'
+        END;
+        SELECT jsonb_object_agg(o.key, o.value), jsonb_object_agg(o.key, new_row -> o.key)
+        INTO old_row, new_row
+        FROM jsonb_each(old_row) o
+        WHERE o.key <> 'updated_at' AND o.value IS DISTINCT FROM new_row -> o.key;
+        IF old_row IS NULL THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+
+    IF old_row ? 'preview_token' AND old_row -> 'preview_token' <> 'null' THEN
+        old_row := jsonb_set(old_row, '{preview_token}', '"redacted"');
+    END IF;
+    IF new_row ? 'preview_token' AND new_row -> 'preview_token' <> 'null' THEN
+        new_row := jsonb_set(new_row, '{preview_token}', '"redacted"');
+    END IF;
+
+    INSERT INTO audit_log (entity, entity_id, action, before, after, actor, request_id)
+    VALUES (TG_TABLE_NAME, row_id, row_action, old_row, new_row,
+        nullif(current_setting('audit.actor', true), ''),
+        nullif(current_setting('audit.request_id', true), ''));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Entries recorded before the preview tokens were redacted.
+UPDATE audit_log SET
+    before = CASE WHEN before -> 'preview_token' <> 'null' THEN jsonb_set(before, '{preview_token}', '"redacted"') ELSE before END,
+    after = CASE WHEN after -> 'preview_token' <> 'null' THEN jsonb_set(after, '{preview_token}', '"redacted"') ELSE after END
+WHERE entity = 'event'
+    AND (before -> 'preview_token' NOT IN ('null', '"redacted"') OR after -> 'preview_token' NOT IN ('null', '"redacted"'));
+
+-- postgres 9.6 has no CREATE OR REPLACE TRIGGER; the triggers are dropped
+-- first so that this file can be applied again.
+DROP TRIGGER IF EXISTS audit_participation_option ON participation_option;
+CREATE TRIGGER audit_participation_option AFTER INSERT OR UPDATE OR DELETE ON participation_option FOR EACH ROW EXECUTE PROCEDURE audit_row('name');
+DROP TRIGGER IF EXISTS audit_platform ON platform;
+CREATE TRIGGER audit_platform AFTER INSERT OR UPDATE OR DELETE ON platform FOR EACH ROW EXECUTE PROCEDURE audit_row('name');
+DROP TRIGGER IF EXISTS audit_audience ON audience;
+CREATE TRIGGER audit_audience AFTER INSERT OR UPDATE OR DELETE ON audience FOR EACH ROW EXECUTE PROCEDURE audit_row('name');
+DROP TRIGGER IF EXISTS audit_audience_rule ON audience_rule;
+CREATE TRIGGER audit_audience_rule AFTER INSERT OR UPDATE OR DELETE ON audience_rule FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_content_schema ON content_schema;
+CREATE TRIGGER audit_content_schema AFTER INSERT OR UPDATE OR DELETE ON content_schema FOR EACH ROW EXECUTE PROCEDURE audit_row('name');
+DROP TRIGGER IF EXISTS audit_participant ON participant;
+CREATE TRIGGER audit_participant AFTER INSERT OR UPDATE OR DELETE ON participant FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_broadcast_url ON broadcast_url;
+CREATE TRIGGER audit_broadcast_url AFTER INSERT OR UPDATE OR DELETE ON broadcast_url FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_item ON item;
+CREATE TRIGGER audit_item AFTER INSERT OR UPDATE OR DELETE ON item FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_item_translation ON item_translation;
+CREATE TRIGGER audit_item_translation AFTER INSERT OR UPDATE OR DELETE ON item_translation FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_item_broadcast_url ON item_broadcast_url;
+CREATE TRIGGER audit_item_broadcast_url AFTER INSERT OR UPDATE OR DELETE ON item_broadcast_url FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event ON event;
+CREATE TRIGGER audit_event AFTER INSERT OR UPDATE OR DELETE ON event FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event_translation ON event_translation;
+CREATE TRIGGER audit_event_translation AFTER INSERT OR UPDATE OR DELETE ON event_translation FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event_series ON event_series;
+CREATE TRIGGER audit_event_series AFTER INSERT OR UPDATE OR DELETE ON event_series FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event_series_exception ON event_series_exception;
+CREATE TRIGGER audit_event_series_exception AFTER INSERT OR UPDATE OR DELETE ON event_series_exception FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event_item ON event_item;
+CREATE TRIGGER audit_event_item AFTER INSERT OR UPDATE OR DELETE ON event_item FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_event_participation_option ON event_participation_option;
+CREATE TRIGGER audit_event_participation_option AFTER INSERT OR UPDATE OR DELETE ON event_participation_option FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_participation_status ON participation_status;
+CREATE TRIGGER audit_participation_status AFTER INSERT OR UPDATE OR DELETE ON participation_status FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+DROP TRIGGER IF EXISTS audit_check_in ON check_in;
+CREATE TRIGGER audit_check_in AFTER INSERT OR UPDATE OR DELETE ON check_in FOR EACH ROW EXECUTE PROCEDURE audit_row('id');
+
+-- idempotency_key keeps the responses to the POST requests made with an
+-- Idempotency-Key header until expires_at, so that retries get the same
+-- response instead of running again. status is null while the first request
+-- is in flight. See idempotency/idempotency.go.
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    actor                   TEXT NOT NULL DEFAULT '',
+    key                     TEXT NOT NULL,
+    fingerprint             TEXT NOT NULL,
+    status                  INT,
+    content_type            TEXT,
+    location                TEXT,
+    body                    BYTEA,
+    created_at              TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at              TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (actor, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_key_expires ON idempotency_key(expires_at);
+
 COMMIT;
@@ -0,0 +1,130 @@
+// Package etag implements the conditional requests of the API. The entity tag
+// of a resource is derived from its updated_at, which every write bumps:
+// GETs by id send it as ETag and answer 304 to an If-None-Match holding it,
+// and PATCHes and DELETEs given an If-Match only go through while the row
+// still has one of the tags listed, and fail with 412 otherwise.
+package etag
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+// Of returns the entity tag of a resource last updated at updatedAt, or ""
+// when that is not known.
+func Of(updatedAt *time.Time) string {
+	if updatedAt == nil {
+		return ""
+	}
+	return `"` + strconv.FormatInt(updatedAt.UnixNano()/1000, 10) + `"`
+}
+
+// parse returns the update time of tag, which is false for tags that are not
+// from Of.
+func parse(tag string) (time.Time, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return time.Time{}, false
+	}
+	micro, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, micro*1000), true
+}
+
+// Set sets the ETag of the response to the tag of a resource last updated at
+// updatedAt, for the responses that return a resource just written.
+func Set(ctx *gin.Context, updatedAt *time.Time) {
+	if tag := Of(updatedAt); tag != "" {
+		ctx.Header("ETag", tag)
+	}
+}
+
+// NotModified sets the ETag of the response to the tag of a resource last
+// updated at updatedAt and, when the If-None-Match of the request holds it,
+// answers 304. It reports whether it did, in which case the handler is done.
+func NotModified(ctx *gin.Context, updatedAt *time.Time) bool {
+	tag := Of(updatedAt)
+	if tag == "" {
+		return false
+	}
+	Set(ctx, updatedAt)
+
+	for _, t := range strings.Split(ctx.GetHeader("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == tag || t == "*" {
+			ctx.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// IfMatch returns the update times the If-Match of the request allows, to be
+// passed to Condition. It is nil when there is no If-Match or it is "*", for
+// which any existing row will do. Weak and unknown tags match no row.
+func IfMatch(ctx *gin.Context) []time.Time {
+	header := strings.TrimSpace(ctx.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	updatedAt := []time.Time{}
+	for _, t := range strings.Split(header, ",") {
+		if at, ok := parse(strings.TrimSpace(t)); ok {
+			updatedAt = append(updatedAt, at)
+		}
+	}
+	return updatedAt
+}
+
+// Matches reports whether a row last updated at updatedAt meets ifMatch, for
+// writes that lock the row before changing it.
+func Matches(ifMatch []time.Time, updatedAt *time.Time) bool {
+	if ifMatch == nil {
+		return true
+	}
+	if updatedAt == nil {
+		return false
+	}
+	for _, at := range ifMatch {
+		if at.Equal(*updatedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition returns the SQL condition that the updated_at of the row meets
+// the ifMatch passed as parameter n, which always holds for a nil ifMatch.
+func Condition(n int) string {
+	return fmt.Sprintf("($%d::timestamptz[] is null or updated_at = any($%d))", n, n)
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// Missed returns why a write conditioned on ifMatch changed no row. Without
+// If-Match the row is not there; otherwise exists, which selects whether it
+// is, tells "precondition failed" from "not found".
+func Missed(ctx context.Context, db querier, ifMatch []time.Time, exists string, args ...interface{}) error {
+	if ifMatch == nil {
+		return fmt.Errorf("not found")
+	}
+	var found bool
+	if err := db.QueryRow(ctx, exists, args...).Scan(&found); err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("precondition failed")
+	}
+	return fmt.Errorf("not found")
+}
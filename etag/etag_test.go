@@ -0,0 +1,187 @@
+package etag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+func testContext(header string, value string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		ctx.Request.Header.Set(header, value)
+	}
+	return ctx, w
+}
+
+func TestOf(t *testing.T) {
+	if Of(nil) != "" {
+		t.Error("Of(nil) is not empty")
+	}
+
+	updatedAt := time.Date(2024, time.March, 4, 10, 0, 0, 123456789, time.UTC)
+	tag := Of(&updatedAt)
+	if tag != `"1709546400123456"` {
+		t.Errorf("Of = %s", tag)
+	}
+	at, ok := parse(tag)
+	if !ok || !at.Equal(updatedAt.Truncate(time.Microsecond)) {
+		t.Errorf("parse(%s) = %v, %v, want %v", tag, at, ok, updatedAt.Truncate(time.Microsecond))
+	}
+
+	for _, s := range []string{"", `"`, `W/"1"`, `"abc"`, `1709546400123456`} {
+		if _, ok := parse(s); ok {
+			t.Errorf("parse(%q) succeeded", s)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	updatedAt := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	tag := Of(&updatedAt)
+
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{tag, true},
+		{"W/" + tag, true},
+		{`"1", ` + tag, true},
+		{"*", true},
+		{`"1"`, false},
+	}
+
+	for _, tt := range tests {
+		ctx, w := testContext("If-None-Match", tt.ifNoneMatch)
+		if got := NotModified(ctx, &updatedAt); got != tt.want {
+			t.Errorf("NotModified with If-None-Match %q = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+		if got := w.Header().Get("ETag"); got != tag {
+			t.Errorf("ETag = %q, want %q", got, tag)
+		}
+		if tt.want && ctx.Writer.Status() != http.StatusNotModified {
+			t.Errorf("status = %d, want 304", ctx.Writer.Status())
+		}
+	}
+
+	ctx, w := testContext("If-None-Match", "*")
+	if NotModified(ctx, nil) || w.Header().Get("ETag") != "" {
+		t.Error("resource without an update time was not modified")
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	updatedAt := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	other := updatedAt.Add(time.Second)
+
+	tests := []struct {
+		ifMatch string
+		want    []time.Time
+	}{
+		{"", nil},
+		{"*", nil},
+		{Of(&updatedAt), []time.Time{updatedAt}},
+		{Of(&updatedAt) + " , " + Of(&other), []time.Time{updatedAt, other}},
+		{"W/" + Of(&updatedAt), []time.Time{}},
+		{`"abc"`, []time.Time{}},
+	}
+
+	for _, tt := range tests {
+		ctx, _ := testContext("If-Match", tt.ifMatch)
+		got := IfMatch(ctx)
+		if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+			t.Errorf("IfMatch(%q) = %v, want %v", tt.ifMatch, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("IfMatch(%q)[%d] = %v, want %v", tt.ifMatch, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	updatedAt := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	other := updatedAt.Add(time.Second)
+
+	tests := []struct {
+		name      string
+		ifMatch   []time.Time
+		updatedAt *time.Time
+		want      bool
+	}{
+		{"no If-Match", nil, &updatedAt, true},
+		{"matching tag", []time.Time{other, updatedAt}, &updatedAt, true},
+		{"other tag", []time.Time{other}, &updatedAt, false},
+		{"no usable tag", []time.Time{}, &updatedAt, false},
+		{"no update time", []time.Time{updatedAt}, nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := Matches(tt.ifMatch, tt.updatedAt); got != tt.want {
+			t.Errorf("%s: Matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCondition(t *testing.T) {
+	if got, want := Condition(3), "($3::timestamptz[] is null or updated_at = any($3))"; got != want {
+		t.Errorf("Condition(3) = %q, want %q", got, want)
+	}
+}
+
+type row struct {
+	found bool
+	err   error
+}
+
+func (r row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	*dest[0].(*bool) = r.found
+	return nil
+}
+
+type queried struct {
+	row   row
+	calls int
+}
+
+func (q *queried) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	q.calls++
+	return q.row
+}
+
+func TestMissed(t *testing.T) {
+	ctx := context.Background()
+	ifMatch := []time.Time{time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)}
+
+	db := &queried{row: row{found: true}}
+	if err := Missed(ctx, db, nil, "select true"); err == nil || err.Error() != "not found" || db.calls != 0 {
+		t.Errorf("without If-Match: %v after %d queries, want not found without querying", err, db.calls)
+	}
+	if err := Missed(ctx, db, ifMatch, "select true"); err == nil || err.Error() != "precondition failed" {
+		t.Errorf("existing row: %v, want precondition failed", err)
+	}
+
+	db = &queried{row: row{found: false}}
+	if err := Missed(ctx, db, ifMatch, "select false"); err == nil || err.Error() != "not found" {
+		t.Errorf("missing row: %v, want not found", err)
+	}
+
+	db = &queried{row: row{err: pgx.ErrTxClosed}}
+	if err := Missed(ctx, db, ifMatch, "select true"); err != pgx.ErrTxClosed {
+		t.Errorf("failing query: %v, want its error", err)
+	}
+}
@@ -2,12 +2,22 @@ package event
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audience"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/language"
+	"vh-srv-event/schema"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -15,36 +25,101 @@ import (
 )
 
 type eventResponse struct {
-	ID                   *int       `json:"id" db:"id"`
-	RegistrationRequired *bool      `json:"registration_required" db:"registration_required"`
-	RegistrationStatus   *string    `json:"registration_status" db:"registration_status"`
-	Audience             *string    `json:"audience" db:"audience"`
-	Slug                 *string    `json:"slug" db:"slug"`
-	Name                 *string    `json:"name" db:"name"`
-	Logo                 *string    `json:"logo,omitempty" db:"logo"`
-	Content              *string    `json:"content,omitempty" db:"content"`
-	Deleted              *bool      `json:"deleted" db:"deleted"`
-	StartsOn             *time.Time `json:"starts_on" db:"starts_on"`
-	EndsOn               *time.Time `json:"ends_on" db:"ends_on"`
-	DateConfirmed        *bool      `json:"date_confirmed" db:"date_confirmed"`
-	CreatedAt            *time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt            *time.Time `json:"updated_at" db:"updated_at"`
+	ID                   *int             `json:"id" db:"id"`
+	RegistrationRequired *bool            `json:"registration_required" db:"registration_required"`
+	RegistrationStatus   *string          `json:"registration_status" db:"registration_status"`
+	RegistrationOpensAt  *time.Time       `json:"registration_opens_at,omitempty" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time       `json:"registration_closes_at,omitempty" db:"registration_closes_at"`
+	Audience             *string          `json:"audience" db:"audience"`
+	Slug                 *string          `json:"slug" db:"slug"`
+	Name                 *string          `json:"name" db:"name"`
+	Logo                 *string          `json:"logo,omitempty" db:"logo"`
+	Content              *json.RawMessage `json:"content,omitempty" db:"content"`
+	ContentType          *string          `json:"content_type" db:"content_type"`
+	Language             *string          `json:"language" db:"language"`
+	OriginalLanguage     *string          `json:"original_language" db:"original_language"`
+	Translated           *bool            `json:"translated" db:"translated"`
+	Deleted              *bool            `json:"deleted" db:"deleted"`
+	DeletedAt            *time.Time       `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy            *string          `json:"deleted_by,omitempty" db:"deleted_by"`
+	StartsOn             *time.Time       `json:"starts_on" db:"starts_on"`
+	EndsOn               *time.Time       `json:"ends_on" db:"ends_on"`
+	Timezone             *string          `json:"timezone" db:"timezone"`
+	StartsOnLocal        *time.Time       `json:"starts_on_local"`
+	EndsOnLocal          *time.Time       `json:"ends_on_local"`
+	DateConfirmed        *bool            `json:"date_confirmed" db:"date_confirmed"`
+	State                *string          `json:"state" db:"state"`
+	PublicationStatus    *string          `json:"publication_status" db:"publication_status"`
+	PublishAt            *time.Time       `json:"publish_at,omitempty" db:"publish_at"`
+	PublishedAt          *time.Time       `json:"published_at,omitempty" db:"published_at"`
+	IsTemplate           *bool            `json:"is_template" db:"is_template"`
+	SeriesID             *int             `json:"series_id,omitempty" db:"series_id"`
+	OccurrenceDate       *time.Time       `json:"occurrence_date,omitempty" db:"occurrence_date"`
+	CreatedAt            *time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt            *time.Time       `json:"updated_at" db:"updated_at"`
 }
 
 type event struct {
-	RegistrationRequired *bool      `json:"registration_required" db:"registration_required"`
-	RegistrationStatus   *string    `json:"registration_status" db:"registration_status"`
-	Audience             *string    `json:"audience" db:"audience"`
-	Slug                 *string    `json:"slug" db:"slug" validate:"required"`
-	Name                 *string    `json:"name" db:"name" validate:"required"`
-	Logo                 *string    `json:"logo,omitempty" db:"logo"`
-	Content              *string    `json:"content,omitempty" db:"content"`
-	Deleted              *bool      `json:"deleted" db:"deleted"`
-	StartsOn             *time.Time `json:"starts_on" db:"starts_on" validate:"required"`
-	EndsOn               *time.Time `json:"ends_on" db:"ends_on" validate:"required"`
-	DateConfirmed        *bool      `json:"date_confirmed" db:"date_confirmed"`
+	RegistrationRequired *bool            `json:"registration_required" db:"registration_required"`
+	RegistrationStatus   *string          `json:"registration_status" db:"registration_status" validate:"omitempty,oneof=open closed cancelled"`
+	RegistrationOpensAt  *time.Time       `json:"registration_opens_at,omitempty" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time       `json:"registration_closes_at,omitempty" db:"registration_closes_at"`
+	Audience             *string          `json:"audience" db:"audience"`
+	Slug                 *string          `json:"slug" db:"slug" validate:"required"`
+	Name                 *string          `json:"name" db:"name" validate:"required"`
+	Logo                 *string          `json:"logo,omitempty" db:"logo"`
+	Content              *json.RawMessage `json:"content,omitempty" db:"content"`
+	ContentType          *string          `json:"content_type,omitempty" db:"content_type"`
+	OriginalLanguage     *string          `json:"original_language" db:"original_language"`
+	StartsOn             *time.Time       `json:"starts_on" db:"starts_on" validate:"required"`
+	EndsOn               *time.Time       `json:"ends_on" db:"ends_on" validate:"required"`
+	Timezone             *string          `json:"timezone,omitempty" db:"timezone"`
+	DateConfirmed        *bool            `json:"date_confirmed" db:"date_confirmed"`
+	IsTemplate           *bool            `json:"is_template" db:"is_template"`
+}
+
+// eventFilter holds the GetAllEvent query parameters.
+type eventFilter struct {
+	Slug     string
+	SeriesID string
+	Template bool
+	Public   bool
+	// IncludeDeleted lists deleted events too.
+	IncludeDeleted bool
+	Publication    string
+	// ParticipantID hides the events whose audience the participant is not
+	// part of; Audiences is filled in from it.
+	ParticipantID string
+	Audiences     []string
+	States        []string
+	StartsAfter   *time.Time
+	StartsBefore  *time.Time
+	EndsAfter     *time.Time
+	EndsBefore    *time.Time
 }
 
+// Lifecycle states of an event, see eventStateExpression.
+const (
+	StateDraft     = "draft"
+	StateUpcoming  = "upcoming"
+	StateLive      = "live"
+	StateEnded     = "ended"
+	StateCancelled = "cancelled"
+)
+
+var eventStates = []string{StateDraft, StateUpcoming, StateLive, StateEnded, StateCancelled}
+
+// eventStateExpression computes the lifecycle state of the event aliased e.
+// Cancellation wins over everything else, and an event whose date is not
+// confirmed yet stays a draft whatever its dates say.
+const eventStateExpression = `case 
+		when coalesce(e.deleted, false) or e.registration_status = 'cancelled' then 'cancelled' 
+		when not e.date_confirmed then 'draft' 
+		when now() < e.starts_on then 'upcoming' 
+		when now() < e.ends_on then 'live' 
+		else 'ended' 
+	end`
+
 type Event interface {
 	GetEventByID(ctx *gin.Context)
 	GetAllEvent(ctx *gin.Context)
@@ -52,22 +127,90 @@ type Event interface {
 	UpdateEventByID(ctx *gin.Context)
 	DeleteEventByID(ctx *gin.Context)
 	DeleteHardEventByID(ctx *gin.Context)
+	RestoreEventByID(ctx *gin.Context)
+	CloneEventByID(ctx *gin.Context)
+	GetEventAgendaByID(ctx *gin.Context)
+	PublishEventByID(ctx *gin.Context)
+	UnpublishEventByID(ctx *gin.Context)
+	ArchiveEventByID(ctx *gin.Context)
+	CreateEventPreviewToken(ctx *gin.Context)
+	GetEventByPreviewToken(ctx *gin.Context)
+	GetPublicEventBySlug(ctx *gin.Context)
+	GetAllPublicEvent(ctx *gin.Context)
 }
 
 type EventDB struct {
-	db *pgxpool.Pool
+	db                   *pgxpool.Pool
+	lang                 *language.Resolver
+	translationLanguages []string
+	schemas              *schema.Registry
+	audiences            *audience.Evaluator
 }
 
-func NewEvent(db *pgxpool.Pool) Event {
+func NewEvent(db *pgxpool.Pool, lang *language.Resolver, translationLanguages []string, schemas *schema.Registry, audiences *audience.Evaluator) Event {
 	return &EventDB{
 		db,
+		lang,
+		translationLanguages,
+		schemas,
+		audiences,
 	}
 }
 
+// eventSelectQuery reads events with name and content taken from the best
+// translation for the candidate languages in $1, falling back to the original
+// text. translated is true when every language in $2 is covered.
+const eventSelectQuery = `select 
+	e.id,
+	e.registration_required,
+	e.registration_status,
+	e.registration_opens_at,
+	e.registration_closes_at,
+	e.audience,
+	e.slug,
+	coalesce(tr.name, e.name),
+	e.logo,
+	coalesce(tr.content, e.content),
+	e.content_type,
+	coalesce(tr.language, e.original_language),
+	e.original_language,
+	not exists (
+		select 1 from unnest($2::text[]) l(code) 
+		where l.code <> e.original_language 
+		and not exists (select 1 from event_translation t where t.event_id = e.id and t.language = l.code)
+	),
+	e.deleted,
+	e.deleted_at,
+	e.deleted_by,
+	e.starts_on,
+	e.ends_on,
+	e.timezone,
+	e.date_confirmed,
+	` + eventStateExpression + `,
+	e.publication_status,
+	e.publish_at,
+	e.published_at,
+	e.is_template,
+	e.series_id,
+	e.occurrence_date,
+	e.created_at,
+	e.updated_at 
+	from event e 
+	left join lateral (
+		select t.language, t.name, t.content from event_translation t 
+		where t.event_id = e.id 
+		and t.language = any($1::text[]) 
+		and array_position($1::text[], t.language) < coalesce(array_position($1::text[], e.original_language), 2147483647) 
+		order by array_position($1::text[], t.language) 
+		limit 1
+	) tr on true`
+
+// GetEventByID returns the event, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *EventDB) GetEventByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getEventByID(r, ctx, id)
+	u, err := getEventByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -83,13 +226,72 @@ func (r *EventDB) GetEventByID(ctx *gin.Context) {
 		})
 		return
 	}
+	// The translation picked depends on Accept-Language.
+	ctx.Header("Vary", "Accept-Language")
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
 func (r *EventDB) GetAllEvent(ctx *gin.Context) {
+	filter, err := eventFilterFromQuery(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+		return
+	}
+
+	listEvents(r, ctx, filter)
+}
+
+// eventFilterFromQuery reads the GetAllEvent filters from the query string.
+func eventFilterFromQuery(ctx *gin.Context) (eventFilter, error) {
+	filter := eventFilter{
+		Slug:        ctx.Query("slug"),
+		SeriesID:    ctx.Query("series_id"),
+		Template:    ctx.Query("template") == "true",
+		Publication: ctx.Query("publication_status"),
+
+		IncludeDeleted: ctx.Query("include_deleted") == "true",
+
+		ParticipantID: ctx.Query("participant_id"),
+	}
+
+	if state := ctx.Query("state"); state != "" {
+		for _, st := range strings.Split(state, ",") {
+			st = strings.TrimSpace(st)
+			if !isEventState(st) {
+				return eventFilter{}, fmt.Errorf("Invalid state value! Accepted values are %s", strings.Join(eventStates, ", "))
+			}
+			filter.States = append(filter.States, st)
+		}
+	}
+
+	for param, target := range map[string]**time.Time{
+		"starts_after":  &filter.StartsAfter,
+		"starts_before": &filter.StartsBefore,
+		"ends_after":    &filter.EndsAfter,
+		"ends_before":   &filter.EndsBefore,
+	} {
+		value := ctx.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseDateParam(value)
+		if err != nil {
+			return eventFilter{}, fmt.Errorf("Invalid %s value! Accepted values are RFC 3339 timestamps or YYYY-MM-DD dates", param)
+		}
+		*target = &t
+	}
+
+	return filter, nil
+}
+
+// listEvents responds with the page of events selected by filter and the
+// skip and limit query parameters.
+func listEvents(r *EventDB, ctx *gin.Context, filter eventFilter) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
-	slug := ctx.Query("slug")
 
 	if skip == "" {
 		skip = "0"
@@ -113,7 +315,20 @@ func (r *EventDB) GetAllEvent(ctx *gin.Context) {
 		return
 	}
 
-	fetchedEvents, err := getAllEvent(r, ctx, intSkip, intLimit, slug)
+	if filter.ParticipantID != "" {
+		audiences, err := r.audiences.EligibleAudiences(ctx, filter.ParticipantID)
+		if err != nil {
+			if err.Error() == "participant not found" {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+				return
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "success": false})
+			return
+		}
+		filter.Audiences = audiences
+	}
+
+	fetchedEvents, err := getAllEvent(r, ctx, intSkip, intLimit, filter)
 
 	// Manage if no event found
 	if len(*fetchedEvents) == 0 {
@@ -154,7 +369,44 @@ func (r *EventDB) CreateNewEvent(ctx *gin.Context) {
 		return
 	}
 
-	if err := CreateEvent(r, ctx, s); err != nil {
+	if err := validateRegistrationWindow(s.RegistrationOpensAt, s.RegistrationClosesAt); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if s.RegistrationStatus == nil {
+		status := initialRegistrationStatus(s.RegistrationOpensAt, s.RegistrationClosesAt)
+		s.RegistrationStatus = &status
+	}
+
+	if s.Timezone != nil {
+		if _, err := loadTimezone(*s.Timezone); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+	}
+
+	if err := validateEventContent(r, ctx, s, ""); err != nil {
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -162,7 +414,27 @@ func (r *EventDB) CreateNewEvent(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event!", "data": s, "success": true})
+	id, err := CreateEvent(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event!", "data": u, "success": true})
 }
 
 func (r *EventDB) UpdateEventByID(ctx *gin.Context) {
@@ -175,9 +447,54 @@ func (r *EventDB) UpdateEventByID(ctx *gin.Context) {
 		return
 	}
 
+	if err := validateEventUpdate(u); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
 	id := ctx.Param("id")
 
-	if err := updateEventByID(r, ctx, u, id); err != nil {
+	if err := validateEventContent(r, ctx, u, id); err != nil {
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if err := updateEventByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -187,6 +504,14 @@ func (r *EventDB) UpdateEventByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -201,14 +526,41 @@ func (r *EventDB) UpdateEventByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Event updated successfully", "data": u, "success": true})
+
+	updated, err := getEventByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event updated successfully", "data": updated, "success": true})
 }
 
+// DeleteEventByID soft deletes the event along with its items, participation
+// options and participation statuses.
 func (r *EventDB) DeleteEventByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteEventByID(r, ctx, id); err != nil {
+	if err := deleteEventByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -219,11 +571,64 @@ func (r *EventDB) DeleteEventByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Event deleted successfully!", "success": true})
 }
 
+// RestoreEventByID restores the event along with the items, participation
+// options and participation statuses deleted with it.
+func (r *EventDB) RestoreEventByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreEventByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event restored successfully!", "data": u, "success": true})
+}
+
 func (r *EventDB) DeleteHardEventByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteHardEventByID(r, ctx, id); err != nil {
+	if err := deleteHardEventByID(r, ctx, id, etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -234,36 +639,46 @@ func (r *EventDB) DeleteHardEventByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Event deleted successfully!", "success": true})
 }
 
-func getEventByID(r *EventDB, ctx *gin.Context, id string) (eventResponse, error) {
+func getEventByID(r *EventDB, ctx *gin.Context, id string, includeDeleted bool) (eventResponse, error) {
+	if includeDeleted {
+		return getEvent(r, ctx, `e.id = $3`, id)
+	}
+	return getEvent(r, ctx, `e.id = $3 and coalesce(e.deleted, false) = false`, id)
+}
+
+// getEvent reads the single event matching condition, in which $3 is arg.
+func getEvent(r *EventDB, ctx *gin.Context, condition string, arg interface{}) (eventResponse, error) {
 	u := eventResponse{}
-	if err := r.db.QueryRow(ctx, `select 
-	id,
-	registration_required,
-	registration_status,
-	audience,
-	slug,
-	name,
-	logo,
-	content,
-	deleted,
-	starts_on,
-	ends_on,
-	date_confirmed,
-	created_at,
-	updated_at 
-	from event where id = $1`, id).Scan(
+	if err := r.db.QueryRow(ctx, eventSelectQuery+` where `+condition,
+		r.lang.Expand(language.Requested(ctx)...), r.translationLanguages, arg).Scan(
 		&u.ID,
 		&u.RegistrationRequired,
 		&u.RegistrationStatus,
+		&u.RegistrationOpensAt,
+		&u.RegistrationClosesAt,
 		&u.Audience,
 		&u.Slug,
 		&u.Name,
 		&u.Logo,
 		&u.Content,
+		&u.ContentType,
+		&u.Language,
+		&u.OriginalLanguage,
+		&u.Translated,
 		&u.Deleted,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.StartsOn,
 		&u.EndsOn,
+		&u.Timezone,
 		&u.DateConfirmed,
+		&u.State,
+		&u.PublicationStatus,
+		&u.PublishAt,
+		&u.PublishedAt,
+		&u.IsTemplate,
+		&u.SeriesID,
+		&u.OccurrenceDate,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -272,54 +687,46 @@ func getEventByID(r *EventDB, ctx *gin.Context, id string) (eventResponse, error
 		}
 		return eventResponse{}, err
 	}
+	localizeEvent(&u)
 	return u, nil
 }
 
-func getAllEvent(r *EventDB, ctx *gin.Context, skip int, limit int, slug string) (*[]eventResponse, error) {
+func getAllEvent(r *EventDB, ctx *gin.Context, skip int, limit int, filter eventFilter) (*[]eventResponse, error) {
 
-	whereQuery := buildAndGetWhereEventQuery(slug)
+	args := []interface{}{r.lang.Expand(language.Requested(ctx)...), r.translationLanguages}
+	whereQuery, args := buildAndGetWhereEventQuery(filter, args)
 
 	u := []eventResponse{}
-	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
-	id,
-	registration_required,
-	registration_status,
-	audience,
-	slug,
-	name,
-	logo,
-	content,
-	deleted,
-	starts_on,
-	ends_on,
-	date_confirmed,
-	created_at,
-	updated_at 
-	from event`+whereQuery+" LIMIT %d OFFSET %d", limit, skip))
+	rows, err := r.db.Query(ctx, eventSelectQuery+whereQuery+fmt.Sprintf(" LIMIT %d OFFSET %d", limit, skip), args...)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var d eventResponse
-		err := rows.Scan(&d.ID, &d.RegistrationRequired, &d.RegistrationStatus, &d.Audience, &d.Slug, &d.Name, &d.Logo, &d.Content, &d.Deleted, &d.StartsOn, &d.EndsOn, &d.DateConfirmed, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.RegistrationRequired, &d.RegistrationStatus, &d.RegistrationOpensAt, &d.RegistrationClosesAt, &d.Audience, &d.Slug, &d.Name, &d.Logo, &d.Content, &d.ContentType, &d.Language, &d.OriginalLanguage, &d.Translated, &d.Deleted, &d.DeletedAt, &d.DeletedBy, &d.StartsOn, &d.EndsOn, &d.Timezone, &d.DateConfirmed, &d.State, &d.PublicationStatus, &d.PublishAt, &d.PublishedAt, &d.IsTemplate, &d.SeriesID, &d.OccurrenceDate, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
+		localizeEvent(&d)
 		u = append(u, d)
 	}
 	return &u, rows.Err()
 }
 
-func updateEventByID(r *EventDB, ctx *gin.Context, req event, id string) error {
+func updateEventByID(r *EventDB, ctx *gin.Context, req event, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareEventUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE event SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE event SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating event: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event where id = $1)`, id)
 		}
 
 		return nil
@@ -328,36 +735,161 @@ func updateEventByID(r *EventDB, ctx *gin.Context, req event, id string) error {
 	}
 }
 
-func CreateEvent(r *EventDB, ctx *gin.Context, req event) error {
+// validateEventContent checks the content of a create (id == "") or update
+// request against the schema of its content type. On update, the stored
+// content type or content is used for whichever of the two is not changed.
+func validateEventContent(r *EventDB, ctx *gin.Context, req event, id string) error {
+	if req.Content == nil && req.ContentType == nil {
+		return nil
+	}
+
+	contentType := "event"
+	var content []byte
+	if id != "" {
+		if err := r.db.QueryRow(ctx, `select content_type, content from event where id = $1`, id).Scan(&contentType, &content); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+	}
+	if req.ContentType != nil {
+		contentType = *req.ContentType
+	}
+	if req.Content != nil {
+		content = *req.Content
+	}
+
+	return r.schemas.Validate(ctx, contentType, content)
+}
+
+func CreateEvent(r *EventDB, ctx *gin.Context, req event) (int, error) {
 
 	createString, numString, createQueryArgs := prepareEventCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO event (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating event: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO event (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating event: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func deleteEventByID(r *EventDB, ctx context.Context, id string) error {
+func deleteEventByID(r *EventDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var eventID int
+		var updatedAt *time.Time
+		if err := tx.QueryRow(ctx, `select id, updated_at from event where id = $1 and coalesce(deleted, false) = false for update`, id).Scan(&eventID, &updatedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !etag.Matches(ifMatch, updatedAt) {
+			return fmt.Errorf("precondition failed")
+		}
 
-	eventQuery := "UPDATE event SET deleted = true WHERE id=" + id + ";"
-	eventItemQuery := "UPDATE event_item SET deleted = true WHERE event_id=" + id + ";"
-	eventPartQuery := "UPDATE event_participation_option SET deleted = true WHERE event_id=" + id + ";"
-	eventStatusQuery := "UPDATE participation_status SET deleted = true WHERE event_id=" + id + ";"
-	_, err := r.db.Exec(ctx, eventQuery+eventItemQuery+eventPartQuery+eventStatusQuery)
-	return err
+		return softDeleteEvent(ctx, tx, eventID, by)
+	})
 }
 
-func deleteHardEventByID(r *EventDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from event where id=$1", id)
-	return err
+func restoreEventByID(r *EventDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var eventID int
+		var deleted bool
+		var deletedAt *time.Time
+		if err := tx.QueryRow(ctx, `select id, coalesce(deleted, false), deleted_at from event where id = $1 for update`, id).Scan(&eventID, &deleted, &deletedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+
+		return restoreEvent(ctx, tx, eventID, deletedAt)
+	})
+}
+
+// softDeleteEvent marks an event deleted along with its items, participation
+// options and participation statuses, like DELETE /v1/event/:id does. They
+// all get the transaction time as deletion time, which restoreEvent goes by;
+// rows deleted before keep theirs.
+func softDeleteEvent(ctx context.Context, tx pgx.Tx, id int, by *string) error {
+	for _, query := range []string{
+		`UPDATE event SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE id = $1 AND coalesce(deleted, false) = false`,
+		`UPDATE event_item SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE event_id = $1 AND coalesce(deleted, false) = false`,
+		`UPDATE event_participation_option SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE event_id = $1 AND coalesce(deleted, false) = false`,
+		`UPDATE participation_status SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE event_id = $1 AND coalesce(deleted, false) = false`,
+	} {
+		if _, err := tx.Exec(ctx, query, id, by); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreEvent undoes softDeleteEvent: the event is restored along with the
+// rows deleted at deletedAt, except the items and participants deleted since.
+// Items unlinked and registrations cancelled before stay deleted.
+func restoreEvent(ctx context.Context, tx pgx.Tx, id int, deletedAt *time.Time) error {
+	for _, query := range []string{
+		`UPDATE event_item ei SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ei.event_id = $1 AND coalesce(ei.deleted, false) = true AND ei.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from item i where i.id = ei.item_id and coalesce(i.deleted, false) = true)`,
+		`UPDATE event_participation_option SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE event_id = $1 AND coalesce(deleted, false) = true AND deleted_at IS NOT DISTINCT FROM $2`,
+		`UPDATE participation_status ps SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ps.event_id = $1 AND coalesce(ps.deleted, false) = true AND ps.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from participant p where p.id = ps.participant_id and coalesce(p.deleted, false) = true)`,
+		`UPDATE event SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE id = $1 AND deleted_at IS NOT DISTINCT FROM $2`,
+	} {
+		if _, err := tx.Exec(ctx, query, id, deletedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteHardEventByID(r *EventDB, ctx context.Context, id string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, "delete from event where id=$1 and "+etag.Condition(2), id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 && ifMatch != nil {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event where id = $1)`, id)
+	}
+	return nil
+}
+
+// validateEventUpdate checks the fields of an event update that the database
+// would accept but the service cannot work with.
+func validateEventUpdate(req event) error {
+	if req.RegistrationStatus != nil {
+		if err := validator.New().Var(*req.RegistrationStatus, "oneof=open closed cancelled"); err != nil {
+			return fmt.Errorf("Invalid registration_status value! Accepted values are open, closed and cancelled")
+		}
+	}
+	if err := validateRegistrationWindow(req.RegistrationOpensAt, req.RegistrationClosesAt); err != nil {
+		return err
+	}
+	if req.Timezone != nil {
+		if _, err := loadTimezone(*req.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func prepareEventUpdateQuery(req event) (string, []interface{}) {
@@ -371,6 +903,18 @@ func prepareEventUpdateQuery(req event) (string, []interface{}) {
 	if req.RegistrationStatus != nil {
 		updateStrings = append(updateStrings, fmt.Sprintf("registration_status=$%d", len(updateStrings)+1))
 		args = append(args, *req.RegistrationStatus)
+		// A manual change is not overridden by the registration scheduler
+		// for windows that started before it.
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_status_changed_at=$%d", len(updateStrings)+1))
+		args = append(args, time.Now())
+	}
+	if req.RegistrationOpensAt != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_opens_at=$%d", len(updateStrings)+1))
+		args = append(args, *req.RegistrationOpensAt)
+	}
+	if req.RegistrationClosesAt != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_closes_at=$%d", len(updateStrings)+1))
+		args = append(args, *req.RegistrationClosesAt)
 	}
 	if req.Audience != nil {
 		updateStrings = append(updateStrings, fmt.Sprintf("audience=$%d", len(updateStrings)+1))
@@ -392,9 +936,13 @@ func prepareEventUpdateQuery(req event) (string, []interface{}) {
 		updateStrings = append(updateStrings, fmt.Sprintf("content=$%d", len(updateStrings)+1))
 		args = append(args, *req.Content)
 	}
-	if req.Deleted != nil {
-		updateStrings = append(updateStrings, fmt.Sprintf("deleted=$%d", len(updateStrings)+1))
-		args = append(args, *req.Deleted)
+	if req.ContentType != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("content_type=$%d", len(updateStrings)+1))
+		args = append(args, *req.ContentType)
+	}
+	if req.OriginalLanguage != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("original_language=$%d", len(updateStrings)+1))
+		args = append(args, *req.OriginalLanguage)
 	}
 	if req.StartsOn != nil {
 		updateStrings = append(updateStrings, fmt.Sprintf("starts_on=$%d", len(updateStrings)+1))
@@ -404,10 +952,18 @@ func prepareEventUpdateQuery(req event) (string, []interface{}) {
 		updateStrings = append(updateStrings, fmt.Sprintf("ends_on=$%d", len(updateStrings)+1))
 		args = append(args, *req.EndsOn)
 	}
+	if req.Timezone != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("timezone=$%d", len(updateStrings)+1))
+		args = append(args, *req.Timezone)
+	}
 	if req.DateConfirmed != nil {
 		updateStrings = append(updateStrings, fmt.Sprintf("date_confirmed=$%d", len(updateStrings)+1))
 		args = append(args, *req.DateConfirmed)
 	}
+	if req.IsTemplate != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("is_template=$%d", len(updateStrings)+1))
+		args = append(args, *req.IsTemplate)
+	}
 
 	if len(args) != 0 {
 		updateStrings = append(updateStrings, fmt.Sprintf("updated_at=$%d", len(updateStrings)+1))
@@ -434,6 +990,16 @@ func prepareEventCreateQuery(req event) (string, string, []interface{}) {
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.RegistrationStatus)
 	}
+	if req.RegistrationOpensAt != nil {
+		createStrings = append(createStrings, "registration_opens_at")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.RegistrationOpensAt)
+	}
+	if req.RegistrationClosesAt != nil {
+		createStrings = append(createStrings, "registration_closes_at")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.RegistrationClosesAt)
+	}
 	if req.Audience != nil {
 		createStrings = append(createStrings, "audience")
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
@@ -459,10 +1025,15 @@ func prepareEventCreateQuery(req event) (string, string, []interface{}) {
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.Content)
 	}
-	if req.Deleted != nil {
-		createStrings = append(createStrings, "deleted")
+	if req.ContentType != nil {
+		createStrings = append(createStrings, "content_type")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.ContentType)
+	}
+	if req.OriginalLanguage != nil {
+		createStrings = append(createStrings, "original_language")
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
-		args = append(args, *req.Deleted)
+		args = append(args, *req.OriginalLanguage)
 	}
 	if req.StartsOn != nil {
 		createStrings = append(createStrings, "starts_on")
@@ -474,11 +1045,21 @@ func prepareEventCreateQuery(req event) (string, string, []interface{}) {
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.EndsOn)
 	}
+	if req.Timezone != nil {
+		createStrings = append(createStrings, "timezone")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.Timezone)
+	}
 	if req.DateConfirmed != nil {
 		createStrings = append(createStrings, "date_confirmed")
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.DateConfirmed)
 	}
+	if req.IsTemplate != nil {
+		createStrings = append(createStrings, "is_template")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.IsTemplate)
+	}
 
 	concatedCreateString := strings.Join(createStrings, ",")
 	concatedNumString := strings.Join(numString, ",")
@@ -486,22 +1067,77 @@ func prepareEventCreateQuery(req event) (string, string, []interface{}) {
 	return concatedCreateString, concatedNumString, args
 }
 
-func buildAndGetWhereEventQuery(slug string) string {
+func buildAndGetWhereEventQuery(filter eventFilter, args []interface{}) (string, []interface{}) {
 
-	var whereString strings.Builder
-	var whereCondition strings.Builder
-	whereString.WriteString(" WHERE")
-	whereCondition.WriteString("")
+	var conditions []string
 
 	// WHERE query generation based on parameters
-	if slug != "" {
-		whereCondition.WriteString(fmt.Sprintf(" slug='%s'", slug))
+	if filter.Slug != "" {
+		args = append(args, filter.Slug)
+		conditions = append(conditions, fmt.Sprintf("e.slug=$%d", len(args)))
+	}
+	if filter.SeriesID != "" {
+		args = append(args, filter.SeriesID)
+		conditions = append(conditions, fmt.Sprintf("e.series_id=$%d", len(args)))
 	}
 
-	if whereCondition.String() != "" {
-		whereString.WriteString(whereCondition.String())
-	} else {
-		whereString.Reset()
+	if len(filter.States) != 0 {
+		args = append(args, filter.States)
+		conditions = append(conditions, fmt.Sprintf("(%s) = any($%d::text[])", eventStateExpression, len(args)))
+	}
+	if filter.StartsAfter != nil {
+		args = append(args, *filter.StartsAfter)
+		conditions = append(conditions, fmt.Sprintf("e.starts_on>=$%d", len(args)))
+	}
+	if filter.StartsBefore != nil {
+		args = append(args, *filter.StartsBefore)
+		conditions = append(conditions, fmt.Sprintf("e.starts_on<$%d", len(args)))
+	}
+	if filter.EndsAfter != nil {
+		args = append(args, *filter.EndsAfter)
+		conditions = append(conditions, fmt.Sprintf("e.ends_on>=$%d", len(args)))
+	}
+	if filter.EndsBefore != nil {
+		args = append(args, *filter.EndsBefore)
+		conditions = append(conditions, fmt.Sprintf("e.ends_on<$%d", len(args)))
+	}
+
+	if filter.Publication != "" {
+		args = append(args, filter.Publication)
+		conditions = append(conditions, fmt.Sprintf("e.publication_status=$%d", len(args)))
+	}
+	if filter.ParticipantID != "" {
+		args = append(args, filter.Audiences)
+		conditions = append(conditions, fmt.Sprintf("e.audience = any($%d::text[])", len(args)))
+	}
+	if filter.Public {
+		conditions = append(conditions, "e.publication_status='published'")
+	}
+	if filter.Public || !filter.IncludeDeleted {
+		conditions = append(conditions, "coalesce(e.deleted, false)=false")
+	}
+
+	// Templates are only listed when asked for explicitly.
+	args = append(args, filter.Template)
+	conditions = append(conditions, fmt.Sprintf("e.is_template=$%d", len(args)))
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func isEventState(s string) bool {
+	for _, st := range eventStates {
+		if st == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDateParam reads a query parameter given either as an RFC 3339
+// timestamp or as a date, which stands for midnight UTC.
+func parseDateParam(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
 	}
-	return whereString.String()
+	return time.Parse("2006-01-02", s)
 }
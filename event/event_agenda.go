@@ -0,0 +1,117 @@
+package event
+
+import (
+	"net/http"
+	"time"
+
+	"vh-srv-event/language"
+
+	"github.com/gin-gonic/gin"
+)
+
+type agendaResponse struct {
+	Event          eventResponse        `json:"event"`
+	ViewerTimezone string               `json:"viewer_timezone"`
+	StartsOnViewer *time.Time           `json:"starts_on_viewer"`
+	EndsOnViewer   *time.Time           `json:"ends_on_viewer"`
+	Items          []agendaItemResponse `json:"items"`
+}
+
+type agendaItemResponse struct {
+	ItemID          *int       `json:"item_id" db:"id"`
+	Name            *string    `json:"name" db:"name"`
+	StartDate       *time.Time `json:"start_date" db:"start_date"`
+	StartDateLocal  *time.Time `json:"start_date_local"`
+	StartDateViewer *time.Time `json:"start_date_viewer"`
+	Duration        *int       `json:"duration" db:"duration"`
+}
+
+// GetEventAgendaByID lists the items of an event in start order with their
+// times in UTC, in the event's timezone and in the viewer's timezone given as
+// ?tz= (the event's timezone when omitted).
+func (r *EventDB) GetEventAgendaByID(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	var viewer *time.Location
+	if tz := ctx.Query("tz"); tz != "" {
+		loc, err := loadTimezone(tz)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		viewer = loc
+	}
+
+	u, err := getEventAgendaByID(r, ctx, id, viewer)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func getEventAgendaByID(r *EventDB, ctx *gin.Context, id string, viewer *time.Location) (agendaResponse, error) {
+	e, err := getEventByID(r, ctx, id, false)
+	if err != nil {
+		return agendaResponse{}, err
+	}
+
+	local := e.StartsOnLocal.Location()
+	if viewer == nil {
+		viewer = local
+	}
+
+	u := agendaResponse{
+		Event:          e,
+		ViewerTimezone: viewer.String(),
+		Items:          []agendaItemResponse{},
+	}
+	_, u.StartsOnViewer = inZones(e.StartsOn, viewer)
+	_, u.EndsOnViewer = inZones(e.EndsOn, viewer)
+
+	rows, err := r.db.Query(ctx, `select 
+	i.id,
+	coalesce(tr.name, i.name),
+	i.start_date,
+	i.duration 
+	from event_item ei 
+	join item i on i.id = ei.item_id 
+	left join lateral (
+		select t.name from item_translation t 
+		where t.item_id = i.id 
+		and t.language = any($1::text[]) 
+		and array_position($1::text[], t.language) < coalesce(array_position($1::text[], i.original_language), 2147483647) 
+		order by array_position($1::text[], t.language) 
+		limit 1
+	) tr on true 
+	where ei.event_id = $2 and ei.deleted = false and coalesce(i.deleted, false) = false 
+	order by i.start_date asc, i.id asc`, r.lang.Expand(language.Requested(ctx)...), id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d agendaItemResponse
+		if err := rows.Scan(&d.ItemID, &d.Name, &d.StartDate, &d.Duration); err != nil {
+			return u, err
+		}
+		d.StartDate, d.StartDateLocal = inZones(d.StartDate, local)
+		_, d.StartDateViewer = inZones(d.StartDate, viewer)
+		u.Items = append(u.Items, d)
+	}
+	return u, rows.Err()
+}
@@ -0,0 +1,275 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+)
+
+type eventClone struct {
+	Slug                 *string    `json:"slug" validate:"required"`
+	Name                 *string    `json:"name,omitempty"`
+	StartsOn             *time.Time `json:"starts_on" validate:"required"`
+	IsTemplate           *bool      `json:"is_template,omitempty"`
+	IncludeBroadcastURLs *bool      `json:"include_broadcast_urls,omitempty"`
+}
+
+// CloneEventByID deep-copies an event under a new slug, shifting its dates
+// and the start dates of its items so that the copy starts on starts_on. The
+// copy is a draft whatever the publication status of the event, so that it
+// can be reviewed before it is published.
+func (r *EventDB) CloneEventByID(ctx *gin.Context) {
+	s := eventClone{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id := ctx.Param("id")
+
+	newID, err := cloneEventByID(r, ctx, id, s)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "slug already exists" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventByID(r, ctx, fmt.Sprint(newID), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	// The clone is at /event/:id, two levels up from /event/:id/clone.
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, "../..", fmt.Sprint(newID)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Event cloned!", "data": u, "success": true})
+}
+
+func cloneEventByID(r *EventDB, ctx context.Context, id string, req eventClone) (int, error) {
+	var newID int
+	err := txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var startsOn time.Time
+		if err := tx.QueryRow(ctx, `select starts_on from event where id = $1 and coalesce(deleted, false) = false`, id).Scan(&startsOn); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		shift := req.StartsOn.Sub(startsOn)
+
+		var slugTaken bool
+		if err := tx.QueryRow(ctx, `select exists(select 1 from event where slug = $1)`, *req.Slug).Scan(&slugTaken); err != nil {
+			return err
+		}
+		if slugTaken {
+			return fmt.Errorf("slug already exists")
+		}
+
+		isTemplate := false
+		if req.IsTemplate != nil {
+			isTemplate = *req.IsTemplate
+		}
+
+		var err error
+		newID, err = copyEvent(ctx, tx, id, *req.Slug, req.Name, shift, isTemplate, false)
+		if err != nil {
+			return err
+		}
+
+		includeBroadcastURLs := req.IncludeBroadcastURLs != nil && *req.IncludeBroadcastURLs
+		return copyEventChildren(ctx, tx, id, newID, shift, includeBroadcastURLs)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// copyEvent inserts a copy of the event row and its translations, with the
+// dates moved by shift, and returns the id of the copy. The copy is a draft
+// unless keepPublication is set, in which case it takes the publication
+// status of the event: a scheduled publication is moved by shift too and a
+// published copy counts as published now. Archived events are copied as
+// drafts either way.
+func copyEvent(ctx context.Context, tx pgx.Tx, id string, slug string, name *string, shift time.Duration, isTemplate bool, keepPublication bool) (int, error) {
+	var newID int
+	if err := tx.QueryRow(ctx, `INSERT INTO event (
+			registration_required,
+			registration_status,
+			registration_opens_at,
+			registration_closes_at,
+			audience,
+			slug,
+			name,
+			logo,
+			content,
+			content_type,
+			original_language,
+			starts_on,
+			ends_on,
+			timezone,
+			date_confirmed,
+			is_template,
+			publication_status,
+			publish_at,
+			published_at)
+		SELECT
+			registration_required,
+			registration_status,
+			registration_opens_at + $4::interval,
+			registration_closes_at + $4::interval,
+			audience,
+			$2,
+			coalesce($3, name),
+			logo,
+			content,
+			content_type,
+			original_language,
+			starts_on + $4::interval,
+			ends_on + $4::interval,
+			timezone,
+			date_confirmed,
+			$5,
+			CASE WHEN $6 AND publication_status <> 'archived' THEN publication_status ELSE 'draft' END,
+			CASE WHEN $6 AND publication_status = 'scheduled' THEN publish_at + $4::interval END,
+			CASE WHEN $6 AND publication_status = 'published' THEN now() END
+		FROM event WHERE id = $1
+		RETURNING id`, id, slug, name, shift, isTemplate, keepPublication).Scan(&newID); err != nil {
+		return 0, fmt.Errorf("problem cloning event: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO event_translation (event_id, language, name, content)
+		SELECT $2, language, name, content FROM event_translation WHERE event_id = $1`, id, newID); err != nil {
+		return 0, fmt.Errorf("problem cloning event translations: %w", err)
+	}
+
+	return newID, nil
+}
+
+// copyEventChildren copies the participation options and items of an event
+// to another one. Items are copied rather than shared so that their start
+// dates can be shifted; broadcast URL links are copied on request.
+func copyEventChildren(ctx context.Context, tx pgx.Tx, fromID string, toID int, shift time.Duration, includeBroadcastURLs bool) error {
+	if _, err := tx.Exec(ctx, `INSERT INTO event_participation_option (
+			event_id,
+			participation_option,
+			registration_status,
+			registration_opens_at,
+			registration_closes_at)
+		SELECT
+			$2,
+			participation_option,
+			registration_status,
+			registration_opens_at + $3::interval,
+			registration_closes_at + $3::interval
+		FROM event_participation_option
+		WHERE event_id = $1 AND deleted = false`, fromID, toID, shift); err != nil {
+		return fmt.Errorf("problem cloning event participation options: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `select ei.item_id from event_item ei
+		join item i on i.id = ei.item_id
+		where ei.event_id = $1 and ei.deleted = false and coalesce(i.deleted, false) = false
+		order by ei.id asc`, fromID)
+	if err != nil {
+		return err
+	}
+	var itemIDs []int
+	for rows.Next() {
+		var itemID int
+		if err := rows.Scan(&itemID); err != nil {
+			rows.Close()
+			return err
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, itemID := range itemIDs {
+		var newItemID int
+		if err := tx.QueryRow(ctx, `INSERT INTO item (
+				start_date,
+				duration,
+				name,
+				content,
+				content_type,
+				original_language)
+			SELECT
+				start_date + $2::interval,
+				duration,
+				name,
+				content,
+				content_type,
+				original_language
+			FROM item WHERE id = $1
+			RETURNING id`, itemID, shift).Scan(&newItemID); err != nil {
+			return fmt.Errorf("problem cloning item: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `INSERT INTO item_translation (item_id, language, name, content)
+			SELECT $2, language, name, content FROM item_translation WHERE item_id = $1`, itemID, newItemID); err != nil {
+			return fmt.Errorf("problem cloning item translations: %w", err)
+		}
+
+		if includeBroadcastURLs {
+			if _, err := tx.Exec(ctx, `INSERT INTO item_broadcast_url (item_id, broadcast_url_id)
+				SELECT $2, ib.broadcast_url_id FROM item_broadcast_url ib
+				JOIN broadcast_url b ON b.id = ib.broadcast_url_id
+				WHERE ib.item_id = $1 AND coalesce(ib.deleted, false) = false AND coalesce(b.deleted, false) = false`, itemID, newItemID); err != nil {
+				return fmt.Errorf("problem cloning item broadcast urls: %w", err)
+			}
+		}
+
+		if _, err := tx.Exec(ctx, `INSERT INTO event_item (event_id, item_id) VALUES ($1, $2)`, toID, newItemID); err != nil {
+			return fmt.Errorf("problem cloning event item: %w", err)
+		}
+	}
+
+	return nil
+}
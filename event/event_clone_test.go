@@ -0,0 +1,190 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testDB connects to the database at TEST_DATABASE_URL, which must have
+// db/initial.sql applied. Tests that need it are skipped when it is not set.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := pgxpool.Connect(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// cloneFixture is a published event with a registration window, an item
+// linked to a broadcast URL and a soft-deleted item.
+type cloneFixture struct {
+	eventID        int
+	itemID         int
+	deletedItemID  int
+	broadcastURLID int
+	slug           string
+	startsOn       time.Time
+}
+
+func newCloneFixture(t *testing.T, db *pgxpool.Pool) cloneFixture {
+	t.Helper()
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	f := cloneFixture{
+		slug:     "clone-test-" + suffix,
+		startsOn: time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC),
+	}
+
+	platform := "clone-test-" + suffix
+	if _, err := db.Exec(ctx, `INSERT INTO platform (name) VALUES ($1)`, platform); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO broadcast_url (url, platform, language) VALUES ($1, $2, 'en') RETURNING id`,
+		"https://example.com/"+suffix, platform).Scan(&f.broadcastURLID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO event (slug, name, starts_on, ends_on, registration_opens_at, registration_closes_at, publication_status, published_at)
+		VALUES ($1, 'Clone test', $2, $2::timestamptz + interval '2 hours', $2::timestamptz - interval '7 days', $2::timestamptz - interval '1 day', 'published', now())
+		RETURNING id`, f.slug, f.startsOn).Scan(&f.eventID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO item (start_date, duration, name, original_language)
+		VALUES ($1::timestamptz + interval '30 minutes', 45, 'Talk', 'en') RETURNING id`, f.startsOn).Scan(&f.itemID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO item (start_date, duration, name, original_language, deleted, deleted_at)
+		VALUES ($1, 30, 'Deleted talk', 'en', true, now()) RETURNING id`, f.startsOn).Scan(&f.deletedItemID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, `INSERT INTO event_item (event_id, item_id) VALUES ($1, $2), ($1, $3)`,
+		f.eventID, f.itemID, f.deletedItemID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, `INSERT INTO item_broadcast_url (item_id, broadcast_url_id) VALUES ($1, $2)`,
+		f.itemID, f.broadcastURLID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fixture and its copies, whose slugs start with the fixture's.
+	t.Cleanup(func() {
+		var itemIDs []int32
+		db.QueryRow(ctx, `select array_agg(ei.item_id) from event_item ei join event e on e.id = ei.event_id
+			where e.slug like $1`, f.slug+"%").Scan(&itemIDs)
+		db.Exec(ctx, `DELETE FROM item_broadcast_url WHERE broadcast_url_id = $1`, f.broadcastURLID)
+		db.Exec(ctx, `DELETE FROM event WHERE slug LIKE $1`, f.slug+"%")
+		db.Exec(ctx, `DELETE FROM item WHERE id = any($1)`, itemIDs)
+		db.Exec(ctx, `DELETE FROM broadcast_url WHERE id = $1`, f.broadcastURLID)
+		db.Exec(ctx, `DELETE FROM platform WHERE name = $1`, platform)
+	})
+	return f
+}
+
+func TestCloneEventByID(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	for _, includeBroadcastURLs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("include_broadcast_urls=%v", includeBroadcastURLs), func(t *testing.T) {
+			f := newCloneFixture(t, db)
+			r := &EventDB{db: db}
+
+			slug := f.slug + "-copy"
+			startsOn := f.startsOn.AddDate(0, 1, 3)
+			newID, err := cloneEventByID(r, ctx, fmt.Sprint(f.eventID), eventClone{
+				Slug:                 &slug,
+				StartsOn:             &startsOn,
+				IncludeBroadcastURLs: &includeBroadcastURLs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			shift := startsOn.Sub(f.startsOn)
+
+			var gotStartsOn, gotEndsOn, opensAt, closesAt time.Time
+			var status string
+			if err := db.QueryRow(ctx, `select starts_on, ends_on, registration_opens_at, registration_closes_at, publication_status
+				from event where id = $1`, newID).Scan(&gotStartsOn, &gotEndsOn, &opensAt, &closesAt, &status); err != nil {
+				t.Fatal(err)
+			}
+			if !gotStartsOn.Equal(startsOn) {
+				t.Errorf("starts_on = %v, want %v", gotStartsOn, startsOn)
+			}
+			if want := startsOn.Add(2 * time.Hour); !gotEndsOn.Equal(want) {
+				t.Errorf("ends_on = %v, want %v", gotEndsOn, want)
+			}
+			if want := f.startsOn.AddDate(0, 0, -7).Add(shift); !opensAt.Equal(want) {
+				t.Errorf("registration_opens_at = %v, want %v", opensAt, want)
+			}
+			if want := f.startsOn.AddDate(0, 0, -1).Add(shift); !closesAt.Equal(want) {
+				t.Errorf("registration_closes_at = %v, want %v", closesAt, want)
+			}
+			if status != PublicationDraft {
+				t.Errorf("publication_status = %q, want %q", status, PublicationDraft)
+			}
+
+			rows, err := db.Query(ctx, `select i.id, i.start_date from event_item ei join item i on i.id = ei.item_id
+				where ei.event_id = $1`, newID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var itemIDs []int
+			for rows.Next() {
+				var id int
+				var startDate time.Time
+				if err := rows.Scan(&id, &startDate); err != nil {
+					t.Fatal(err)
+				}
+				if want := startsOn.Add(30 * time.Minute); !startDate.Equal(want) {
+					t.Errorf("item start_date = %v, want %v", startDate, want)
+				}
+				itemIDs = append(itemIDs, id)
+			}
+			rows.Close()
+			if len(itemIDs) != 1 {
+				t.Fatalf("got %d items, want 1 (the deleted one is left out)", len(itemIDs))
+			}
+			if itemIDs[0] == f.itemID {
+				t.Errorf("item was shared instead of copied")
+			}
+
+			var links int
+			if err := db.QueryRow(ctx, `select count(*) from item_broadcast_url where item_id = $1 and broadcast_url_id = $2`,
+				itemIDs[0], f.broadcastURLID).Scan(&links); err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if includeBroadcastURLs {
+				want = 1
+			}
+			if links != want {
+				t.Errorf("got %d broadcast URL links, want %d", links, want)
+			}
+		})
+	}
+}
+
+func TestCloneDeletedEvent(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	f := newCloneFixture(t, db)
+
+	if _, err := db.Exec(ctx, `UPDATE event SET deleted = true, deleted_at = now() WHERE id = $1`, f.eventID); err != nil {
+		t.Fatal(err)
+	}
+	slug := f.slug + "-copy"
+	_, err := cloneEventByID(&EventDB{db: db}, ctx, fmt.Sprint(f.eventID), eventClone{Slug: &slug, StartsOn: &f.startsOn})
+	if err == nil || err.Error() != "not found" {
+		t.Errorf("cloning a deleted event: %v, want not found", err)
+	}
+}
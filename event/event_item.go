@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -19,14 +25,15 @@ type eventItemResponse struct {
 	EventID   *int       `json:"event_id" db:"event_id"`
 	ItemID    *int       `json:"item_id" db:"item_id"`
 	Deleted   *bool      `json:"deleted" db:"deleted"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy *string    `json:"deleted_by,omitempty" db:"deleted_by"`
 	CreatedAt *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type eventItem struct {
-	EventID *int  `json:"event_id" db:"event_id" validate:"required"`
-	ItemID  *int  `json:"item_id" db:"item_id" validate:"required"`
-	Deleted *bool `json:"deleted" db:"deleted"`
+	EventID *int `json:"event_id" db:"event_id" validate:"required"`
+	ItemID  *int `json:"item_id" db:"item_id" validate:"required"`
 }
 
 type EventItem interface {
@@ -35,6 +42,7 @@ type EventItem interface {
 	CreateNewEventItem(ctx *gin.Context)
 	UpdateEventItemByID(ctx *gin.Context)
 	DeleteEventItemByID(ctx *gin.Context)
+	RestoreEventItemByID(ctx *gin.Context)
 }
 
 type EventItemDB struct {
@@ -47,10 +55,12 @@ func NewEventItem(db *pgxpool.Pool) EventItem {
 	}
 }
 
+// GetEventItemByID returns the event item, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *EventItemDB) GetEventItemByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getEventItemByID(r, ctx, id)
+	u, err := getEventItemByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -66,9 +76,14 @@ func (r *EventItemDB) GetEventItemByID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllEventItem lists the event items, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *EventItemDB) GetAllEventItem(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -95,7 +110,7 @@ func (r *EventItemDB) GetAllEventItem(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllEventItem(r, ctx, intSkip, intLimit)
+	u, err := getAllEventItem(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -127,7 +142,17 @@ func (r *EventItemDB) CreateNewEventItem(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewEventItem(r, ctx, s); err != nil {
+	id, err := createNewEventItem(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventItemByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -135,7 +160,9 @@ func (r *EventItemDB) CreateNewEventItem(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event Item!", "data": s, "success": true})
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event Item!", "data": u, "success": true})
 }
 
 func (r *EventItemDB) UpdateEventItemByID(ctx *gin.Context) {
@@ -150,7 +177,7 @@ func (r *EventItemDB) UpdateEventItemByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := updateEventItemByID(r, ctx, u, id); err != nil {
+	if err := updateEventItemByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -160,6 +187,14 @@ func (r *EventItemDB) UpdateEventItemByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -174,14 +209,39 @@ func (r *EventItemDB) UpdateEventItemByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Event Item updated successfully", "data": u, "success": true})
+
+	updated, err := getEventItemByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event Item updated successfully", "data": updated, "success": true})
 }
 
 func (r *EventItemDB) DeleteEventItemByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteEventItemByID(r, ctx, id); err != nil {
+	if err := deleteEventItemByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -192,20 +252,55 @@ func (r *EventItemDB) DeleteEventItemByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Event Item deleted successfully!", "success": true})
 }
 
-func getEventItemByID(r *EventItemDB, ctx *gin.Context, id string) (eventItemResponse, error) {
+// RestoreEventItemByID restores the event item, as long as neither its event
+// nor its item is deleted.
+func (r *EventItemDB) RestoreEventItemByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreEventItemByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" || err.Error() == "event or item deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event Item restored successfully!", "success": true})
+}
+
+func getEventItemByID(r *EventItemDB, ctx *gin.Context, id string, includeDeleted bool) (eventItemResponse, error) {
 	u := eventItemResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
 	event_id,
 	item_id,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from event_item where id = $1`, id).Scan(
+	from event_item where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.EventID,
 		&u.ItemID,
 		&u.Deleted,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -217,7 +312,7 @@ func getEventItemByID(r *EventItemDB, ctx *gin.Context, id string) (eventItemRes
 	return u, nil
 }
 
-func getAllEventItem(r *EventItemDB, ctx *gin.Context, skip int, limit int) (*[]eventItemResponse, error) {
+func getAllEventItem(r *EventItemDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]eventItemResponse, error) {
 
 	u := []eventItemResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
@@ -225,12 +320,14 @@ func getAllEventItem(r *EventItemDB, ctx *gin.Context, skip int, limit int) (*[]
 	event_id,
 	item_id,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from event_item LIMIT %d OFFSET %d`, limit, skip))
+	from event_item where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d eventItemResponse
-		err := rows.Scan(&d.ID, &d.EventID, &d.ItemID, &d.Deleted, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.EventID, &d.ItemID, &d.Deleted, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -239,19 +336,19 @@ func getAllEventItem(r *EventItemDB, ctx *gin.Context, skip int, limit int) (*[]
 	return &u, rows.Err()
 }
 
-func updateEventItemByID(r *EventItemDB, ctx *gin.Context, req eventItem, id string) error {
+func updateEventItemByID(r *EventItemDB, ctx *gin.Context, req eventItem, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareEventItemUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE event_item SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE event_item SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating Event Item: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event_item where id = $1)`, id)
 		}
 
 		return nil
@@ -260,26 +357,59 @@ func updateEventItemByID(r *EventItemDB, ctx *gin.Context, req eventItem, id str
 	}
 }
 
-func createNewEventItem(r *EventItemDB, ctx *gin.Context, req eventItem) error {
+func createNewEventItem(r *EventItemDB, ctx *gin.Context, req eventItem) (int, error) {
 
 	createString, numString, createQueryArgs := prepareEventItemCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO event_item (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating event item: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO event_item (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating event item: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func deleteEventItemByID(r *EventItemDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from event_item where id=$1", id)
-	return err
+func deleteEventItemByID(r *EventItemDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE event_item SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event_item where id = $1 and coalesce(deleted, false) = false)`, id)
+	}
+	return nil
+}
+
+func restoreEventItemByID(r *EventItemDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted, parentDeleted bool
+		if err := tx.QueryRow(ctx, `select coalesce(ei.deleted, false), coalesce(e.deleted, false) or coalesce(i.deleted, false) 
+		from event_item ei 
+		join event e on e.id = ei.event_id 
+		join item i on i.id = ei.item_id 
+		where ei.id = $1
+		for update of ei for share of e, i`, id).Scan(&deleted, &parentDeleted); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+		if parentDeleted {
+			return fmt.Errorf("event or item deleted")
+		}
+
+		_, err := tx.Exec(ctx, `UPDATE event_item SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id)
+		return err
+	})
 }
 
 func prepareEventItemUpdateQuery(req eventItem) (string, []interface{}) {
@@ -320,11 +450,6 @@ func prepareEventItemCreateQuery(req eventItem) (string, string, []interface{})
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.ItemID)
 	}
-	if req.Deleted != nil {
-		createStrings = append(createStrings, "deleted")
-		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
-		args = append(args, *req.Deleted)
-	}
 
 	concatedCreateString := strings.Join(createStrings, ",")
 	concatedNumString := strings.Join(numString, ",")
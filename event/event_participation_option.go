@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -15,18 +21,25 @@ import (
 )
 
 type eventPartOptionResponse struct {
-	ID                  *int       `json:"id" db:"id"`
-	EventID             *int       `json:"event_id" db:"event_id"`
-	ParticipationOption *string    `json:"participation_option" db:"participation_option"`
-	Deleted             *bool      `json:"deleted" db:"deleted"`
-	CreatedAt           *time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt           *time.Time `json:"updated_at" db:"updated_at"`
+	ID                   *int       `json:"id" db:"id"`
+	EventID              *int       `json:"event_id" db:"event_id"`
+	ParticipationOption  *string    `json:"participation_option" db:"participation_option"`
+	RegistrationStatus   *string    `json:"registration_status" db:"registration_status"`
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at,omitempty" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at,omitempty" db:"registration_closes_at"`
+	Deleted              *bool      `json:"deleted" db:"deleted"`
+	DeletedAt            *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy            *string    `json:"deleted_by,omitempty" db:"deleted_by"`
+	CreatedAt            *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt            *time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type eventPartOption struct {
-	EventID             *int    `json:"event_id" db:"event_id" validate:"required"`
-	ParticipationOption *string `json:"participation_option" db:"participation_option" validate:"required"`
-	Deleted             *bool   `json:"deleted" db:"deleted"`
+	EventID              *int       `json:"event_id" db:"event_id" validate:"required"`
+	ParticipationOption  *string    `json:"participation_option" db:"participation_option" validate:"required"`
+	RegistrationStatus   *string    `json:"registration_status" db:"registration_status" validate:"omitempty,oneof=open closed cancelled"`
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at,omitempty" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at,omitempty" db:"registration_closes_at"`
 }
 
 type EventPartOption interface {
@@ -35,6 +48,7 @@ type EventPartOption interface {
 	CreateNewEventPartOption(ctx *gin.Context)
 	UpdateEventPartOptionByID(ctx *gin.Context)
 	DeleteEventPartOptionByID(ctx *gin.Context)
+	RestoreEventPartOptionByID(ctx *gin.Context)
 }
 
 type EventPartOptionDB struct {
@@ -47,10 +61,12 @@ func NewEventPartOption(db *pgxpool.Pool) EventPartOption {
 	}
 }
 
+// GetEventPartOptionByID returns the event participation option, or 404 when
+// it is deleted unless ?include_deleted=true.
 func (r *EventPartOptionDB) GetEventPartOptionByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getEventPartOptionByID(r, ctx, id)
+	u, err := getEventPartOptionByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -66,9 +82,14 @@ func (r *EventPartOptionDB) GetEventPartOptionByID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllEventPartOption lists the event participation options, leaving deleted
+// ones out unless ?include_deleted=true.
 func (r *EventPartOptionDB) GetAllEventPartOption(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -95,7 +116,7 @@ func (r *EventPartOptionDB) GetAllEventPartOption(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllEventPartOption(r, ctx, intSkip, intLimit)
+	u, err := getAllEventPartOption(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -127,7 +148,29 @@ func (r *EventPartOptionDB) CreateNewEventPartOption(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewEventPartOption(r, ctx, s); err != nil {
+	if err := validateRegistrationWindow(s.RegistrationOpensAt, s.RegistrationClosesAt); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if s.RegistrationStatus == nil {
+		status := initialRegistrationStatus(s.RegistrationOpensAt, s.RegistrationClosesAt)
+		s.RegistrationStatus = &status
+	}
+
+	id, err := createNewEventPartOption(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventPartOptionByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -135,7 +178,9 @@ func (r *EventPartOptionDB) CreateNewEventPartOption(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event Participation Option!", "data": s, "success": true})
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Event Participation Option!", "data": u, "success": true})
 }
 
 func (r *EventPartOptionDB) UpdateEventPartOptionByID(ctx *gin.Context) {
@@ -148,9 +193,26 @@ func (r *EventPartOptionDB) UpdateEventPartOptionByID(ctx *gin.Context) {
 		return
 	}
 
+	if u.RegistrationStatus != nil {
+		if err := validator.New().Var(*u.RegistrationStatus, "oneof=open closed cancelled"); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid registration_status value! Accepted values are open, closed and cancelled",
+				"success": false,
+			})
+			return
+		}
+	}
+	if err := validateRegistrationWindow(u.RegistrationOpensAt, u.RegistrationClosesAt); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
 	id := ctx.Param("id")
 
-	if err := updateEventPartOptionByID(r, ctx, u, id); err != nil {
+	if err := updateEventPartOptionByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -160,6 +222,14 @@ func (r *EventPartOptionDB) UpdateEventPartOptionByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -174,14 +244,39 @@ func (r *EventPartOptionDB) UpdateEventPartOptionByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Event Participation Option updated successfully", "data": u, "success": true})
+
+	updated, err := getEventPartOptionByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event Participation Option updated successfully", "data": updated, "success": true})
 }
 
 func (r *EventPartOptionDB) DeleteEventPartOptionByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteEventPartOptionByID(r, ctx, id); err != nil {
+	if err := deleteEventPartOptionByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -192,20 +287,61 @@ func (r *EventPartOptionDB) DeleteEventPartOptionByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Event Participation Option deleted successfully!", "success": true})
 }
 
-func getEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, id string) (eventPartOptionResponse, error) {
+// RestoreEventPartOptionByID restores the event participation option, as long
+// as its event is not deleted.
+func (r *EventPartOptionDB) RestoreEventPartOptionByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreEventPartOptionByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" || err.Error() == "event deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event Participation Option restored successfully!", "success": true})
+}
+
+func getEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, id string, includeDeleted bool) (eventPartOptionResponse, error) {
 	u := eventPartOptionResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
 	event_id,
 	participation_option,
+	registration_status,
+	registration_opens_at,
+	registration_closes_at,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from event_participation_option where id = $1`, id).Scan(
+	from event_participation_option where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.EventID,
 		&u.ParticipationOption,
+		&u.RegistrationStatus,
+		&u.RegistrationOpensAt,
+		&u.RegistrationClosesAt,
 		&u.Deleted,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -217,20 +353,25 @@ func getEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, id string) (
 	return u, nil
 }
 
-func getAllEventPartOption(r *EventPartOptionDB, ctx *gin.Context, skip int, limit int) (*[]eventPartOptionResponse, error) {
+func getAllEventPartOption(r *EventPartOptionDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]eventPartOptionResponse, error) {
 
 	u := []eventPartOptionResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
 	id,
 	event_id,
 	participation_option,
+	registration_status,
+	registration_opens_at,
+	registration_closes_at,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from event_participation_option LIMIT %d OFFSET %d`, limit, skip))
+	from event_participation_option where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d eventPartOptionResponse
-		err := rows.Scan(&d.ID, &d.EventID, &d.ParticipationOption, &d.Deleted, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.EventID, &d.ParticipationOption, &d.RegistrationStatus, &d.RegistrationOpensAt, &d.RegistrationClosesAt, &d.Deleted, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -239,19 +380,19 @@ func getAllEventPartOption(r *EventPartOptionDB, ctx *gin.Context, skip int, lim
 	return &u, rows.Err()
 }
 
-func updateEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, req eventPartOption, id string) error {
+func updateEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, req eventPartOption, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareEventPartOptionUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE event_participation_option SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE event_participation_option SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating Event Participation Option: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event_participation_option where id = $1)`, id)
 		}
 
 		return nil
@@ -260,26 +401,58 @@ func updateEventPartOptionByID(r *EventPartOptionDB, ctx *gin.Context, req event
 	}
 }
 
-func createNewEventPartOption(r *EventPartOptionDB, ctx *gin.Context, req eventPartOption) error {
+func createNewEventPartOption(r *EventPartOptionDB, ctx *gin.Context, req eventPartOption) (int, error) {
 
 	createString, numString, createQueryArgs := prepareEventPartOptionCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO event_participation_option (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating participation status: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO event_participation_option (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating participation status: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func deleteEventPartOptionByID(r *EventPartOptionDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from event_participation_option where id=$1", id)
-	return err
+func deleteEventPartOptionByID(r *EventPartOptionDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE event_participation_option SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from event_participation_option where id = $1 and coalesce(deleted, false) = false)`, id)
+	}
+	return nil
+}
+
+func restoreEventPartOptionByID(r *EventPartOptionDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted, eventDeleted bool
+		if err := tx.QueryRow(ctx, `select coalesce(epo.deleted, false), coalesce(e.deleted, false) 
+		from event_participation_option epo 
+		join event e on e.id = epo.event_id 
+		where epo.id = $1
+		for update of epo for share of e`, id).Scan(&deleted, &eventDeleted); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+		if eventDeleted {
+			return fmt.Errorf("event deleted")
+		}
+
+		_, err := tx.Exec(ctx, `UPDATE event_participation_option SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id)
+		return err
+	})
 }
 
 func prepareEventPartOptionUpdateQuery(req eventPartOption) (string, []interface{}) {
@@ -294,9 +467,19 @@ func prepareEventPartOptionUpdateQuery(req eventPartOption) (string, []interface
 		updateStrings = append(updateStrings, fmt.Sprintf("participation_option=$%d", len(updateStrings)+1))
 		args = append(args, *req.ParticipationOption)
 	}
-	if req.Deleted != nil {
-		updateStrings = append(updateStrings, fmt.Sprintf("deleted=$%d", len(updateStrings)+1))
-		args = append(args, *req.Deleted)
+	if req.RegistrationStatus != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_status=$%d", len(updateStrings)+1))
+		args = append(args, *req.RegistrationStatus)
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_status_changed_at=$%d", len(updateStrings)+1))
+		args = append(args, time.Now())
+	}
+	if req.RegistrationOpensAt != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_opens_at=$%d", len(updateStrings)+1))
+		args = append(args, *req.RegistrationOpensAt)
+	}
+	if req.RegistrationClosesAt != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("registration_closes_at=$%d", len(updateStrings)+1))
+		args = append(args, *req.RegistrationClosesAt)
 	}
 
 	if len(args) != 0 {
@@ -324,10 +507,20 @@ func prepareEventPartOptionCreateQuery(req eventPartOption) (string, string, []i
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.ParticipationOption)
 	}
-	if req.Deleted != nil {
-		createStrings = append(createStrings, "deleted")
+	if req.RegistrationStatus != nil {
+		createStrings = append(createStrings, "registration_status")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.RegistrationStatus)
+	}
+	if req.RegistrationOpensAt != nil {
+		createStrings = append(createStrings, "registration_opens_at")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.RegistrationOpensAt)
+	}
+	if req.RegistrationClosesAt != nil {
+		createStrings = append(createStrings, "registration_closes_at")
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
-		args = append(args, *req.Deleted)
+		args = append(args, *req.RegistrationClosesAt)
 	}
 
 	concatedCreateString := strings.Join(createStrings, ",")
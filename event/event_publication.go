@@ -0,0 +1,353 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"vh-srv-event/audience"
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Publication statuses of an event. Only published events are listed by the
+// public endpoints; scheduled ones are published by the Publisher once their
+// publish_at is reached.
+const (
+	PublicationDraft     = "draft"
+	PublicationScheduled = "scheduled"
+	PublicationPublished = "published"
+	PublicationArchived  = "archived"
+)
+
+type eventPublish struct {
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+}
+
+type eventPreviewTokenResponse struct {
+	EventID      *int    `json:"event_id"`
+	PreviewToken *string `json:"preview_token"`
+}
+
+// PublishEventByID publishes the event now, or schedules it when publish_at
+// is in the future.
+func (r *EventDB) PublishEventByID(ctx *gin.Context) {
+	s := eventPublish{}
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&s); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+	}
+
+	id := ctx.Param("id")
+
+	if err := publishEventByID(r, ctx, id, s.PublishAt); err != nil {
+		respondPublicationError(ctx, err)
+		return
+	}
+
+	u, err := getEventByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event publication updated!", "data": u, "success": true})
+}
+
+// UnpublishEventByID takes the event back to draft. Archived events cannot be
+// unpublished.
+func (r *EventDB) UnpublishEventByID(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	if err := setEventPublicationStatus(r, ctx, id, PublicationDraft); err != nil {
+		respondPublicationError(ctx, err)
+		return
+	}
+
+	u, err := getEventByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event publication updated!", "data": u, "success": true})
+}
+
+// ArchiveEventByID archives a published event ahead of the automatic
+// archiving.
+func (r *EventDB) ArchiveEventByID(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	if err := setEventPublicationStatus(r, ctx, id, PublicationArchived); err != nil {
+		respondPublicationError(ctx, err)
+		return
+	}
+
+	u, err := getEventByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event publication updated!", "data": u, "success": true})
+}
+
+// CreateEventPreviewToken issues a new preview token for the event, which
+// replaces any previous one. Anyone holding it can read the event through
+// GET /v1/preview/:token whatever its publication status. Templates and
+// deleted events get no token.
+func (r *EventDB) CreateEventPreviewToken(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	u, err := createEventPreviewToken(r, ctx, id)
+
+	if err != nil {
+		respondPublicationError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Preview token created!", "data": u, "success": true})
+}
+
+func (r *EventDB) GetEventByPreviewToken(ctx *gin.Context) {
+	token := ctx.Param("token")
+
+	u, err := getEvent(r, ctx, `e.preview_token = $3 and coalesce(e.deleted, false) = false`, token)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetPublicEventBySlug returns a published, non-deleted event.
+func (r *EventDB) GetPublicEventBySlug(ctx *gin.Context) {
+	slug := ctx.Param("slug")
+
+	u, err := getEvent(r, ctx, `e.slug = $3 and e.publication_status = 'published' and coalesce(e.deleted, false) = false and e.is_template = false`, slug)
+
+	// Events outside the participant's audience are reported as missing.
+	if err == nil && ctx.Query("participant_id") != "" {
+		var res audience.Result
+		res, err = r.audiences.Check(ctx, *u.Audience, ctx.Query("participant_id"))
+		if err == nil && !res.Eligible {
+			err = fmt.Errorf("not found")
+		}
+	}
+
+	if err != nil {
+		if err.Error() == "participant not found" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetAllPublicEvent lists published, non-deleted events. It accepts the same
+// filters as GetAllEvent except template and publication_status.
+func (r *EventDB) GetAllPublicEvent(ctx *gin.Context) {
+	filter, err := eventFilterFromQuery(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+		return
+	}
+	filter.Template = false
+	filter.Publication = ""
+	filter.Public = true
+
+	listEvents(r, ctx, filter)
+}
+
+func respondPublicationError(ctx *gin.Context, err error) {
+	switch err.Error() {
+	case "not found":
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+	case "event is deleted", "event is a template", "event is archived", "event is not published":
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+	}
+}
+
+// checkPublishable returns the publication status of the event, or an error
+// when the event does not exist, is deleted or is a template. It locks the
+// event until tx ends, so that the status change made next applies to the
+// event it checked.
+func checkPublishable(ctx context.Context, tx pgx.Tx, id string) (string, error) {
+	var deleted, isTemplate bool
+	var status string
+	if err := tx.QueryRow(ctx, `select coalesce(deleted, false), is_template, publication_status from event where id = $1 for update`, id).Scan(&deleted, &isTemplate, &status); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", fmt.Errorf("not found")
+		}
+		return "", err
+	}
+	if deleted {
+		return "", fmt.Errorf("event is deleted")
+	}
+	if isTemplate {
+		return "", fmt.Errorf("event is a template")
+	}
+	return status, nil
+}
+
+// checkPublicationTransition returns an error when an event cannot go from
+// one publication status to the other by hand: an archived event stays
+// archived, and only a published event can be archived.
+func checkPublicationTransition(from, to string) error {
+	switch to {
+	case PublicationDraft:
+		if from == PublicationArchived {
+			return fmt.Errorf("event is archived")
+		}
+	case PublicationArchived:
+		if from != PublicationPublished && from != PublicationArchived {
+			return fmt.Errorf("event is not published")
+		}
+	}
+	return nil
+}
+
+func publishEventByID(r *EventDB, ctx context.Context, id string, publishAt *time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		if _, err := checkPublishable(ctx, tx, id); err != nil {
+			return err
+		}
+
+		if publishAt != nil && publishAt.After(time.Now()) {
+			_, err := tx.Exec(ctx, `UPDATE event SET publication_status = $1, publish_at = $2, updated_at = now() WHERE id = $3`,
+				PublicationScheduled, *publishAt, id)
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `UPDATE event SET publication_status = $1, publish_at = null, published_at = now(), updated_at = now() WHERE id = $2`,
+			PublicationPublished, id)
+		return err
+	})
+}
+
+func setEventPublicationStatus(r *EventDB, ctx context.Context, id string, status string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		from, err := checkPublishable(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkPublicationTransition(from, status); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE event SET publication_status = $1, publish_at = null, updated_at = now() WHERE id = $2`, status, id)
+		return err
+	})
+}
+
+func createEventPreviewToken(r *EventDB, ctx context.Context, id string) (eventPreviewTokenResponse, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return eventPreviewTokenResponse{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	u := eventPreviewTokenResponse{}
+	err := txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		if _, err := checkPublishable(ctx, tx, id); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `UPDATE event SET preview_token = $1, updated_at = now() WHERE id = $2 RETURNING id, preview_token`,
+			token, id).Scan(&u.EventID, &u.PreviewToken)
+	})
+	if err != nil {
+		return eventPreviewTokenResponse{}, err
+	}
+	return u, nil
+}
+
+// Publisher moves events along their publication workflow: scheduled events
+// are published once publish_at is reached and published events are archived
+// once they ended more than the retention ago. Series templates are left as
+// they are, since their status is the one given to new occurrences.
+type Publisher struct {
+	db        *pgxpool.Pool
+	retention time.Duration
+}
+
+func NewPublisher(db *pgxpool.Pool, retention time.Duration) *Publisher {
+	return &Publisher{
+		db,
+		retention,
+	}
+}
+
+func (p *Publisher) Run(ctx context.Context) error {
+	published, err := p.db.Exec(ctx, `UPDATE event SET publication_status = $1, published_at = publish_at, publish_at = null, updated_at = now()
+		WHERE publication_status = $2 AND publish_at <= now() AND coalesce(deleted, false) = false AND is_template = false`,
+		PublicationPublished, PublicationScheduled)
+	if err != nil {
+		return fmt.Errorf("problem publishing scheduled events: %w", err)
+	}
+
+	archived, err := p.db.Exec(ctx, `UPDATE event SET publication_status = $1, updated_at = now()
+		WHERE publication_status = $2 AND ends_on + $3::interval < now() AND is_template = false`,
+		PublicationArchived, PublicationPublished, p.retention)
+	if err != nil {
+		return fmt.Errorf("problem archiving ended events: %w", err)
+	}
+
+	if published.RowsAffected() != 0 || archived.RowsAffected() != 0 {
+		log.Printf("publisher: %d event(s) published, %d archived", published.RowsAffected(), archived.RowsAffected())
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package event
+
+import "testing"
+
+func TestCheckPublicationTransition(t *testing.T) {
+	for _, c := range []struct {
+		from, to string
+		err      string
+	}{
+		{PublicationDraft, PublicationDraft, ""},
+		{PublicationScheduled, PublicationDraft, ""},
+		{PublicationPublished, PublicationDraft, ""},
+		{PublicationArchived, PublicationDraft, "event is archived"},
+		{PublicationDraft, PublicationArchived, "event is not published"},
+		{PublicationScheduled, PublicationArchived, "event is not published"},
+		{PublicationPublished, PublicationArchived, ""},
+		{PublicationArchived, PublicationArchived, ""},
+	} {
+		got := ""
+		if err := checkPublicationTransition(c.from, c.to); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%s -> %s: error %q, want %q", c.from, c.to, got, c.err)
+		}
+	}
+}
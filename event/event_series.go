@@ -0,0 +1,1084 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"vh-srv-event/actor"
+	"vh-srv-event/audience"
+	"vh-srv-event/etag"
+	"vh-srv-event/language"
+	"vh-srv-event/recurrence"
+	"vh-srv-event/schema"
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// defaultSeriesHorizon is how far ahead occurrences of an open-ended series
+// are materialized when no materialize_until is given.
+const defaultSeriesHorizon = 365 * 24 * time.Hour
+
+type eventSeriesResponse struct {
+	ID                *int                           `json:"id" db:"id"`
+	TemplateEventID   *int                           `json:"template_event_id" db:"template_event_id"`
+	Slug              *string                        `json:"slug" db:"slug"`
+	RRule             *string                        `json:"rrule" db:"rrule"`
+	StartsOn          *time.Time                     `json:"starts_on" db:"starts_on"`
+	MaterializedUntil *time.Time                     `json:"materialized_until" db:"materialized_until"`
+	Deleted           *bool                          `json:"deleted" db:"deleted"`
+	DeletedAt         *time.Time                     `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy         *string                        `json:"deleted_by,omitempty" db:"deleted_by"`
+	CreatedAt         *time.Time                     `json:"created_at" db:"created_at"`
+	UpdatedAt         *time.Time                     `json:"updated_at" db:"updated_at"`
+	Occurrences       []eventOccurrenceResponse      `json:"occurrences,omitempty"`
+	Exceptions        []eventSeriesExceptionResponse `json:"exceptions,omitempty"`
+	// Version is the last change to the series, its events or exceptions,
+	// which its entity tag is derived from.
+	Version *time.Time `json:"-"`
+}
+
+// seriesVersion selects the Version of the series with id $1.
+const seriesVersion = `select greatest(s.updated_at,
+	(select max(e.updated_at) from event e where e.series_id = s.id),
+	(select max(x.updated_at) from event_series_exception x where x.series_id = s.id))
+	from event_series s where s.id = $1`
+
+type eventOccurrenceResponse struct {
+	EventID        *int       `json:"event_id" db:"id"`
+	Slug           *string    `json:"slug" db:"slug"`
+	OccurrenceDate *time.Time `json:"occurrence_date" db:"occurrence_date"`
+	StartsOn       *time.Time `json:"starts_on" db:"starts_on"`
+	EndsOn         *time.Time `json:"ends_on" db:"ends_on"`
+	Deleted        *bool      `json:"deleted" db:"deleted"`
+}
+
+type eventSeriesExceptionResponse struct {
+	OccurrenceDate *time.Time `json:"occurrence_date" db:"occurrence_date"`
+	MovedTo        *time.Time `json:"moved_to,omitempty" db:"moved_to"`
+	Cancelled      bool       `json:"cancelled"`
+}
+
+type eventSeries struct {
+	EventID              *int       `json:"event_id" validate:"required"`
+	Slug                 *string    `json:"slug" validate:"required"`
+	RRule                *string    `json:"rrule" validate:"required"`
+	StartsOn             *time.Time `json:"starts_on,omitempty"`
+	MaterializeUntil     *time.Time `json:"materialize_until,omitempty"`
+	IncludeBroadcastURLs *bool      `json:"include_broadcast_urls,omitempty"`
+}
+
+type eventSeriesMaterialize struct {
+	Until *time.Time `json:"until" validate:"required"`
+}
+
+type eventSeriesException struct {
+	OccurrenceDate *time.Time `json:"occurrence_date" validate:"required"`
+	MovedTo        *time.Time `json:"moved_to,omitempty"`
+}
+
+type EventSeries interface {
+	GetEventSeriesByID(ctx *gin.Context)
+	GetAllEventSeries(ctx *gin.Context)
+	CreateNewEventSeries(ctx *gin.Context)
+	DeleteEventSeriesByID(ctx *gin.Context)
+	RestoreEventSeriesByID(ctx *gin.Context)
+	MaterializeEventSeries(ctx *gin.Context)
+	UpdateEventSeriesOccurrence(ctx *gin.Context)
+	CreateEventSeriesException(ctx *gin.Context)
+}
+
+type EventSeriesDB struct {
+	db      *pgxpool.Pool
+	schemas *schema.Registry
+	// events reads back the occurrences changed through the series.
+	events *EventDB
+}
+
+func NewEventSeries(db *pgxpool.Pool, lang *language.Resolver, translationLanguages []string, schemas *schema.Registry, audiences *audience.Evaluator) EventSeries {
+	return &EventSeriesDB{
+		db,
+		schemas,
+		&EventDB{db, lang, translationLanguages, schemas, audiences},
+	}
+}
+
+// GetEventSeriesByID returns the series, or 404 when it is deleted unless
+// ?include_deleted=true.
+func (r *EventSeriesDB) GetEventSeriesByID(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	u, err := getEventSeriesByID(r, ctx, id, ctx.Query("include_deleted") == "true")
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if etag.NotModified(ctx, u.Version) {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetAllEventSeries lists the series, leaving deleted ones out unless
+// ?include_deleted=true.
+func (r *EventSeriesDB) GetAllEventSeries(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	u, err := getAllEventSeries(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// CreateNewEventSeries copies the event given as event_id into a hidden
+// template and materializes one event per occurrence of rrule, with slugs
+// derived from the series slug and the occurrence date.
+func (r *EventSeriesDB) CreateNewEventSeries(ctx *gin.Context) {
+	s := eventSeries{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	rule, err := recurrence.Parse(*s.RRule)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id, err := createEventSeries(r, ctx, s, rule)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "slug already exists" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventSeriesByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.Version)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new event series!", "data": u, "success": true})
+}
+
+// DeleteEventSeriesByID soft-deletes the series together with its template
+// and the occurrences that have not started yet. Past occurrences are kept.
+func (r *EventSeriesDB) DeleteEventSeriesByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := deleteEventSeriesByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event series deleted successfully!", "success": true})
+}
+
+// RestoreEventSeriesByID restores the series together with the template and
+// occurrences deleted with it. Cancelled occurrences stay deleted.
+func (r *EventSeriesDB) RestoreEventSeriesByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreEventSeriesByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventSeriesByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event series restored successfully!", "data": u, "success": true})
+}
+
+// MaterializeEventSeries creates the occurrences of an open-ended series up
+// to the given date. Occurrences that already exist are left alone.
+func (r *EventSeriesDB) MaterializeEventSeries(ctx *gin.Context) {
+	s := eventSeriesMaterialize{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id := ctx.Param("id")
+
+	if err := extendEventSeries(r, ctx, id, *s.Until); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventSeriesByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event series materialized!", "data": u, "success": true})
+}
+
+// UpdateEventSeriesOccurrence edits a single occurrence (?scope=this, the
+// default) or that occurrence and every later one (?scope=future), in which
+// case the series template is updated too so that occurrences materialized
+// later carry the change; a registration window given then is kept relative
+// to the start of each of them. Dates are changed through exceptions instead.
+func (r *EventSeriesDB) UpdateEventSeriesOccurrence(ctx *gin.Context) {
+	u := event{}
+	if err := ctx.ShouldBindJSON(&u); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if u.Slug != nil || u.StartsOn != nil || u.EndsOn != nil || u.IsTemplate != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "slug, dates and is_template cannot be changed on an occurrence",
+			"success": false,
+		})
+		return
+	}
+
+	if err := validateEventUpdate(u); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	scope := ctx.DefaultQuery("scope", "this")
+	if scope != "this" && scope != "future" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid scope value! Accepted values are this and future",
+			"success": false,
+		})
+		return
+	}
+
+	id := ctx.Param("id")
+	eventID := ctx.Param("eventId")
+
+	if err := updateEventSeriesOccurrence(r, ctx, id, eventID, scope, u, etag.IfMatch(ctx)); err != nil {
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "invalid values" || err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	updated, err := getEventByID(r.events, ctx, eventID, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event series occurrence updated successfully", "data": updated, "success": true})
+}
+
+// CreateEventSeriesException cancels an occurrence (no moved_to) or moves it
+// to another start time. A cancelled occurrence is soft-deleted; a moved one
+// keeps its slug and duration and its items are shifted along.
+func (r *EventSeriesDB) CreateEventSeriesException(ctx *gin.Context) {
+	s := eventSeriesException{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id := ctx.Param("id")
+
+	if err := createEventSeriesException(r, ctx, id, s, actor.FromContext(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not an occurrence of the series" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "occurrence is cancelled" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getEventSeriesByID(r, ctx, id, false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Event series exception saved!", "data": u, "success": true})
+}
+
+func getEventSeriesByID(r *EventSeriesDB, ctx context.Context, id string, includeDeleted bool) (eventSeriesResponse, error) {
+	u := eventSeriesResponse{}
+	if err := r.db.QueryRow(ctx, `select
+	id,
+	template_event_id,
+	slug,
+	rrule,
+	starts_on,
+	materialized_until,
+	deleted,
+	deleted_at,
+	deleted_by,
+	created_at,
+	updated_at,
+	(`+seriesVersion+`)
+	from event_series where id = $1 and ($2 or deleted = false)`, id, includeDeleted).Scan(
+		&u.ID,
+		&u.TemplateEventID,
+		&u.Slug,
+		&u.RRule,
+		&u.StartsOn,
+		&u.MaterializedUntil,
+		&u.Deleted,
+		&u.DeletedAt,
+		&u.DeletedBy,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.Version,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return eventSeriesResponse{}, fmt.Errorf("not found")
+		}
+		return eventSeriesResponse{}, err
+	}
+
+	rows, err := r.db.Query(ctx, `select id, slug, occurrence_date, starts_on, ends_on, deleted
+	from event where series_id = $1 and is_template = false order by occurrence_date asc`, id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d eventOccurrenceResponse
+		if err := rows.Scan(&d.EventID, &d.Slug, &d.OccurrenceDate, &d.StartsOn, &d.EndsOn, &d.Deleted); err != nil {
+			return u, err
+		}
+		u.Occurrences = append(u.Occurrences, d)
+	}
+	if err := rows.Err(); err != nil {
+		return u, err
+	}
+
+	exceptions, err := r.db.Query(ctx, `select occurrence_date, moved_to
+	from event_series_exception where series_id = $1 order by occurrence_date asc`, id)
+	if err != nil {
+		return u, err
+	}
+	defer exceptions.Close()
+	for exceptions.Next() {
+		var d eventSeriesExceptionResponse
+		if err := exceptions.Scan(&d.OccurrenceDate, &d.MovedTo); err != nil {
+			return u, err
+		}
+		d.Cancelled = d.MovedTo == nil
+		u.Exceptions = append(u.Exceptions, d)
+	}
+	return u, exceptions.Err()
+}
+
+func getAllEventSeries(r *EventSeriesDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]eventSeriesResponse, error) {
+
+	u := []eventSeriesResponse{}
+	rows, err := r.db.Query(ctx, `select
+	id,
+	template_event_id,
+	slug,
+	rrule,
+	starts_on,
+	materialized_until,
+	deleted,
+	deleted_at,
+	deleted_by,
+	created_at,
+	updated_at
+	from event_series where $3 or deleted = false order by id asc LIMIT $1 OFFSET $2`, limit, skip, includeDeleted)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d eventSeriesResponse
+		err := rows.Scan(&d.ID, &d.TemplateEventID, &d.Slug, &d.RRule, &d.StartsOn, &d.MaterializedUntil, &d.Deleted, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return &u, err
+		}
+		u = append(u, d)
+	}
+	return &u, rows.Err()
+}
+
+func createEventSeries(r *EventSeriesDB, ctx context.Context, req eventSeries, rule *recurrence.Rule) (int, error) {
+	var id int
+	err := txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var sourceStartsOn time.Time
+		if err := tx.QueryRow(ctx, `select starts_on from event where id = $1`, *req.EventID).Scan(&sourceStartsOn); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+
+		var slugTaken bool
+		if err := tx.QueryRow(ctx, `select exists(select 1 from event where slug = $1)
+			or exists(select 1 from event_series where slug = $1)`, *req.Slug).Scan(&slugTaken); err != nil {
+			return err
+		}
+		if slugTaken {
+			return fmt.Errorf("slug already exists")
+		}
+
+		startsOn := sourceStartsOn
+		if req.StartsOn != nil {
+			startsOn = *req.StartsOn
+		}
+		until := startsOn.Add(defaultSeriesHorizon)
+		if req.MaterializeUntil != nil {
+			until = *req.MaterializeUntil
+		}
+
+		// The template keeps the series slug, which reserves it for the derived
+		// occurrence slugs, and the publication status of the event, which the
+		// occurrences take.
+		templateID, err := copyEvent(ctx, tx, fmt.Sprint(*req.EventID), *req.Slug, nil, startsOn.Sub(sourceStartsOn), true, true)
+		if err != nil {
+			return err
+		}
+		includeBroadcastURLs := req.IncludeBroadcastURLs != nil && *req.IncludeBroadcastURLs
+		if err := copyEventChildren(ctx, tx, fmt.Sprint(*req.EventID), templateID, startsOn.Sub(sourceStartsOn), includeBroadcastURLs); err != nil {
+			return err
+		}
+
+		if err := tx.QueryRow(ctx, `INSERT INTO event_series (
+				template_event_id,
+				slug,
+				rrule,
+				starts_on,
+				materialized_until)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id`, templateID, *req.Slug, *req.RRule, startsOn, until).Scan(&id); err != nil {
+			return fmt.Errorf("problem creating event series: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE event SET series_id = $1, updated_at = now() WHERE id = $2`, id, templateID); err != nil {
+			return err
+		}
+
+		return materializeEventSeries(ctx, tx, id, templateID, *req.Slug, rule, startsOn, until)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func extendEventSeries(r *EventSeriesDB, ctx context.Context, id string, until time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var seriesID, templateID int
+		var slug, rrule string
+		var startsOn time.Time
+		if err := tx.QueryRow(ctx, `select id, template_event_id, slug, rrule, starts_on
+			from event_series where id = $1 and deleted = false for update`, id).Scan(&seriesID, &templateID, &slug, &rrule, &startsOn); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+
+		rule, err := recurrence.Parse(rrule)
+		if err != nil {
+			return err
+		}
+
+		if err := materializeEventSeries(ctx, tx, seriesID, templateID, slug, rule, startsOn, until); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE event_series SET materialized_until = greatest(materialized_until, $1), updated_at = now()
+			WHERE id = $2`, until, seriesID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// materializeEventSeries creates the missing occurrences of the series up to
+// until by copying its template. An occurrence is missing when no event row,
+// deleted or not, exists for its date and it has not been cancelled, so that
+// soft-deleted occurrences are never brought back.
+func materializeEventSeries(ctx context.Context, tx pgx.Tx, seriesID int, templateID int, slug string, rule *recurrence.Rule, startsOn time.Time, until time.Time) error {
+	existing := map[int64]bool{}
+	rows, err := tx.Query(ctx, `select occurrence_date from event where series_id = $1 and occurrence_date is not null`, seriesID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d time.Time
+		if err := rows.Scan(&d); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[d.Unix()] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	moved := map[int64]*time.Time{}
+	rows, err = tx.Query(ctx, `select occurrence_date, moved_to from event_series_exception where series_id = $1`, seriesID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d time.Time
+		var to *time.Time
+		if err := rows.Scan(&d, &to); err != nil {
+			rows.Close()
+			return err
+		}
+		moved[d.Unix()] = to
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	loc, err := seriesLocation(ctx, tx, templateID)
+	if err != nil {
+		return err
+	}
+
+	for _, occurrence := range rule.Occurrences(startsOn.In(loc), until) {
+		if existing[occurrence.Unix()] {
+			continue
+		}
+		start := occurrence
+		if to, ok := moved[occurrence.Unix()]; ok {
+			if to == nil {
+				continue
+			}
+			start = *to
+		}
+
+		shift := start.Sub(startsOn)
+		newID, err := copyEvent(ctx, tx, fmt.Sprint(templateID), occurrenceSlug(slug, occurrence), nil, shift, false, true)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE event SET series_id = $1, occurrence_date = $2 WHERE id = $3`, seriesID, occurrence, newID); err != nil {
+			return err
+		}
+		if err := copyEventChildren(ctx, tx, fmt.Sprint(templateID), newID, shift, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// occurrenceSlug derives the slug of an occurrence from the series slug and
+// the local date the rule produced for it, e.g. "weekly-meetup-20240312".
+func occurrenceSlug(slug string, occurrence time.Time) string {
+	return slug + "-" + occurrence.Format("20060102")
+}
+
+// seriesLocation returns the timezone of the series template. Rules are
+// expanded in it so that occurrences keep their local time across DST
+// changes.
+func seriesLocation(ctx context.Context, tx pgx.Tx, templateID int) (*time.Location, error) {
+	var tz string
+	if err := tx.QueryRow(ctx, `select timezone from event where id = $1`, templateID).Scan(&tz); err != nil {
+		return nil, err
+	}
+	loc, err := loadTimezone(tz)
+	if err != nil {
+		return nil, fmt.Errorf("series template has %w %q", err, tz)
+	}
+	return loc, nil
+}
+
+func deleteEventSeriesByID(r *EventSeriesDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		if ifMatch != nil {
+			var version *time.Time
+			if err := tx.QueryRow(ctx, seriesVersion+` and s.deleted = false`, id).Scan(&version); err != nil {
+				if err == pgx.ErrNoRows {
+					return fmt.Errorf("not found")
+				}
+				return err
+			}
+			if !etag.Matches(ifMatch, version) {
+				return fmt.Errorf("precondition failed")
+			}
+		}
+
+		res, err := tx.Exec(ctx, `UPDATE event_series SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE id = $1 AND deleted = false`, id, by)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return fmt.Errorf("not found")
+		}
+
+		rows, err := tx.Query(ctx, `select id from event where series_id = $1 and deleted = false
+			and (is_template = true or starts_on > now())`, id)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var eventID int
+			if err := rows.Scan(&eventID); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, eventID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, eventID := range ids {
+			if err := softDeleteEvent(ctx, tx, eventID, by); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreEventSeriesByID restores the series and the events deleted along
+// with it, leaving out the occurrences cancelled by an exception.
+func restoreEventSeriesByID(r *EventSeriesDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var seriesID int
+		var deleted bool
+		var deletedAt *time.Time
+		if err := tx.QueryRow(ctx, `select id, deleted, deleted_at from event_series where id = $1 for update`, id).Scan(&seriesID, &deleted, &deletedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+
+		rows, err := tx.Query(ctx, `select e.id from event e 
+			where e.series_id = $1 and e.deleted = true and e.deleted_at is not distinct from $2 
+			and not exists (select 1 from event_series_exception x 
+				where x.series_id = e.series_id and x.occurrence_date = e.occurrence_date and x.moved_to is null)`, seriesID, deletedAt)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var eventID int
+			if err := rows.Scan(&eventID); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, eventID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, eventID := range ids {
+			if err := restoreEvent(ctx, tx, eventID, deletedAt); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE event_series SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, seriesID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func updateEventSeriesOccurrence(r *EventSeriesDB, ctx *gin.Context, id string, eventID string, scope string, req event, ifMatch []time.Time) error {
+	toUpdate, toUpdateArgs := prepareEventUpdateQuery(req)
+	if len(toUpdateArgs) == 0 {
+		return fmt.Errorf("invalid values")
+	}
+
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var templateID int
+		var occurrenceDate, startsOn time.Time
+		var contentType string
+		var updatedAt *time.Time
+		if err := tx.QueryRow(ctx, `select s.template_event_id, e.occurrence_date, e.starts_on, e.content_type, e.updated_at
+			from event e join event_series s on s.id = e.series_id
+			where s.id = $1 and e.id = $2 and e.is_template = false
+			for update of e`, id, eventID).Scan(&templateID, &occurrenceDate, &startsOn, &contentType, &updatedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		// If-Match goes by the tag of the occurrence, as GET /event/:id sends it.
+		if !etag.Matches(ifMatch, updatedAt) {
+			return fmt.Errorf("precondition failed")
+		}
+
+		if req.ContentType != nil || req.Content != nil {
+			if req.ContentType != nil {
+				contentType = *req.ContentType
+			}
+			var content []byte
+			if req.Content != nil {
+				content = *req.Content
+			}
+			if err := r.schemas.Validate(ctx, contentType, content); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if scope == "this" {
+			_, err = tx.Exec(ctx, fmt.Sprintf(`UPDATE event SET %s WHERE id=$%d`, toUpdate, len(toUpdateArgs)+1),
+				append(toUpdateArgs, eventID)...)
+		} else {
+			sets, args := futureOccurrenceUpdate(req, startsOn)
+			n := len(args)
+			_, err = tx.Exec(ctx, fmt.Sprintf(`UPDATE event SET %s WHERE id=$%d
+				OR (series_id=$%d AND is_template = false AND deleted = false AND occurrence_date >= $%d)`, sets, n+1, n+2, n+3),
+				append(args, templateID, id, occurrenceDate)...)
+		}
+		if err != nil {
+			return fmt.Errorf("problem updating event series occurrence: %w", err)
+		}
+		return nil
+	})
+}
+
+// futureOccurrenceUpdate returns the SET clause and its arguments for the
+// template and the occurrences from the one starting at startsOn. Their
+// registration windows are relative to their start, as materializing an
+// occurrence shifts the window of the template, so the windows of req are
+// saved as offsets from startsOn.
+func futureOccurrenceUpdate(req event, startsOn time.Time) (string, []interface{}) {
+	opensAt, closesAt := req.RegistrationOpensAt, req.RegistrationClosesAt
+	req.RegistrationOpensAt, req.RegistrationClosesAt = nil, nil
+
+	toUpdate, args := prepareEventUpdateQuery(req)
+	var sets []string
+	if len(args) != 0 {
+		sets = append(sets, toUpdate)
+	} else {
+		sets = append(sets, "updated_at = now()")
+	}
+	if opensAt != nil {
+		args = append(args, opensAt.Sub(startsOn))
+		sets = append(sets, fmt.Sprintf("registration_opens_at = starts_on + $%d::interval", len(args)))
+	}
+	if closesAt != nil {
+		args = append(args, closesAt.Sub(startsOn))
+		sets = append(sets, fmt.Sprintf("registration_closes_at = starts_on + $%d::interval", len(args)))
+	}
+	return strings.Join(sets, ","), args
+}
+
+func createEventSeriesException(r *EventSeriesDB, ctx context.Context, id string, req eventSeriesException, by *string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var seriesID, templateID int
+		var rrule string
+		var startsOn time.Time
+		if err := tx.QueryRow(ctx, `select id, template_event_id, rrule, starts_on from event_series where id = $1 and deleted = false`, id).Scan(&seriesID, &templateID, &rrule, &startsOn); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+
+		rule, err := recurrence.Parse(rrule)
+		if err != nil {
+			return err
+		}
+		loc, err := seriesLocation(ctx, tx, templateID)
+		if err != nil {
+			return err
+		}
+		if !rule.Includes(startsOn.In(loc), *req.OccurrenceDate) {
+			return fmt.Errorf("not an occurrence of the series")
+		}
+
+		if _, err := tx.Exec(ctx, `INSERT INTO event_series_exception (series_id, occurrence_date, moved_to)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (series_id, occurrence_date) DO UPDATE SET
+				moved_to = EXCLUDED.moved_to,
+				updated_at = now()`, seriesID, *req.OccurrenceDate, req.MovedTo); err != nil {
+			return fmt.Errorf("problem saving event series exception: %w", err)
+		}
+
+		// Occurrences that are not materialized yet pick the exception up when
+		// they are.
+		var eventID int
+		var eventStartsOn time.Time
+		var deleted bool
+		if err := tx.QueryRow(ctx, `select id, starts_on, coalesce(deleted, false) from event
+			where series_id = $1 and occurrence_date = $2`, seriesID, *req.OccurrenceDate).Scan(&eventID, &eventStartsOn, &deleted); err != nil {
+			if err == pgx.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+
+		if req.MovedTo == nil {
+			if !deleted {
+				if err := softDeleteEvent(ctx, tx, eventID, by); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if deleted {
+			return fmt.Errorf("occurrence is cancelled")
+		}
+
+		// Registration windows move along with the occurrence.
+		shift := req.MovedTo.Sub(eventStartsOn)
+		if _, err := tx.Exec(ctx, `UPDATE event SET starts_on = starts_on + $1::interval, ends_on = ends_on + $1::interval,
+			registration_opens_at = registration_opens_at + $1::interval,
+			registration_closes_at = registration_closes_at + $1::interval,
+			updated_at = now()
+			WHERE id = $2`, shift, eventID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE event_participation_option SET
+			registration_opens_at = registration_opens_at + $1::interval,
+			registration_closes_at = registration_closes_at + $1::interval,
+			updated_at = now()
+			WHERE event_id = $2`, shift, eventID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE item SET start_date = start_date + $1::interval, updated_at = now()
+			WHERE id IN (select item_id from event_item where event_id = $2)`, shift, eventID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,31 @@
+package event
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFutureOccurrenceUpdate(t *testing.T) {
+	startsOn := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	opensAt := startsOn.AddDate(0, 0, -7)
+	closesAt := startsOn.Add(-time.Hour)
+	name := "Meetup"
+
+	sets, args := futureOccurrenceUpdate(event{RegistrationOpensAt: &opensAt, RegistrationClosesAt: &closesAt}, startsOn)
+	if want := "updated_at = now(),registration_opens_at = starts_on + $1::interval,registration_closes_at = starts_on + $2::interval"; sets != want {
+		t.Errorf("sets = %q, want %q", sets, want)
+	}
+	if want := []interface{}{-7 * 24 * time.Hour, -time.Hour}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+
+	sets, args = futureOccurrenceUpdate(event{Name: &name, RegistrationClosesAt: &closesAt}, startsOn)
+	if !strings.HasPrefix(sets, "name=$1,updated_at=$2,") || !strings.HasSuffix(sets, ",registration_closes_at = starts_on + $3::interval") {
+		t.Errorf("sets = %q", sets)
+	}
+	if len(args) != 3 || args[0] != name || args[2] != -time.Hour {
+		t.Errorf("args = %v", args)
+	}
+}
@@ -0,0 +1,32 @@
+package event
+
+import (
+	"vh-srv-event/schema"
+	"vh-srv-event/translation"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type EventTranslation interface {
+	GetAllEventTranslation(ctx *gin.Context)
+	UpsertEventTranslation(ctx *gin.Context)
+}
+
+type EventTranslationDB struct {
+	translations *translation.Translations
+}
+
+func NewEventTranslation(db *pgxpool.Pool, schemas *schema.Registry) EventTranslation {
+	return &EventTranslationDB{
+		translation.New(db, schemas, "event"),
+	}
+}
+
+func (r *EventTranslationDB) GetAllEventTranslation(ctx *gin.Context) {
+	r.translations.GetAll(ctx)
+}
+
+func (r *EventTranslationDB) UpsertEventTranslation(ctx *gin.Context) {
+	r.translations.Upsert(ctx)
+}
@@ -0,0 +1,76 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Registration statuses of events and of their participation options.
+const (
+	RegistrationOpen      = "open"
+	RegistrationClosed    = "closed"
+	RegistrationCancelled = "cancelled"
+)
+
+func validateRegistrationWindow(opensAt *time.Time, closesAt *time.Time) error {
+	if opensAt != nil && closesAt != nil && !closesAt.After(*opensAt) {
+		return fmt.Errorf("registration_closes_at must be after registration_opens_at")
+	}
+	return nil
+}
+
+// initialRegistrationStatus is the status of a new event or participation
+// option created without one: closed outside its registration window.
+func initialRegistrationStatus(opensAt *time.Time, closesAt *time.Time) string {
+	now := time.Now()
+	if (opensAt != nil && now.Before(*opensAt)) || (closesAt != nil && !now.Before(*closesAt)) {
+		return RegistrationClosed
+	}
+	return RegistrationOpen
+}
+
+// RegistrationScheduler opens and closes registration on events and
+// participation options when their registration window starts and ends.
+// A status changed by hand after a window boundary is left alone, and
+// cancelled registrations are never reopened.
+type RegistrationScheduler struct {
+	db *pgxpool.Pool
+}
+
+func NewRegistrationScheduler(db *pgxpool.Pool) *RegistrationScheduler {
+	return &RegistrationScheduler{
+		db,
+	}
+}
+
+func (s *RegistrationScheduler) Run(ctx context.Context) error {
+	for _, table := range []string{"event", "event_participation_option"} {
+		opened, err := s.db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET registration_status = $1, registration_status_changed_at = now(), updated_at = now()
+			WHERE registration_status = $2
+			AND registration_opens_at <= now()
+			AND (registration_closes_at IS NULL OR registration_closes_at > now())
+			AND (registration_status_changed_at IS NULL OR registration_status_changed_at < registration_opens_at)
+			AND coalesce(deleted, false) = false`, table), RegistrationOpen, RegistrationClosed)
+		if err != nil {
+			return fmt.Errorf("problem opening %s registrations: %w", table, err)
+		}
+
+		closed, err := s.db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET registration_status = $1, registration_status_changed_at = now(), updated_at = now()
+			WHERE registration_status = $2
+			AND registration_closes_at <= now()
+			AND (registration_status_changed_at IS NULL OR registration_status_changed_at < registration_closes_at)
+			AND coalesce(deleted, false) = false`, table), RegistrationClosed, RegistrationOpen)
+		if err != nil {
+			return fmt.Errorf("problem closing %s registrations: %w", table, err)
+		}
+
+		if opened.RowsAffected() != 0 || closed.RowsAffected() != 0 {
+			log.Printf("registration: %s: %d opened, %d closed", table, opened.RowsAffected(), closed.RowsAffected())
+		}
+	}
+	return nil
+}
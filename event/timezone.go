@@ -0,0 +1,43 @@
+package event
+
+import (
+	"fmt"
+	"time"
+)
+
+// loadTimezone resolves an IANA timezone name such as "Europe/Lisbon" against
+// the embedded tzdata. Empty names and "Local" are rejected because they
+// depend on the machine the service runs on.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid timezone")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone")
+	}
+	return loc, nil
+}
+
+// localizeEvent returns the event dates in UTC and fills in their
+// counterparts in the event's own timezone.
+func localizeEvent(u *eventResponse) {
+	loc := time.UTC
+	if u.Timezone != nil {
+		if l, err := loadTimezone(*u.Timezone); err == nil {
+			loc = l
+		}
+	}
+	u.StartsOn, u.StartsOnLocal = inZones(u.StartsOn, loc)
+	u.EndsOn, u.EndsOnLocal = inZones(u.EndsOn, loc)
+}
+
+// inZones returns t in UTC and in loc.
+func inZones(t *time.Time, loc *time.Location) (*time.Time, *time.Time) {
+	if t == nil {
+		return nil, nil
+	}
+	utc := t.UTC()
+	local := t.In(loc)
+	return &utc, &local
+}
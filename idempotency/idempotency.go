@@ -0,0 +1,278 @@
+// Package idempotency lets clients retry POST requests safely. A request sent
+// with an Idempotency-Key header runs once; retries with the same key get the
+// stored response back until the key expires, and reusing the key for a
+// different request is rejected.
+//
+// Keys are scoped to the X-Actor of the request, which the service takes from
+// the gateway in front of it without checking. The scope keeps the keys that
+// clients pick from colliding, it does not keep them apart: a client that can
+// send any X-Actor can replay the responses stored for that actor, so the
+// gateway must set X-Actor itself.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"vh-srv-event/actor"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Header carries the key a client picks for a request and sends again with
+// its retries.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on the responses replayed from a stored one.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// maxKeyLength bounds the keys accepted from clients.
+const maxKeyLength = 255
+
+// maxBodySize bounds the bodies of the requests made with a key, which are
+// read in memory to be fingerprinted.
+const maxBodySize = 1 << 20
+
+// maxStoredBodySize bounds the response bodies stored. A larger response is
+// stored without its body, so that a retry gets its status and Location only.
+const maxStoredBodySize = 1 << 20
+
+// inFlightTimeout is how long a key stays taken by a request that neither
+// completes nor fails, as when the server stops while serving it.
+const inFlightTimeout = time.Minute
+
+// Keys stores the responses to the requests made with an Idempotency-Key in
+// the idempotency_key table, by actor and key.
+type Keys struct {
+	db  *pgxpool.Pool
+	ttl time.Duration
+}
+
+func NewKeys(db *pgxpool.Pool, ttl time.Duration) *Keys {
+	return &Keys{
+		db,
+		ttl,
+	}
+}
+
+type record struct {
+	fingerprint string
+	status      *int
+	contentType *string
+	location    *string
+	body        []byte
+}
+
+// recorder keeps a copy of the response written to the client, up to
+// maxStoredBodySize.
+type recorder struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.keep(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recorder) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *recorder) keep(b []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(b) > maxStoredBodySize {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(b)
+}
+
+// Middleware honors Idempotency-Key on POST requests. The first request with
+// a key runs and its response is stored, unless it fails with a server error
+// so that it can be retried. A retry gets the stored response, 409 while the
+// first request is still running, and 422 when its method, path or body
+// differ. Bodies over maxBodySize get 413, and multipart requests 415 since
+// their boundary changes from one retry to the next.
+func (k *Keys) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(Header)
+		if ctx.Request.Method != http.MethodPost || key == "" {
+			ctx.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long", "success": false})
+			return
+		}
+
+		if strings.HasPrefix(ctx.ContentType(), "multipart/") {
+			ctx.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":   "Idempotency-Key is not supported on multipart requests",
+				"success": false,
+			})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxBodySize+1))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+			return
+		}
+		if len(body) > maxBodySize {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":   "request body is too large for an Idempotency-Key",
+				"success": false,
+			})
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		owner := ""
+		if a := actor.FromContext(ctx); a != nil {
+			owner = *a
+		}
+		fingerprint := fingerprintOf(ctx.Request, body)
+
+		stored, err := k.claim(ctx, owner, key, fingerprint)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "success": false})
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.fingerprint != fingerprint:
+				ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error":   "Idempotency-Key was already used for a different request",
+					"success": false,
+				})
+			case stored.status == nil:
+				ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error":   "a request with this Idempotency-Key is in progress",
+					"success": false,
+				})
+			default:
+				replay(ctx, stored)
+			}
+			return
+		}
+
+		w := &recorder{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		ctx.Next()
+
+		// The request may be cancelled by now, the outcome is kept anyway.
+		saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := k.save(saveCtx, owner, key, w); err != nil {
+			log.Printf("idempotency: problem saving the response to key %q: %v", key, err)
+		}
+	}
+}
+
+// fingerprintOf identifies a request by its method, path and body.
+func fingerprintOf(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claim takes key for the request with fingerprint. It returns the record of
+// the key when another request holds it, and nil when the key was free or had
+// expired.
+func (k *Keys) claim(ctx context.Context, owner string, key string, fingerprint string) (*record, error) {
+	for {
+		res, err := k.db.Exec(ctx, `INSERT INTO idempotency_key (actor, key, fingerprint, expires_at)
+			VALUES ($1, $2, $3, now() + $4::interval)
+			ON CONFLICT (actor, key) DO UPDATE SET
+				fingerprint = EXCLUDED.fingerprint,
+				status = null,
+				content_type = null,
+				location = null,
+				body = null,
+				created_at = now(),
+				expires_at = EXCLUDED.expires_at
+			WHERE idempotency_key.expires_at <= now()`, owner, key, fingerprint, inFlightTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if res.RowsAffected() == 1 {
+			return nil, nil
+		}
+
+		r := record{}
+		if err := k.db.QueryRow(ctx, `select fingerprint, status, content_type, location, body
+		from idempotency_key where actor = $1 and key = $2 and expires_at > now()`, owner, key).Scan(
+			&r.fingerprint,
+			&r.status,
+			&r.contentType,
+			&r.location,
+			&r.body,
+		); err != nil {
+			// It expired in between, so it can be claimed now.
+			if err == pgx.ErrNoRows {
+				continue
+			}
+			return nil, err
+		}
+		return &r, nil
+	}
+}
+
+// save stores the response recorded by w for key, or frees the key when the
+// request failed with a server error.
+func (k *Keys) save(ctx context.Context, owner string, key string, w *recorder) error {
+	if w.Status() >= http.StatusInternalServerError {
+		_, err := k.db.Exec(ctx, `delete from idempotency_key where actor = $1 and key = $2`, owner, key)
+		return err
+	}
+
+	var contentType, location *string
+	if s := w.Header().Get("Content-Type"); s != "" {
+		contentType = &s
+	}
+	if s := w.Header().Get("Location"); s != "" {
+		location = &s
+	}
+	if w.overflow {
+		contentType = nil
+	}
+	_, err := k.db.Exec(ctx, `UPDATE idempotency_key SET status = $3, content_type = $4, location = $5, body = $6,
+		expires_at = now() + $7::interval
+		WHERE actor = $1 AND key = $2`, owner, key, w.Status(), contentType, location, w.body.Bytes(), k.ttl)
+	return err
+}
+
+func replay(ctx *gin.Context, r *record) {
+	ctx.Header(ReplayedHeader, "true")
+	if r.location != nil {
+		ctx.Header("Location", *r.location)
+	}
+	contentType := ""
+	if r.contentType != nil {
+		contentType = *r.contentType
+	}
+	ctx.Data(*r.status, contentType, r.body)
+	ctx.Abort()
+}
+
+// Run deletes the expired keys. It is meant to be scheduled.
+func (k *Keys) Run(ctx context.Context) error {
+	_, err := k.db.Exec(ctx, `delete from idempotency_key where expires_at <= now()`)
+	return err
+}
@@ -0,0 +1,113 @@
+package idempotency
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMiddlewareRejects covers the requests turned away before their key is
+// looked up, so that no database is needed.
+func TestMiddlewareRejects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	k := &Keys{}
+
+	tests := []struct {
+		name        string
+		key         string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"key too long", strings.Repeat("k", maxKeyLength+1), "application/json", "{}", http.StatusBadRequest},
+		{"multipart", "key", "multipart/form-data; boundary=x", "--x--", http.StatusUnsupportedMediaType},
+		{"body too large", "key", "text/csv", strings.Repeat("a", maxBodySize+1), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/participants/import", strings.NewReader(tt.body))
+			ctx.Request.Header.Set(Header, tt.key)
+			ctx.Request.Header.Set("Content-Type", tt.contentType)
+
+			k.Middleware()(ctx)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if !ctx.IsAborted() {
+				t.Error("request was not aborted")
+			}
+		})
+	}
+}
+
+func TestMiddlewareIgnores(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	k := &Keys{}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/v1/event/", strings.NewReader("{}")),
+		httptest.NewRequest(http.MethodPatch, "/v1/event/1", strings.NewReader("{}")),
+	} {
+		if req.Method != http.MethodPost {
+			req.Header.Set(Header, "key")
+		}
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = req
+
+		k.Middleware()(ctx)
+
+		if ctx.IsAborted() {
+			t.Errorf("%s without a key on POST was aborted", req.Method)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	req := func(method string, target string) *http.Request {
+		return httptest.NewRequest(method, target, nil)
+	}
+
+	base := fingerprintOf(req(http.MethodPost, "/v1/event/"), []byte(`{"slug":"a"}`))
+	if fingerprintOf(req(http.MethodPost, "/v1/event/"), []byte(`{"slug":"a"}`)) != base {
+		t.Error("same request has another fingerprint")
+	}
+	for name, other := range map[string]string{
+		"body":   fingerprintOf(req(http.MethodPost, "/v1/event/"), []byte(`{"slug":"b"}`)),
+		"path":   fingerprintOf(req(http.MethodPost, "/v1/item/"), []byte(`{"slug":"a"}`)),
+		"query":  fingerprintOf(req(http.MethodPost, "/v1/event/?dry_run=true"), []byte(`{"slug":"a"}`)),
+		"method": fingerprintOf(req(http.MethodPut, "/v1/event/"), []byte(`{"slug":"a"}`)),
+	} {
+		if other == base {
+			t.Errorf("request with another %s has the same fingerprint", name)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	w := &recorder{ResponseWriter: ctx.Writer}
+	w.Write([]byte("ab"))
+	w.WriteString("cd")
+	if w.overflow || w.body.String() != "abcd" {
+		t.Errorf("recorded %q (overflow %v), want \"abcd\"", w.body.String(), w.overflow)
+	}
+
+	w.Write(bytes.Repeat([]byte("a"), maxStoredBodySize))
+	if !w.overflow || w.body.Len() != 0 {
+		t.Errorf("recorded %d bytes (overflow %v) past maxStoredBodySize, want none", w.body.Len(), w.overflow)
+	}
+	w.Write([]byte("e"))
+	if w.body.Len() != 0 {
+		t.Error("recorded after overflowing")
+	}
+}
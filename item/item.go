@@ -2,12 +2,21 @@ package item
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/language"
+	"vh-srv-event/schema"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -15,24 +24,28 @@ import (
 )
 
 type itemResponse struct {
-	ID               *int       `json:"id" db:"id"`
-	StartDate        *time.Time `json:"start_date" db:"start_date"`
-	Duration         *int       `json:"duration" db:"duration"`
-	Name             *string    `json:"name" db:"name"`
-	Content          *string    `json:"content,omitempty" db:"content"`
-	OriginalLanguage *string    `json:"original_language" db:"original_language"`
-	Translated       *bool      `json:"translated" db:"translated"`
-	CreatedAt        *time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt        *time.Time `json:"updated_at" db:"updated_at"`
+	ID               *int             `json:"id" db:"id"`
+	StartDate        *time.Time       `json:"start_date" db:"start_date"`
+	Duration         *int             `json:"duration" db:"duration"`
+	Name             *string          `json:"name" db:"name"`
+	Content          *json.RawMessage `json:"content,omitempty" db:"content"`
+	ContentType      *string          `json:"content_type" db:"content_type"`
+	Language         *string          `json:"language" db:"language"`
+	OriginalLanguage *string          `json:"original_language" db:"original_language"`
+	Translated       *bool            `json:"translated" db:"translated"`
+	DeletedAt        *time.Time       `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy        *string          `json:"deleted_by,omitempty" db:"deleted_by"`
+	CreatedAt        *time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt        *time.Time       `json:"updated_at" db:"updated_at"`
 }
 
 type item struct {
-	StartDate        *time.Time `json:"start_date" db:"start_date" validate:"required"`
-	Duration         *int       `json:"duration" db:"duration" validate:"required"`
-	Name             *string    `json:"name" db:"name" validate:"required"`
-	Content          *string    `json:"content,omitempty" db:"content"`
-	OriginalLanguage *string    `json:"original_language" db:"original_language" validate:"required"`
-	Translated       *bool      `json:"translated" db:"translated" validate:"required"`
+	StartDate        *time.Time       `json:"start_date" db:"start_date" validate:"required"`
+	Duration         *int             `json:"duration" db:"duration" validate:"required"`
+	Name             *string          `json:"name" db:"name" validate:"required"`
+	Content          *json.RawMessage `json:"content,omitempty" db:"content"`
+	ContentType      *string          `json:"content_type,omitempty" db:"content_type"`
+	OriginalLanguage *string          `json:"original_language" db:"original_language" validate:"required"`
 }
 
 type Item interface {
@@ -41,22 +54,62 @@ type Item interface {
 	CreateNewItem(ctx *gin.Context)
 	UpdateItemByID(ctx *gin.Context)
 	DeleteItemByID(ctx *gin.Context)
+	RestoreItemByID(ctx *gin.Context)
 }
 
 type ItemDB struct {
-	db *pgxpool.Pool
+	db                   *pgxpool.Pool
+	lang                 *language.Resolver
+	translationLanguages []string
+	schemas              *schema.Registry
 }
 
-func NewItem(db *pgxpool.Pool) Item {
+func NewItem(db *pgxpool.Pool, lang *language.Resolver, translationLanguages []string, schemas *schema.Registry) Item {
 	return &ItemDB{
 		db,
+		lang,
+		translationLanguages,
+		schemas,
 	}
 }
 
+// itemSelectQuery reads items with name and content taken from the best
+// translation for the candidate languages in $1, falling back to the original
+// text. translated is true when every language in $2 is covered.
+const itemSelectQuery = `select 
+	i.id,
+	i.start_date,
+	i.duration,
+	coalesce(tr.name, i.name),
+	coalesce(tr.content, i.content),
+	i.content_type,
+	coalesce(tr.language, i.original_language),
+	i.original_language,
+	not exists (
+		select 1 from unnest($2::text[]) l(code) 
+		where l.code <> i.original_language 
+		and not exists (select 1 from item_translation t where t.item_id = i.id and t.language = l.code)
+	),
+	i.deleted_at,
+	i.deleted_by,
+	i.created_at,
+	i.updated_at 
+	from item i 
+	left join lateral (
+		select t.language, t.name, t.content from item_translation t 
+		where t.item_id = i.id 
+		and t.language = any($1::text[]) 
+		and array_position($1::text[], t.language) < coalesce(array_position($1::text[], i.original_language), 2147483647) 
+		order by array_position($1::text[], t.language) 
+		limit 1
+	) tr on true`
+
+// GetItemByID returns the item, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *ItemDB) GetItemByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getItemByID(r, ctx, id)
+	u, err := getItemByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -72,9 +125,16 @@ func (r *ItemDB) GetItemByID(ctx *gin.Context) {
 		})
 		return
 	}
+	// The translation picked depends on Accept-Language.
+	ctx.Header("Vary", "Accept-Language")
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllItem lists the items, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *ItemDB) GetAllItem(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -101,7 +161,7 @@ func (r *ItemDB) GetAllItem(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllItem(r, ctx, intSkip, intLimit)
+	u, err := getAllItem(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -133,7 +193,31 @@ func (r *ItemDB) CreateNewItem(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewItem(r, ctx, s); err != nil {
+	if err := validateItemContent(r, ctx, s, ""); err != nil {
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id, err := createNewItem(r, ctx, s)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -141,7 +225,18 @@ func (r *ItemDB) CreateNewItem(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Item!", "data": s, "success": true})
+	u, err := getItemByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Item!", "data": u, "success": true})
 }
 
 func (r *ItemDB) UpdateItemByID(ctx *gin.Context) {
@@ -156,7 +251,44 @@ func (r *ItemDB) UpdateItemByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := updateItemByID(r, ctx, u, id); err != nil {
+	if err := validateItemContent(r, ctx, u, id); err != nil {
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if err := updateItemByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -166,6 +298,14 @@ func (r *ItemDB) UpdateItemByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -180,14 +320,41 @@ func (r *ItemDB) UpdateItemByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Item updated successfully", "data": u, "success": true})
+
+	updated, err := getItemByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Item updated successfully", "data": updated, "success": true})
 }
 
+// DeleteItemByID soft deletes the item along with its links to events and
+// broadcast urls.
 func (r *ItemDB) DeleteItemByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteItemByID(r, ctx, id); err != nil {
+	if err := deleteItemByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -198,24 +365,51 @@ func (r *ItemDB) DeleteItemByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Item deleted successfully!", "success": true})
 }
 
-func getItemByID(r *ItemDB, ctx *gin.Context, id string) (itemResponse, error) {
+// RestoreItemByID restores the item along with the links deleted with it.
+func (r *ItemDB) RestoreItemByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreItemByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Item restored successfully!", "success": true})
+}
+
+func getItemByID(r *ItemDB, ctx *gin.Context, id string, includeDeleted bool) (itemResponse, error) {
 	u := itemResponse{}
-	if err := r.db.QueryRow(ctx, `select 
-	id,
-	start_date,
-	duration,
-	name,
-	original_language,
-	translated,
-	created_at,
-	updated_at 
-	from item where id = $1`, id).Scan(
+	if err := r.db.QueryRow(ctx, itemSelectQuery+` where i.id = $3 and ($4 or coalesce(i.deleted, false) = false)`,
+		r.lang.Expand(language.Requested(ctx)...), r.translationLanguages, id, includeDeleted).Scan(
 		&u.ID,
 		&u.StartDate,
 		&u.Duration,
 		&u.Name,
+		&u.Content,
+		&u.ContentType,
+		&u.Language,
 		&u.OriginalLanguage,
 		&u.Translated,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -227,22 +421,18 @@ func getItemByID(r *ItemDB, ctx *gin.Context, id string) (itemResponse, error) {
 	return u, nil
 }
 
-func getAllItem(r *ItemDB, ctx *gin.Context, skip int, limit int) (*[]itemResponse, error) {
+func getAllItem(r *ItemDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]itemResponse, error) {
 
 	u := []itemResponse{}
-	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
-	id,
-	start_date,
-	duration,
-	name,
-	original_language,
-	translated,
-	created_at,
-	updated_at 
-	from item LIMIT %d OFFSET %d`, limit, skip))
+	rows, err := r.db.Query(ctx, itemSelectQuery+fmt.Sprintf(` where $3 or coalesce(i.deleted, false) = false LIMIT %d OFFSET %d`, limit, skip),
+		r.lang.Expand(language.Requested(ctx)...), r.translationLanguages, includeDeleted)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var d itemResponse
-		err := rows.Scan(&d.ID, &d.StartDate, &d.Duration, &d.Name, &d.OriginalLanguage, &d.Translated, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.StartDate, &d.Duration, &d.Name, &d.Content, &d.ContentType, &d.Language, &d.OriginalLanguage, &d.Translated, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -251,19 +441,19 @@ func getAllItem(r *ItemDB, ctx *gin.Context, skip int, limit int) (*[]itemRespon
 	return &u, rows.Err()
 }
 
-func updateItemByID(r *ItemDB, ctx *gin.Context, req item, id string) error {
+func updateItemByID(r *ItemDB, ctx *gin.Context, req item, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareItemUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE item SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE item SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating item: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from item where id = $1)`, id)
 		}
 
 		return nil
@@ -272,25 +462,106 @@ func updateItemByID(r *ItemDB, ctx *gin.Context, req item, id string) error {
 	}
 }
 
-func createNewItem(r *ItemDB, ctx *gin.Context, req item) error {
+// validateItemContent checks the content of a create (id == "") or update
+// request against the schema of its content type. On update, the stored
+// content type or content is used for whichever of the two is not changed.
+func validateItemContent(r *ItemDB, ctx *gin.Context, req item, id string) error {
+	if req.Content == nil && req.ContentType == nil {
+		return nil
+	}
+
+	contentType := "item"
+	var content []byte
+	if id != "" {
+		if err := r.db.QueryRow(ctx, `select content_type, content from item where id = $1`, id).Scan(&contentType, &content); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+	}
+	if req.ContentType != nil {
+		contentType = *req.ContentType
+	}
+	if req.Content != nil {
+		content = *req.Content
+	}
+
+	return r.schemas.Validate(ctx, contentType, content)
+}
+
+func createNewItem(r *ItemDB, ctx *gin.Context, req item) (int, error) {
 	createString, numString, createQueryArgs := prepareItemCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO item (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating item: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO item (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating item: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func deleteItemByID(r *ItemDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from item where id=$1", id)
-	return err
+// deleteItemByID marks the item and its event and broadcast url links deleted
+// in one transaction, so that they share the deletion time restoreItemByID
+// goes by.
+func deleteItemByID(r *ItemDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, `UPDATE item SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return etag.Missed(ctx, tx, ifMatch, `select exists(select 1 from item where id = $1 and coalesce(deleted, false) = false)`, id)
+		}
+
+		for _, table := range []string{"event_item", "item_broadcast_url"} {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE %s SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+			WHERE item_id = $1 AND coalesce(deleted, false) = false`, table), id, by); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreItemByID restores the item and the links deleted along with it,
+// except those to an event or broadcast url deleted since. Links deleted on
+// their own before stay deleted.
+func restoreItemByID(r *ItemDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted bool
+		var deletedAt *time.Time
+		if err := tx.QueryRow(ctx, `select coalesce(deleted, false), deleted_at from item where id = $1 for update`, id).Scan(&deleted, &deletedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE event_item ei SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ei.item_id = $1 AND coalesce(ei.deleted, false) = true AND ei.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from event e where e.id = ei.event_id and coalesce(e.deleted, false) = true)`, id, deletedAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE item_broadcast_url ib SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ib.item_id = $1 AND coalesce(ib.deleted, false) = true AND ib.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from broadcast_url b where b.id = ib.broadcast_url_id and coalesce(b.deleted, false) = true)`, id, deletedAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE item SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 func prepareItemUpdateQuery(req item) (string, []interface{}) {
@@ -309,14 +580,18 @@ func prepareItemUpdateQuery(req item) (string, []interface{}) {
 		updateStrings = append(updateStrings, fmt.Sprintf("name=$%d", len(updateStrings)+1))
 		args = append(args, *req.Name)
 	}
+	if req.Content != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("content=$%d", len(updateStrings)+1))
+		args = append(args, *req.Content)
+	}
+	if req.ContentType != nil {
+		updateStrings = append(updateStrings, fmt.Sprintf("content_type=$%d", len(updateStrings)+1))
+		args = append(args, *req.ContentType)
+	}
 	if req.OriginalLanguage != nil {
 		updateStrings = append(updateStrings, fmt.Sprintf("original_language=$%d", len(updateStrings)+1))
 		args = append(args, *req.OriginalLanguage)
 	}
-	if req.Translated != nil {
-		updateStrings = append(updateStrings, fmt.Sprintf("translated=$%d", len(updateStrings)+1))
-		args = append(args, *req.Translated)
-	}
 
 	if len(args) != 0 {
 		updateStrings = append(updateStrings, fmt.Sprintf("updated_at=$%d", len(updateStrings)+1))
@@ -353,16 +628,16 @@ func prepareItemCreateQuery(req item) (string, string, []interface{}) {
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.Content)
 	}
+	if req.ContentType != nil {
+		createStrings = append(createStrings, "content_type")
+		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
+		args = append(args, *req.ContentType)
+	}
 	if req.OriginalLanguage != nil {
 		createStrings = append(createStrings, "original_language")
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.OriginalLanguage)
 	}
-	if req.Translated != nil {
-		createStrings = append(createStrings, "translated")
-		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
-		args = append(args, *req.Translated)
-	}
 
 	concatedCreateString := strings.Join(createStrings, ",")
 	concatedNumString := strings.Join(numString, ",")
@@ -4,10 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/language"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -18,6 +25,8 @@ type itemBroadcastURLResponse struct {
 	ID             *int       `json:"id" db:"id"`
 	ItemID         *int       `json:"item_id" db:"item_id"`
 	BoradcastURLID *int       `json:"broadcast_url_id" db:"broadcast_url_id"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy      *string    `json:"deleted_by,omitempty" db:"deleted_by"`
 	CreatedAt      *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt      *time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -27,28 +36,42 @@ type itemBroadcastURL struct {
 	BoradcastURLID *int `json:"broadcast_url_id" db:"broadcast_url_id" validate:"required"`
 }
 
+type selectedBroadcastURLResponse struct {
+	ID       *int    `json:"id" db:"id"`
+	ItemID   *int    `json:"item_id" db:"item_id"`
+	URL      *string `json:"url" db:"url"`
+	Platform *string `json:"platform" db:"platform"`
+	Language *string `json:"language" db:"language"`
+}
+
 type ItemBroadcastURL interface {
 	GetItemBroadcastURLByID(ctx *gin.Context)
+	GetBroadcastURLForItem(ctx *gin.Context)
 	GetAllItemBroadcastURL(ctx *gin.Context)
 	CreateNewItemBroadcastURL(ctx *gin.Context)
 	UpdateItemBroadcastURLByID(ctx *gin.Context)
 	DeleteItemBroadcastURLByID(ctx *gin.Context)
+	RestoreItemBroadcastURLByID(ctx *gin.Context)
 }
 
 type ItemBroadcastURLDB struct {
-	db *pgxpool.Pool
+	db   *pgxpool.Pool
+	lang *language.Resolver
 }
 
-func NewItemBroadcastURL(db *pgxpool.Pool) ItemBroadcastURL {
+func NewItemBroadcastURL(db *pgxpool.Pool, lang *language.Resolver) ItemBroadcastURL {
 	return &ItemBroadcastURLDB{
 		db,
+		lang,
 	}
 }
 
+// GetItemBroadcastURLByID returns the link, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *ItemBroadcastURLDB) GetItemBroadcastURLByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getItemBroadcastURLByID(r, ctx, id)
+	u, err := getItemBroadcastURLByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -64,9 +87,52 @@ func (r *ItemBroadcastURLDB) GetItemBroadcastURLByID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetBroadcastURLForItem picks the broadcast URL of an item whose language
+// best matches the viewer: ?lang=, then the participant's languages when
+// ?participant_id= is given, then Accept-Language and the fallback chains.
+func (r *ItemBroadcastURLDB) GetBroadcastURLForItem(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	var preferences []string
+	if participantID := ctx.Query("participant_id"); participantID != "" {
+		p, err := language.ParticipantPreferences(ctx, r.db, participantID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		preferences = p
+	}
+
+	u, err := selectBroadcastURLForItem(r, ctx, id, language.Requested(ctx, preferences...))
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetAllItemBroadcastURL lists the links, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *ItemBroadcastURLDB) GetAllItemBroadcastURL(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -93,7 +159,7 @@ func (r *ItemBroadcastURLDB) GetAllItemBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllItemBroadcastURL(r, ctx, intSkip, intLimit)
+	u, err := getAllItemBroadcastURL(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -125,7 +191,8 @@ func (r *ItemBroadcastURLDB) CreateNewItemBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewItemBroadcastURL(r, ctx, s); err != nil {
+	id, err := createNewItemBroadcastURL(r, ctx, s)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -133,7 +200,18 @@ func (r *ItemBroadcastURLDB) CreateNewItemBroadcastURL(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Item BroadcastURL!", "data": s, "success": true})
+	u, err := getItemBroadcastURLByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Item BroadcastURL!", "data": u, "success": true})
 }
 
 func (r *ItemBroadcastURLDB) UpdateItemBroadcastURLByID(ctx *gin.Context) {
@@ -148,7 +226,7 @@ func (r *ItemBroadcastURLDB) UpdateItemBroadcastURLByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := updateItemBroadcastURLByID(r, ctx, u, id); err != nil {
+	if err := updateItemBroadcastURLByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -158,6 +236,14 @@ func (r *ItemBroadcastURLDB) UpdateItemBroadcastURLByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -172,14 +258,39 @@ func (r *ItemBroadcastURLDB) UpdateItemBroadcastURLByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Item BroadcastURL updated successfully", "data": u, "success": true})
+
+	updated, err := getItemBroadcastURLByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Item BroadcastURL updated successfully", "data": updated, "success": true})
 }
 
 func (r *ItemBroadcastURLDB) DeleteItemBroadcastURLByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteItemBroadcastURLByID(r, ctx, id); err != nil {
+	if err := deleteItemBroadcastURLByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -190,18 +301,53 @@ func (r *ItemBroadcastURLDB) DeleteItemBroadcastURLByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Item BroadcastURL deleted successfully!", "success": true})
 }
 
-func getItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, id string) (itemBroadcastURLResponse, error) {
+// RestoreItemBroadcastURLByID restores the link, as long as neither its item
+// nor its broadcast url is deleted.
+func (r *ItemBroadcastURLDB) RestoreItemBroadcastURLByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreItemBroadcastURLByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" || err.Error() == "item or broadcast url deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Item BroadcastURL restored successfully!", "success": true})
+}
+
+func getItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, id string, includeDeleted bool) (itemBroadcastURLResponse, error) {
 	u := itemBroadcastURLResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
 	item_id,
 	broadcast_url_id,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from item_broadcast_url where id = $1`, id).Scan(
+	from item_broadcast_url where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.ItemID,
 		&u.BoradcastURLID,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -213,19 +359,21 @@ func getItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, id string)
 	return u, nil
 }
 
-func getAllItemBroadcastURL(r *ItemBroadcastURLDB, ctx *gin.Context, skip int, limit int) (*[]itemBroadcastURLResponse, error) {
+func getAllItemBroadcastURL(r *ItemBroadcastURLDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]itemBroadcastURLResponse, error) {
 
 	u := []itemBroadcastURLResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
 	id,
 	item_id,
 	broadcast_url_id,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from item_broadcast_url LIMIT %d OFFSET %d`, limit, skip))
+	from item_broadcast_url where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d itemBroadcastURLResponse
-		err := rows.Scan(&d.ID, &d.ItemID, &d.BoradcastURLID, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.ItemID, &d.BoradcastURLID, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -234,19 +382,66 @@ func getAllItemBroadcastURL(r *ItemBroadcastURLDB, ctx *gin.Context, skip int, l
 	return &u, rows.Err()
 }
 
-func updateItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, req itemBroadcastURL, id string) error {
+func selectBroadcastURLForItem(r *ItemBroadcastURLDB, ctx *gin.Context, itemID string, requested []string) (selectedBroadcastURLResponse, error) {
+	rows, err := r.db.Query(ctx, `select 
+	b.id,
+	ib.item_id,
+	b.url,
+	b.platform,
+	b.language 
+	from item_broadcast_url ib 
+	join broadcast_url b on b.id = ib.broadcast_url_id 
+	where ib.item_id = $1 and coalesce(ib.deleted, false) = false and coalesce(b.deleted, false) = false 
+	order by ib.created_at asc`, itemID)
+	if err != nil {
+		return selectedBroadcastURLResponse{}, err
+	}
+	defer rows.Close()
+
+	var urls []selectedBroadcastURLResponse
+	var available []string
+	for rows.Next() {
+		var d selectedBroadcastURLResponse
+		if err := rows.Scan(&d.ID, &d.ItemID, &d.URL, &d.Platform, &d.Language); err != nil {
+			return selectedBroadcastURLResponse{}, err
+		}
+		urls = append(urls, d)
+		available = append(available, *d.Language)
+	}
+	if err := rows.Err(); err != nil {
+		return selectedBroadcastURLResponse{}, err
+	}
+
+	if len(urls) == 0 {
+		return selectedBroadcastURLResponse{}, fmt.Errorf("not found")
+	}
+
+	match, ok := r.lang.Match(available, requested...)
+	if !ok {
+		// None of the requested languages is broadcast, serve the first stream.
+		return urls[0], nil
+	}
+	for _, u := range urls {
+		if *u.Language == match {
+			return u, nil
+		}
+	}
+	return urls[0], nil
+}
+
+func updateItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, req itemBroadcastURL, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareItemBroadcastURLUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE item_broadcast_url SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE item_broadcast_url SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating item broadcast url: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from item_broadcast_url where id = $1)`, id)
 		}
 
 		return nil
@@ -255,23 +450,58 @@ func updateItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx *gin.Context, req ite
 	}
 }
 
-func createNewItemBroadcastURL(r *ItemBroadcastURLDB, ctx *gin.Context, req itemBroadcastURL) error {
-	_, err := r.db.Exec(ctx,
+func createNewItemBroadcastURL(r *ItemBroadcastURLDB, ctx *gin.Context, req itemBroadcastURL) (int, error) {
+	var id int
+	err := audit.QueryRow(ctx, r.db,
 		`INSERT INTO item_broadcast_url (
 			item_id,
 			broadcast_url_id)
 		VALUES (
 			$1,
-			$2)`,
+			$2)
+		RETURNING id`,
 		*req.ItemID,
-		*req.BoradcastURLID)
+		*req.BoradcastURLID).Scan(&id)
+
+	return id, err
+}
 
-	return err
+func deleteItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE item_broadcast_url SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from item_broadcast_url where id = $1 and coalesce(deleted, false) = false)`, id)
+	}
+	return nil
 }
 
-func deleteItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from item_broadcast_url where id=$1", id)
-	return err
+func restoreItemBroadcastURLByID(r *ItemBroadcastURLDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted, parentDeleted bool
+		if err := tx.QueryRow(ctx, `select coalesce(ib.deleted, false), coalesce(i.deleted, false) or coalesce(b.deleted, false) 
+		from item_broadcast_url ib 
+		join item i on i.id = ib.item_id 
+		join broadcast_url b on b.id = ib.broadcast_url_id 
+		where ib.id = $1
+		for update of ib for share of i, b`, id).Scan(&deleted, &parentDeleted); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+		if parentDeleted {
+			return fmt.Errorf("item or broadcast url deleted")
+		}
+
+		_, err := tx.Exec(ctx, `UPDATE item_broadcast_url SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id)
+		return err
+	})
 }
 
 func prepareItemBroadcastURLUpdateQuery(req itemBroadcastURL) (string, []interface{}) {
@@ -0,0 +1,32 @@
+package item
+
+import (
+	"vh-srv-event/schema"
+	"vh-srv-event/translation"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type ItemTranslation interface {
+	GetAllItemTranslation(ctx *gin.Context)
+	UpsertItemTranslation(ctx *gin.Context)
+}
+
+type ItemTranslationDB struct {
+	translations *translation.Translations
+}
+
+func NewItemTranslation(db *pgxpool.Pool, schemas *schema.Registry) ItemTranslation {
+	return &ItemTranslationDB{
+		translation.New(db, schemas, "item"),
+	}
+}
+
+func (r *ItemTranslationDB) GetAllItemTranslation(ctx *gin.Context) {
+	r.translations.GetAll(ctx)
+}
+
+func (r *ItemTranslationDB) UpsertItemTranslation(ctx *gin.Context) {
+	r.translations.Upsert(ctx)
+}
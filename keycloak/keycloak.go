@@ -0,0 +1,141 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client reads group and role memberships from the Keycloak admin REST API,
+// authenticating as a confidential client with the client credentials grant.
+// The client needs the view-users role of the realm-management client.
+type Client struct {
+	baseURL      string
+	realm        string
+	clientID     string
+	clientSecret string
+	http         *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewClient(baseURL string, realm string, clientID string, clientSecret string) *Client {
+	return &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		realm:        realm,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		http:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// UserGroups returns the paths of the groups the user belongs to, such as
+// "/staff/volunteers".
+func (c *Client) UserGroups(ctx context.Context, userID string) ([]string, error) {
+	var groups []struct {
+		Path string `json:"path"`
+	}
+	if err := c.get(ctx, "/users/"+url.PathEscape(userID)+"/groups", &groups); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, g := range groups {
+		out = append(out, g.Path)
+	}
+	return out, nil
+}
+
+// UserRealmRoles returns the names of the realm roles the user has, including
+// the ones granted through composite roles and groups.
+func (c *Client) UserRealmRoles(ctx context.Context, userID string) ([]string, error) {
+	var roles []struct {
+		Name string `json:"name"`
+	}
+	if err := c.get(ctx, "/users/"+url.PathEscape(userID)+"/role-mappings/realm/composite", &roles); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, r := range roles {
+		out = append(out, r.Name)
+	}
+	return out, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/admin/realms/"+url.PathEscape(c.realm)+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("keycloak: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("keycloak: user not found")
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("keycloak: unexpected status %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// accessToken returns a cached service account token, requesting a new one
+// shortly before the cached one expires.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {c.clientID},
+		"client_secret": {c.clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.baseURL+"/realms/"+url.PathEscape(c.realm)+"/protocol/openid-connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("keycloak: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("keycloak: token request failed with status %d", res.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("keycloak: %w", err)
+	}
+
+	c.token = body.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - 30*time.Second)
+	return c.token, nil
+}
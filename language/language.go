@@ -0,0 +1,219 @@
+package language
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Resolver negotiates which of the available languages should be served to a
+// participant, walking the requested languages in order and expanding each one
+// through its configured fallback chain (e.g. pt-BR -> pt -> en).
+type Resolver struct {
+	fallbacks       map[string][]string
+	defaultLanguage string
+}
+
+func NewResolver(fallbacks map[string][]string, defaultLanguage string) *Resolver {
+	normalized := make(map[string][]string, len(fallbacks))
+	for tag, chain := range fallbacks {
+		var n []string
+		for _, c := range chain {
+			n = append(n, Normalize(c))
+		}
+		normalized[Normalize(tag)] = n
+	}
+	return &Resolver{
+		normalized,
+		Normalize(defaultLanguage),
+	}
+}
+
+// ParseFallbacks reads fallback chains written as "pt-BR:pt,en;es-MX:es,en".
+func ParseFallbacks(s string) (map[string][]string, error) {
+	fallbacks := map[string][]string{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid fallback chain %q", entry)
+		}
+		var chain []string
+		for _, c := range strings.Split(parts[1], ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				chain = append(chain, c)
+			}
+		}
+		fallbacks[strings.TrimSpace(parts[0])] = chain
+	}
+	return fallbacks, nil
+}
+
+// Normalize lowercases a language tag and uses "-" as the subtag separator so
+// that "pt_BR", "PT-br" and "pt-BR" compare equal.
+func Normalize(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// Default returns the language used when nothing in the chain is available.
+func (l *Resolver) Default() string {
+	return l.defaultLanguage
+}
+
+// Chain expands the preferred languages, in order, into the full list of
+// candidates to try, ending with the default language. The default language
+// only comes before a preferred language when it is preferred itself, not
+// because a fallback chain lists it: with pt-BR -> pt -> en and en as the
+// default, "pt-BR, de-AT" gives pt-br, pt, de-at, de, en.
+func (l *Resolver) Chain(preferred ...string) []string {
+	return l.expand(preferred, true)
+}
+
+// Expand is Chain without the default language, for callers that have their
+// own last resort (e.g. the original language of a translated text). The
+// default language is still last when a fallback chain lists it.
+func (l *Resolver) Expand(preferred ...string) []string {
+	return l.expand(preferred, false)
+}
+
+func (l *Resolver) expand(preferred []string, withDefault bool) []string {
+	chain := []string{}
+	seen := map[string]bool{}
+	fallbackToDefault := false
+	add := func(tag string) {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			chain = append(chain, tag)
+		}
+	}
+
+	for _, p := range preferred {
+		tag := Normalize(p)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		add(tag)
+		if fallbacks, ok := l.fallbacks[tag]; ok {
+			for _, f := range fallbacks {
+				if f == l.defaultLanguage {
+					fallbackToDefault = true
+					continue
+				}
+				add(f)
+			}
+			continue
+		}
+		// Without an explicit chain fall back to the less specific tags.
+		for i := strings.LastIndex(tag, "-"); i > 0; i = strings.LastIndex(tag, "-") {
+			tag = tag[:i]
+			add(tag)
+		}
+	}
+	if withDefault || fallbackToDefault {
+		add(l.defaultLanguage)
+	}
+
+	return chain
+}
+
+// Match returns the first available language in the chain built from the
+// preferred languages. The returned value is taken from available as is.
+func (l *Resolver) Match(available []string, preferred ...string) (string, bool) {
+	index := make(map[string]string, len(available))
+	for _, a := range available {
+		if _, ok := index[Normalize(a)]; !ok {
+			index[Normalize(a)] = a
+		}
+	}
+
+	for _, candidate := range l.Chain(preferred...) {
+		if a, ok := index[candidate]; ok {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// ParseAcceptLanguage returns the languages of an Accept-Language header
+// ordered by their quality value. Entries with q=0 are dropped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	languages := make([]string, 0, len(tags))
+	for _, t := range tags {
+		languages = append(languages, t.tag)
+	}
+	return languages
+}
+
+// Requested returns the languages asked for by the request: an explicit
+// ?lang= parameter first, then the stored preferences of the participant (if
+// any), then the Accept-Language header.
+func Requested(ctx *gin.Context, preferences ...string) []string {
+	var languages []string
+	if lang := ctx.Query("lang"); lang != "" {
+		languages = append(languages, lang)
+	}
+	languages = append(languages, preferences...)
+	return append(languages, ParseAcceptLanguage(ctx.GetHeader("Accept-Language"))...)
+}
+
+// ParticipantPreferences returns the stored languages of a participant, the
+// first language before the email language. Unknown participants have none.
+func ParticipantPreferences(ctx context.Context, db *pgxpool.Pool, participantID string) ([]string, error) {
+	var firstLanguage, emailLanguage *string
+	if err := db.QueryRow(ctx, `select 
+	first_language,
+	email_language 
+	from participant where id = $1`, participantID).Scan(&firstLanguage, &emailLanguage); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var preferences []string
+	if firstLanguage != nil {
+		preferences = append(preferences, *firstLanguage)
+	}
+	if emailLanguage != nil {
+		preferences = append(preferences, *emailLanguage)
+	}
+	return preferences, nil
+}
@@ -0,0 +1,139 @@
+package language
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestResolver() *Resolver {
+	return NewResolver(map[string][]string{
+		"pt-BR": {"pt", "en"},
+		"es_MX": {"es-419", "es"},
+	}, "EN")
+}
+
+func TestChain(t *testing.T) {
+	l := newTestResolver()
+
+	tests := []struct {
+		name      string
+		preferred []string
+		want      []string
+	}{
+		{"nothing preferred", nil, []string{"en"}},
+		{"configured chain", []string{"pt-BR"}, []string{"pt-br", "pt", "en"}},
+		{"default after later preferences", []string{"pt-BR", "de-AT"}, []string{"pt-br", "pt", "de-at", "de", "en"}},
+		{"default preferred explicitly", []string{"en", "pt-BR"}, []string{"en", "pt-br", "pt"}},
+		{"chain keys are normalized", []string{"es-mx"}, []string{"es-mx", "es-419", "es", "en"}},
+		{"less specific tags", []string{"zh-Hant-TW"}, []string{"zh-hant-tw", "zh-hant", "zh", "en"}},
+		{"duplicates and wildcards", []string{"fr", "*", "FR", "fr_CA"}, []string{"fr", "fr-ca", "en"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Chain(tt.preferred...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Chain(%q) = %q, want %q", tt.preferred, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	l := newTestResolver()
+
+	tests := []struct {
+		preferred []string
+		want      []string
+	}{
+		{nil, []string{}},
+		{[]string{"de-AT"}, []string{"de-at", "de"}},
+		{[]string{"pt-BR", "de"}, []string{"pt-br", "pt", "de", "en"}},
+	}
+
+	for _, tt := range tests {
+		if got := l.Expand(tt.preferred...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Expand(%q) = %q, want %q", tt.preferred, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	l := newTestResolver()
+
+	tests := []struct {
+		available []string
+		preferred []string
+		want      string
+		found     bool
+	}{
+		{[]string{"en", "pt"}, []string{"pt-BR"}, "pt", true},
+		{[]string{"en", "de"}, []string{"pt-BR", "de-AT"}, "de", true},
+		{[]string{"fr", "EN"}, []string{"it"}, "EN", true},
+		{[]string{"pt_BR"}, []string{"pt-br"}, "pt_BR", true},
+		{[]string{"fr"}, []string{"it"}, "", false},
+	}
+
+	for _, tt := range tests {
+		got, found := l.Match(tt.available, tt.preferred...)
+		if got != tt.want || found != tt.found {
+			t.Errorf("Match(%q, %q) = %q, %v, want %q, %v", tt.available, tt.preferred, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-CH", "fr", "en", "de", "*"}},
+		{"en;q=0.5, de", []string{"de", "en"}},
+		{"en;q=0.8, fr;q=0.8, de;q=0.9", []string{"de", "en", "fr"}},
+		{"en;q=0, de", []string{"de"}},
+		{"en;q=abc, de;q=0.5", []string{"en", "de"}},
+		{" , de ;q=0.5,,", []string{"de"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseFallbacks(t *testing.T) {
+	got, err := ParseFallbacks(" pt-BR: pt, en ;es-MX:es,en;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"pt-BR": {"pt", "en"},
+		"es-MX": {"es", "en"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseFallbacks = %q, want %q", got, want)
+	}
+
+	for _, s := range []string{"pt-BR", ":pt", "pt-BR=pt"} {
+		if _, err := ParseFallbacks(s); err == nil {
+			t.Errorf("ParseFallbacks(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestRequested(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("GET", "/?lang=it", nil)
+	ctx.Request.Header.Set("Accept-Language", "de;q=0.5, fr")
+
+	want := []string{"it", "pt", "es", "fr", "de"}
+	if got := Requested(ctx, "pt", "es"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Requested = %q, want %q", got, want)
+	}
+}
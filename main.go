@@ -2,19 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"os"
 	"time"
+	_ "time/tzdata"
 
 	"vh-srv-event/audience"
+	"vh-srv-event/audit"
 	"vh-srv-event/broadcasturl"
+	"vh-srv-event/checkin"
 	"vh-srv-event/event"
+	"vh-srv-event/idempotency"
 	"vh-srv-event/item"
+	"vh-srv-event/keycloak"
+	"vh-srv-event/language"
 	part "vh-srv-event/participant"
 	partoptn "vh-srv-event/partoptn"
 	"vh-srv-event/partstatus"
 	"vh-srv-event/platform"
+	"vh-srv-event/scheduler"
+	"vh-srv-event/schema"
+	"vh-srv-event/search"
+	"vh-srv-event/stats"
+	"vh-srv-event/viewing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -28,11 +40,20 @@ type Controllers struct {
 	Audience            audience.Audience
 	BroadcastURL        broadcasturl.BroadcastURL
 	Item                item.Item
+	ItemTranslation     item.ItemTranslation
 	ItemBroadcastURL    item.ItemBroadcastURL
 	Event               event.Event
+	EventTranslation    event.EventTranslation
+	EventSeries         event.EventSeries
 	EventItem           event.EventItem
 	EventPartOption     event.EventPartOption
 	ParticipationStatus partstatus.ParticipationStatus
+	ContentSchema       schema.ContentSchema
+	CheckIn             checkin.CheckIn
+	Viewing             viewing.Viewing
+	Stats               stats.Stats
+	Search              search.Search
+	Audit               audit.Audit
 }
 
 // cfg is the struct type that contains fields that stores the necessary configuration
@@ -44,6 +65,47 @@ var cfg struct {
 	DBHost   string `envconfig:"DB_HOST" default:"localhost"`
 	DBPort   string `envconfig:"DB_PORT" default:"5432"`
 	APP_PORT string `envconfig:"APP_PORT" default:"8080"`
+
+	DefaultLanguage   string `envconfig:"DEFAULT_LANGUAGE" default:"en"`
+	LanguageFallbacks string `envconfig:"LANGUAGE_FALLBACKS" default:"pt-BR:pt,en;es-MX:es,en"`
+	// TranslationLanguages lists the languages event and item content must be
+	// available in to be reported as translated.
+	TranslationLanguages []string `envconfig:"TRANSLATION_LANGUAGES" default:"en"`
+
+	// PublishInterval is how often scheduled events are published and ended
+	// events archived; ArchiveRetention is how long after ends_on a published
+	// event stays published.
+	PublishInterval  time.Duration `envconfig:"PUBLISH_INTERVAL" default:"1m"`
+	ArchiveRetention time.Duration `envconfig:"ARCHIVE_RETENTION" default:"720h"`
+	// RegistrationInterval is how often registrations are opened and closed
+	// according to their registration windows.
+	RegistrationInterval time.Duration `envconfig:"REGISTRATION_INTERVAL" default:"1m"`
+
+	// The Keycloak admin API is used to evaluate audience rules on group and
+	// role membership. Those rules never match when KeycloakURL is empty.
+	KeycloakURL          string `envconfig:"KEYCLOAK_URL"`
+	KeycloakRealm        string `envconfig:"KEYCLOAK_REALM"`
+	KeycloakClientID     string `envconfig:"KEYCLOAK_CLIENT_ID"`
+	KeycloakClientSecret string `envconfig:"KEYCLOAK_CLIENT_SECRET"`
+
+	// CheckInSecret signs the QR payloads of the check-in tickets. When it is
+	// empty a random secret is used, which invalidates the tickets at every
+	// restart. Check-ins open CheckInEarly before the event or item starts.
+	CheckInSecret string        `envconfig:"CHECKIN_SECRET"`
+	CheckInEarly  time.Duration `envconfig:"CHECKIN_EARLY" default:"2h"`
+
+	// ViewingMaxGap is the most watch time counted between two heartbeats of
+	// a view session.
+	ViewingMaxGap time.Duration `envconfig:"VIEWING_MAX_GAP" default:"2m"`
+
+	// StatsCacheTTL is how long event statistics are cached.
+	StatsCacheTTL time.Duration `envconfig:"STATS_CACHE_TTL" default:"30s"`
+
+	// IdempotencyKeyTTL is how long the response to a POST made with an
+	// Idempotency-Key is replayed to its retries. Expired keys are purged
+	// every IdempotencyPurgeInterval.
+	IdempotencyKeyTTL        time.Duration `envconfig:"IDEMPOTENCY_KEY_TTL" default:"24h"`
+	IdempotencyPurgeInterval time.Duration `envconfig:"IDEMPOTENCY_PURGE_INTERVAL" default:"1h"`
 }
 
 type Router struct {
@@ -54,11 +116,20 @@ type Router struct {
 	audience            audience.Audience
 	broadcastURL        broadcasturl.BroadcastURL
 	item                item.Item
+	itemTranslation     item.ItemTranslation
 	itemBroadcastURL    item.ItemBroadcastURL
 	event               event.Event
+	eventTranslation    event.EventTranslation
+	eventSeries         event.EventSeries
 	eventItem           event.EventItem
 	eventPartOption     event.EventPartOption
 	participationStatus partstatus.ParticipationStatus
+	contentSchema       schema.ContentSchema
+	checkIn             checkin.CheckIn
+	viewing             viewing.Viewing
+	stats               stats.Stats
+	search              search.Search
+	audit               audit.Audit
 }
 
 func NewRouter(server *gin.Engine, controller Controllers) *Router {
@@ -70,11 +141,20 @@ func NewRouter(server *gin.Engine, controller Controllers) *Router {
 		controller.Audience,
 		controller.BroadcastURL,
 		controller.Item,
+		controller.ItemTranslation,
 		controller.ItemBroadcastURL,
 		controller.Event,
+		controller.EventTranslation,
+		controller.EventSeries,
 		controller.EventItem,
 		controller.EventPartOption,
 		controller.ParticipationStatus,
+		controller.ContentSchema,
+		controller.CheckIn,
+		controller.Viewing,
+		controller.Stats,
+		controller.Search,
+		controller.Audit,
 	}
 }
 func (r *Router) Init() {
@@ -86,17 +166,27 @@ func (r *Router) Init() {
 		participant.POST("/", r.participant.CreateNewParticipant)
 		participant.PATCH("/:id", r.participant.UpdateParticipantByID)
 		participant.DELETE("/:id", r.participant.DeleteParticipantByID)
+		participant.POST("/:id/restore", r.participant.RestoreParticipantByID)
 		participant.GET("/:id", r.participant.GetParticipantById)
 		participant.GET("email/:email", r.participant.GetParticipantByEmail)
 		participant.GET("keycloakid/:id", r.participant.GetParticipantByKeycloakID)
+		participant.GET("/:id/duplicates", r.participant.GetParticipantDuplicates)
+		participant.POST("/:id/merge", r.participant.MergeParticipantByID)
+		participant.GET("/:id/merges", r.participant.GetParticipantMerges)
+		participant.GET("/:id/export", r.participant.ExportParticipantByID)
+		participant.POST("/:id/erase", r.participant.EraseParticipantByID)
 	}
 	basePath.GET("/participants", r.participant.GetAllParticipant)
+	basePath.POST("/participants/import", r.participant.ImportParticipants)
+	basePath.GET("/participants/search", r.participant.SearchParticipants)
+	basePath.GET("/participant-duplicates", r.participant.GetAllParticipantDuplicates)
 
 	participationOption := basePath.Group("/participation-option")
 	{
 		participationOption.POST("/", r.participationOption.CreateNewParticipationOption)
 		participationOption.PATCH("/:name", r.participationOption.UpdateParticipationOptionByName)
 		participationOption.DELETE("/:name", r.participationOption.DeleteParticipationOptionByName)
+		participationOption.POST("/:name/restore", r.participationOption.RestoreParticipationOptionByName)
 		participationOption.GET("/:name", r.participationOption.GetParticipationOptionByName)
 	}
 	basePath.GET("/participation-options", r.participationOption.GetAllParticipationOption)
@@ -106,6 +196,7 @@ func (r *Router) Init() {
 		platform.POST("/", r.platform.CreateNewPlatform)
 		platform.PATCH("/:name", r.platform.UpdatePlatformByName)
 		platform.DELETE("/:name", r.platform.DeletePlatformByName)
+		platform.POST("/:name/restore", r.platform.RestorePlatformByName)
 		platform.GET("/:name", r.platform.GetPlatformByName)
 	}
 	basePath.GET("/platforms", r.platform.GetAllPlatform)
@@ -115,7 +206,12 @@ func (r *Router) Init() {
 		audience.POST("/", r.audience.CreateNewAudience)
 		audience.PATCH("/:name", r.audience.UpdateAudienceByName)
 		audience.DELETE("/:name", r.audience.DeleteAudienceByName)
+		audience.POST("/:name/restore", r.audience.RestoreAudienceByName)
 		audience.GET("/:name", r.audience.GetAudienceByName)
+		audience.GET("/:name/rules", r.audience.GetAllAudienceRule)
+		audience.POST("/:name/rules", r.audience.CreateNewAudienceRule)
+		audience.DELETE("/:name/rules/:ruleId", r.audience.DeleteAudienceRuleByID)
+		audience.GET("/:name/check/:participantId", r.audience.CheckAudienceEligibility)
 	}
 	basePath.GET("/audiences", r.audience.GetAllAudience)
 
@@ -124,6 +220,7 @@ func (r *Router) Init() {
 		broadcastURL.POST("/", r.broadcastURL.CreateNewBroadcastURL)
 		broadcastURL.PATCH("/:id", r.broadcastURL.UpdateBroadcastURLByID)
 		broadcastURL.DELETE("/:id", r.broadcastURL.DeleteBroadcastURLByID)
+		broadcastURL.POST("/:id/restore", r.broadcastURL.RestoreBroadcastURLByID)
 		broadcastURL.GET("/:id", r.broadcastURL.GetBroadcastURLByID)
 	}
 	basePath.GET("/broadcasturls", r.broadcastURL.GetAllBroadcastURL)
@@ -134,6 +231,10 @@ func (r *Router) Init() {
 		item.GET("/:id", r.item.GetItemByID)
 		item.PATCH("/:id", r.item.UpdateItemByID)
 		item.DELETE("/:id", r.item.DeleteItemByID)
+		item.POST("/:id/restore", r.item.RestoreItemByID)
+		item.GET("/:id/broadcasturl", r.itemBroadcastURL.GetBroadcastURLForItem)
+		item.GET("/:id/translations", r.itemTranslation.GetAllItemTranslation)
+		item.PUT("/:id/translations/:lang", r.itemTranslation.UpsertItemTranslation)
 	}
 	basePath.GET("/items", r.item.GetAllItem)
 
@@ -143,6 +244,7 @@ func (r *Router) Init() {
 		itemBroadcastUrl.GET("/:id", r.itemBroadcastURL.GetItemBroadcastURLByID)
 		itemBroadcastUrl.PATCH("/:id", r.itemBroadcastURL.UpdateItemBroadcastURLByID)
 		itemBroadcastUrl.DELETE("/:id", r.itemBroadcastURL.DeleteItemBroadcastURLByID)
+		itemBroadcastUrl.POST("/:id/restore", r.itemBroadcastURL.RestoreItemBroadcastURLByID)
 	}
 	basePath.GET("/item-broadcasturls", r.itemBroadcastURL.GetAllItemBroadcastURL)
 
@@ -153,8 +255,41 @@ func (r *Router) Init() {
 		event.PATCH("/:id", r.event.UpdateEventByID)
 		event.DELETE("/:id", r.event.DeleteEventByID)
 		event.DELETE("/hard/:id", r.event.DeleteHardEventByID)
+		event.POST("/:id/restore", r.event.RestoreEventByID)
+		event.POST("/:id/clone", r.event.CloneEventByID)
+		event.GET("/:id/agenda", r.event.GetEventAgendaByID)
+		event.GET("/:id/attendees/export", r.participationStatus.ExportEventAttendees)
+		event.POST("/:id/check-in", r.checkIn.CheckInToEvent)
+		event.GET("/:id/check-ins", r.checkIn.GetAllCheckIn)
+		event.GET("/:id/attendance", r.checkIn.GetEventAttendance)
+		event.GET("/:id/stats", r.stats.GetEventStats)
+		event.POST("/:id/publish", r.event.PublishEventByID)
+		event.POST("/:id/unpublish", r.event.UnpublishEventByID)
+		event.POST("/:id/archive", r.event.ArchiveEventByID)
+		event.POST("/:id/preview-token", r.event.CreateEventPreviewToken)
+		event.GET("/:id/translations", r.eventTranslation.GetAllEventTranslation)
+		event.PUT("/:id/translations/:lang", r.eventTranslation.UpsertEventTranslation)
 	}
 	basePath.GET("/events", r.event.GetAllEvent)
+	basePath.GET("/preview/:token", r.event.GetEventByPreviewToken)
+
+	public := basePath.Group("/public")
+	{
+		public.GET("/event/:slug", r.event.GetPublicEventBySlug)
+		public.GET("/events", r.event.GetAllPublicEvent)
+	}
+
+	eventSeries := basePath.Group("/event-series")
+	{
+		eventSeries.POST("/", r.eventSeries.CreateNewEventSeries)
+		eventSeries.GET("/:id", r.eventSeries.GetEventSeriesByID)
+		eventSeries.DELETE("/:id", r.eventSeries.DeleteEventSeriesByID)
+		eventSeries.POST("/:id/restore", r.eventSeries.RestoreEventSeriesByID)
+		eventSeries.POST("/:id/materialize", r.eventSeries.MaterializeEventSeries)
+		eventSeries.PATCH("/:id/occurrences/:eventId", r.eventSeries.UpdateEventSeriesOccurrence)
+		eventSeries.POST("/:id/exceptions", r.eventSeries.CreateEventSeriesException)
+	}
+	basePath.GET("/event-series", r.eventSeries.GetAllEventSeries)
 
 	eventItem := basePath.Group("/event-item")
 	{
@@ -162,6 +297,7 @@ func (r *Router) Init() {
 		eventItem.GET("/:id", r.eventItem.GetEventItemByID)
 		eventItem.PATCH("/:id", r.eventItem.UpdateEventItemByID)
 		eventItem.DELETE("/:id", r.eventItem.DeleteEventItemByID)
+		eventItem.POST("/:id/restore", r.eventItem.RestoreEventItemByID)
 	}
 	basePath.GET("/event-items", r.eventItem.GetAllEventItem)
 
@@ -171,6 +307,7 @@ func (r *Router) Init() {
 		eventPartOption.GET("/:id", r.eventPartOption.GetEventPartOptionByID)
 		eventPartOption.PATCH("/:id", r.eventPartOption.UpdateEventPartOptionByID)
 		eventPartOption.DELETE("/:id", r.eventPartOption.DeleteEventPartOptionByID)
+		eventPartOption.POST("/:id/restore", r.eventPartOption.RestoreEventPartOptionByID)
 	}
 	basePath.GET("/event-part-options", r.eventPartOption.GetAllEventPartOption)
 
@@ -180,12 +317,36 @@ func (r *Router) Init() {
 		participationStatus.GET("/:id", r.participationStatus.GetParticipationStatusByID)
 		participationStatus.PATCH("/:id", r.participationStatus.UpdateParticipationStatusByID)
 		participationStatus.DELETE("/:id", r.participationStatus.DeleteParticipationStatusByID)
+		participationStatus.POST("/:id/restore", r.participationStatus.RestoreParticipationStatusByID)
+		participationStatus.GET("/:id/ticket", r.checkIn.GetTicketByParticipationStatusID)
 	}
 	basePath.GET("/participation-statuses", r.participationStatus.GetAllParticipationStatus)
+
+	contentSchema := basePath.Group("/content-schema")
+	{
+		contentSchema.POST("/", r.contentSchema.CreateNewContentSchema)
+		contentSchema.GET("/:name", r.contentSchema.GetContentSchemaByName)
+		contentSchema.PATCH("/:name", r.contentSchema.UpdateContentSchemaByName)
+		contentSchema.DELETE("/:name", r.contentSchema.DeleteContentSchemaByName)
+	}
+	basePath.GET("/content-schemas", r.contentSchema.GetAllContentSchema)
+
+	viewSession := basePath.Group("/view-session")
+	{
+		viewSession.POST("/", r.viewing.CreateNewViewSession)
+		viewSession.POST("/:id/heartbeat", r.viewing.HeartbeatViewSessionByID)
+		viewSession.POST("/:id/end", r.viewing.EndViewSessionByID)
+	}
+	basePath.GET("/viewing-report", r.viewing.GetViewingReport)
+
+	basePath.GET("/search", r.search.SearchAll)
+
+	basePath.GET("/audit", r.audit.GetAllAudit)
 }
 
 func main() {
 	route := gin.Default()
+	route.Use(audit.Middleware())
 
 	if err := envconfig.Process("LIST", &cfg); err != nil {
 		log.Fatalln("Error while fetching env file")
@@ -197,7 +358,12 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	conn, err := pgxpool.Connect(ctx, databaseURL)
+	poolConfig, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		log.Fatalln("Invalid database configuration:", err)
+	}
+
+	conn, err := pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Connection url: %s", databaseURL)
@@ -205,17 +371,57 @@ func main() {
 	}
 	defer conn.Close()
 
+	fallbacks, err := language.ParseFallbacks(cfg.LanguageFallbacks)
+	if err != nil {
+		log.Fatalln("Invalid LANGUAGE_FALLBACKS:", err)
+	}
+	lang := language.NewResolver(fallbacks, cfg.DefaultLanguage)
+
+	var translationLanguages []string
+	for _, l := range cfg.TranslationLanguages {
+		translationLanguages = append(translationLanguages, language.Normalize(l))
+	}
+
 	participant := part.NewParticipant(conn)
 	participationOption := partoptn.NewParticipationOption(conn)
 	platform := platform.NewPlatform(conn)
-	audience := audience.NewAudience(conn)
+	var membership audience.Membership
+	if cfg.KeycloakURL != "" {
+		membership = keycloak.NewClient(cfg.KeycloakURL, cfg.KeycloakRealm, cfg.KeycloakClientID, cfg.KeycloakClientSecret)
+	}
+	audiences := audience.NewEvaluator(conn, membership)
+	audience := audience.NewAudience(conn, audiences)
 	broadcasturl := broadcasturl.NewBroadcastURL(conn)
-	itemBroadcastURL := item.NewItemBroadcastURL(conn)
-	item := item.NewItem(conn)
+	itemBroadcastURL := item.NewItemBroadcastURL(conn, lang)
+	schemas := schema.NewRegistry(conn)
+	contentSchema := schema.NewContentSchema(conn)
+	itemTranslation := item.NewItemTranslation(conn, schemas)
+	item := item.NewItem(conn, lang, translationLanguages, schemas)
 	eventPartOption := event.NewEventPartOption(conn)
 	eventItem := event.NewEventItem(conn)
-	event := event.NewEvent(conn)
-	participationStatus := partstatus.NewParticipationStatus(conn)
+	eventTranslation := event.NewEventTranslation(conn, schemas)
+	eventSeries := event.NewEventSeries(conn, lang, translationLanguages, schemas, audiences)
+	publisher := event.NewPublisher(conn, cfg.ArchiveRetention)
+	registrationScheduler := event.NewRegistrationScheduler(conn)
+	event := event.NewEvent(conn, lang, translationLanguages, schemas, audiences)
+	participationStatus := partstatus.NewParticipationStatus(conn, audiences)
+
+	checkInSecret := []byte(cfg.CheckInSecret)
+	if len(checkInSecret) == 0 {
+		log.Println("CHECKIN_SECRET is not set, check-in tickets will not survive a restart")
+		checkInSecret = make([]byte, 32)
+		if _, err := rand.Read(checkInSecret); err != nil {
+			log.Fatalln("Unable to generate a check-in secret:", err)
+		}
+	}
+	checkIn := checkin.NewCheckIn(conn, checkInSecret, cfg.CheckInEarly)
+	viewing := viewing.NewViewing(conn, cfg.ViewingMaxGap)
+	stats := stats.NewStats(conn, cfg.StatsCacheTTL)
+	search := search.NewSearch(conn)
+	auditLog := audit.NewAudit(conn)
+
+	idempotencyKeys := idempotency.NewKeys(conn, cfg.IdempotencyKeyTTL)
+	route.Use(idempotencyKeys.Middleware())
 
 	r := NewRouter(route, Controllers{
 		Participant:         participant,
@@ -224,14 +430,29 @@ func main() {
 		Audience:            audience,
 		BroadcastURL:        broadcasturl,
 		Item:                item,
+		ItemTranslation:     itemTranslation,
 		ItemBroadcastURL:    itemBroadcastURL,
 		Event:               event,
+		EventTranslation:    eventTranslation,
+		EventSeries:         eventSeries,
 		EventItem:           eventItem,
 		EventPartOption:     eventPartOption,
 		ParticipationStatus: participationStatus,
+		ContentSchema:       contentSchema,
+		CheckIn:             checkIn,
+		Viewing:             viewing,
+		Stats:               stats,
+		Search:              search,
+		Audit:               auditLog,
 	})
 
 	r.Init()
 
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go scheduler.Every(jobs, "publisher", cfg.PublishInterval, publisher)
+	go scheduler.Every(jobs, "registration", cfg.RegistrationInterval, registrationScheduler)
+	go scheduler.Every(jobs, "idempotency", cfg.IdempotencyPurgeInterval, idempotencyKeys)
+
 	route.Run("localhost:" + cfg.APP_PORT)
 }
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -25,6 +31,9 @@ type partResponse struct {
 	Country       *string    `json:"country,omitempty" db:"country"`
 	FirstName     *string    `json:"first_name" db:"first_name"`
 	LastName      *string    `json:"last_name" db:"last_name"`
+	ErasedAt      *time.Time `json:"erased_at,omitempty" db:"erased_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy     *string    `json:"deleted_by,omitempty" db:"deleted_by"`
 	CreatedAt     *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt     *time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -49,6 +58,15 @@ type Participant interface {
 	CreateNewParticipant(ctx *gin.Context)
 	UpdateParticipantByID(ctx *gin.Context)
 	DeleteParticipantByID(ctx *gin.Context)
+	RestoreParticipantByID(ctx *gin.Context)
+	GetParticipantDuplicates(ctx *gin.Context)
+	GetAllParticipantDuplicates(ctx *gin.Context)
+	MergeParticipantByID(ctx *gin.Context)
+	GetParticipantMerges(ctx *gin.Context)
+	ExportParticipantByID(ctx *gin.Context)
+	EraseParticipantByID(ctx *gin.Context)
+	ImportParticipants(ctx *gin.Context)
+	SearchParticipants(ctx *gin.Context)
 }
 
 type ParticipantDB struct {
@@ -61,10 +79,13 @@ func NewParticipant(db *pgxpool.Pool) Participant {
 	}
 }
 
+// GetParticipantById returns the participant, or 404 when it is deleted
+// unless ?include_deleted=true. The same goes for the lookups by email and
+// Keycloak id.
 func (r *ParticipantDB) GetParticipantById(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getPartById(r, ctx, id)
+	u, err := getPartById(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -80,13 +101,16 @@ func (r *ParticipantDB) GetParticipantById(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
 func (r *ParticipantDB) GetParticipantByKeycloakID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getPartByKeycloakID(r, ctx, id)
+	u, err := getPartByKeycloakID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -102,13 +126,16 @@ func (r *ParticipantDB) GetParticipantByKeycloakID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
 func (r *ParticipantDB) GetParticipantByEmail(ctx *gin.Context) {
 	email := ctx.Param("keycloak-id")
 
-	u, err := getPartByEmail(r, ctx, email)
+	u, err := getPartByEmail(r, ctx, email, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -124,9 +151,14 @@ func (r *ParticipantDB) GetParticipantByEmail(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllParticipant lists the participants, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *ParticipantDB) GetAllParticipant(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -153,7 +185,7 @@ func (r *ParticipantDB) GetAllParticipant(ctx *gin.Context) {
 		return
 	}
 
-	u, err := GetAllPart(r, ctx, intSkip, intLimit)
+	u, err := GetAllPart(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -185,7 +217,8 @@ func (r *ParticipantDB) CreateNewParticipant(ctx *gin.Context) {
 		return
 	}
 
-	if err := CreateNewPart(r, ctx, s); err != nil {
+	id, err := CreateNewPart(r, ctx, s)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -193,7 +226,18 @@ func (r *ParticipantDB) CreateNewParticipant(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new participant!", "data": s, "success": true})
+	u, err := getPartById(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new participant!", "data": u, "success": true})
 }
 
 func (r *ParticipantDB) UpdateParticipantByID(ctx *gin.Context) {
@@ -208,7 +252,7 @@ func (r *ParticipantDB) UpdateParticipantByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := UpdatePartByID(r, ctx, u, id); err != nil {
+	if err := UpdatePartByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -218,6 +262,14 @@ func (r *ParticipantDB) UpdateParticipantByID(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -232,14 +284,41 @@ func (r *ParticipantDB) UpdateParticipantByID(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Participant updated successfully", "data": u, "success": true})
+
+	updated, err := getPartById(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participant updated successfully", "data": updated, "success": true})
 }
 
+// DeleteParticipantByID soft deletes the participant along with its
+// registrations. Personal data is kept until the participant is erased.
 func (r *ParticipantDB) DeleteParticipantByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := DeletePartByID(r, ctx, id); err != nil {
+	if err := DeletePartByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -250,7 +329,38 @@ func (r *ParticipantDB) DeleteParticipantByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Participant deleted successfully!", "success": true})
 }
 
-func getPartById(r *ParticipantDB, ctx *gin.Context, id string) (partResponse, error) {
+// RestoreParticipantByID restores the participant along with the
+// registrations deleted with it.
+func (r *ParticipantDB) RestoreParticipantByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := RestorePartByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participant restored successfully!", "success": true})
+}
+
+func getPartById(r *ParticipantDB, ctx *gin.Context, id string, includeDeleted bool) (partResponse, error) {
 	u := partResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
@@ -263,9 +373,12 @@ func getPartById(r *ParticipantDB, ctx *gin.Context, id string) (partResponse, e
 	country,
 	first_name,
 	last_name,
+	erased_at,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from participant where id = $1`, id).Scan(
+	from participant where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.KeycloakID,
 		&u.FirstLanguage,
@@ -276,6 +389,9 @@ func getPartById(r *ParticipantDB, ctx *gin.Context, id string) (partResponse, e
 		&u.Country,
 		&u.FirstName,
 		&u.LastName,
+		&u.ErasedAt,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -287,7 +403,7 @@ func getPartById(r *ParticipantDB, ctx *gin.Context, id string) (partResponse, e
 	return u, nil
 }
 
-func getPartByEmail(r *ParticipantDB, ctx *gin.Context, email string) (partResponse, error) {
+func getPartByEmail(r *ParticipantDB, ctx *gin.Context, email string, includeDeleted bool) (partResponse, error) {
 	u := partResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
@@ -300,9 +416,12 @@ func getPartByEmail(r *ParticipantDB, ctx *gin.Context, email string) (partRespo
 	country,
 	first_name,
 	last_name,
+	erased_at,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from participant where email = $1`, email).Scan(
+	from participant where email = $1 and ($2 or coalesce(deleted, false) = false)`, email, includeDeleted).Scan(
 		&u.ID,
 		&u.KeycloakID,
 		&u.FirstLanguage,
@@ -313,6 +432,9 @@ func getPartByEmail(r *ParticipantDB, ctx *gin.Context, email string) (partRespo
 		&u.Country,
 		&u.FirstName,
 		&u.LastName,
+		&u.ErasedAt,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -324,7 +446,7 @@ func getPartByEmail(r *ParticipantDB, ctx *gin.Context, email string) (partRespo
 	return u, nil
 }
 
-func getPartByKeycloakID(r *ParticipantDB, ctx *gin.Context, id string) (partResponse, error) {
+func getPartByKeycloakID(r *ParticipantDB, ctx *gin.Context, id string, includeDeleted bool) (partResponse, error) {
 	u := partResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
@@ -337,9 +459,12 @@ func getPartByKeycloakID(r *ParticipantDB, ctx *gin.Context, id string) (partRes
 	country,
 	first_name,
 	last_name,
+	erased_at,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from participant where keycloak_id = $1`, id).Scan(
+	from participant where keycloak_id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.KeycloakID,
 		&u.FirstLanguage,
@@ -350,6 +475,9 @@ func getPartByKeycloakID(r *ParticipantDB, ctx *gin.Context, id string) (partRes
 		&u.Country,
 		&u.FirstName,
 		&u.LastName,
+		&u.ErasedAt,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -361,7 +489,7 @@ func getPartByKeycloakID(r *ParticipantDB, ctx *gin.Context, id string) (partRes
 	return u, nil
 }
 
-func GetAllPart(r *ParticipantDB, ctx *gin.Context, skip int, limit int) (*[]partResponse, error) {
+func GetAllPart(r *ParticipantDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]partResponse, error) {
 
 	u := []partResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
@@ -375,12 +503,15 @@ func GetAllPart(r *ParticipantDB, ctx *gin.Context, skip int, limit int) (*[]par
 	country,
 	first_name,
 	last_name,
+	erased_at,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from participant LIMIT %d OFFSET %d`, limit, skip))
+	from participant where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d partResponse
-		err := rows.Scan(&d.ID, &d.KeycloakID, &d.FirstLanguage, &d.EmailLanguage, &d.DOB, &d.Gender, &d.Email, &d.Country, &d.FirstName, &d.LastName, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.KeycloakID, &d.FirstLanguage, &d.EmailLanguage, &d.DOB, &d.Gender, &d.Email, &d.Country, &d.FirstName, &d.LastName, &d.ErasedAt, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -389,18 +520,18 @@ func GetAllPart(r *ParticipantDB, ctx *gin.Context, skip int, limit int) (*[]par
 	return &u, rows.Err()
 }
 
-func UpdatePartByID(r *ParticipantDB, ctx *gin.Context, req part, id string) error {
+func UpdatePartByID(r *ParticipantDB, ctx *gin.Context, req part, id string, ifMatch []time.Time) error {
 	toUpdate, toUpdateArgs := prepareParticipantUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE participant SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE participant SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating participant: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from participant where id = $1)`, id)
 		}
 
 		return nil
@@ -409,26 +540,71 @@ func UpdatePartByID(r *ParticipantDB, ctx *gin.Context, req part, id string) err
 	}
 }
 
-func CreateNewPart(r *ParticipantDB, ctx *gin.Context, req part) error {
+func CreateNewPart(r *ParticipantDB, ctx *gin.Context, req part) (int, error) {
 
 	createString, numString, createQueryArgs := prepareParticipantCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO participant (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating participant: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO participant (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating participant: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func DeletePartByID(r *ParticipantDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from participant where id=$1", id)
-	return err
+// DeletePartByID marks the participant and its registrations deleted in one
+// transaction, so that they share the deletion time RestorePartByID goes by.
+func DeletePartByID(r *ParticipantDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		res, err := tx.Exec(ctx, `UPDATE participant SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return etag.Missed(ctx, tx, ifMatch, `select exists(select 1 from participant where id = $1 and coalesce(deleted, false) = false)`, id)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE participation_status SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+		WHERE participant_id = $1 AND coalesce(deleted, false) = false`, id, by); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// RestorePartByID restores the participant and the registrations deleted
+// along with it, except those to an event deleted since. Registrations
+// cancelled before stay deleted.
+func RestorePartByID(r *ParticipantDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted bool
+		var deletedAt *time.Time
+		if err := tx.QueryRow(ctx, `select coalesce(deleted, false), deleted_at from participant where id = $1 for update`, id).Scan(&deleted, &deletedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE participation_status ps SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() 
+		WHERE ps.participant_id = $1 AND coalesce(ps.deleted, false) = true AND ps.deleted_at IS NOT DISTINCT FROM $2 
+		AND NOT EXISTS (select 1 from event e where e.id = ps.event_id and coalesce(e.deleted, false) = true)`, id, deletedAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE participant SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 func prepareParticipantUpdateQuery(req part) (string, []interface{}) {
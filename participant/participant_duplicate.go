@@ -0,0 +1,398 @@
+package participant
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultDuplicateScore is the score from which two participants are
+// reported as likely duplicates.
+const defaultDuplicateScore = 0.6
+
+type duplicateResponse struct {
+	ParticipantID *int                `json:"participant_id"`
+	DuplicateID   *int                `json:"duplicate_id"`
+	Score         float64             `json:"score"`
+	Reasons       []string            `json:"reasons"`
+	Participant   *duplicateCandidate `json:"participant,omitempty"`
+	Duplicate     *duplicateCandidate `json:"duplicate"`
+}
+
+type duplicateCandidate struct {
+	ID        *int       `json:"id" db:"id"`
+	Email     *string    `json:"email" db:"email"`
+	FirstName *string    `json:"first_name" db:"first_name"`
+	LastName  *string    `json:"last_name" db:"last_name"`
+	DOB       *time.Time `json:"dob,omitempty" db:"dob"`
+	Country   *string    `json:"country,omitempty" db:"country"`
+}
+
+// GetParticipantDuplicates lists the participants that are likely the same
+// person as the given one, best match first.
+func (r *ParticipantDB) GetParticipantDuplicates(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	minScore, ok := minScoreFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	u, err := findDuplicates(r, ctx, &id, minScore)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// GetAllParticipantDuplicates lists likely duplicate pairs among all
+// participants, best match first. The pairs are scored in memory on every
+// request, after loading every participant, and skip and limit page through
+// them; the endpoint is meant for occasional admin use.
+func (r *ParticipantDB) GetAllParticipantDuplicates(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil || intSkip < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is a non-negative INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil || intLimit < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is a non-negative INTEGER", "success": false})
+		return
+	}
+
+	minScore, ok := minScoreFromQuery(ctx)
+	if !ok {
+		return
+	}
+
+	u, err := findDuplicates(r, ctx, nil, minScore)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if intSkip > len(u) {
+		intSkip = len(u)
+	}
+	u = u[intSkip:]
+	if intLimit < len(u) {
+		u = u[:intLimit]
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func minScoreFromQuery(ctx *gin.Context) (float64, bool) {
+	minScore := defaultDuplicateScore
+	if s := ctx.Query("min_score"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || f > 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_score value! Accepted value is a number between 0 and 1", "success": false})
+			return 0, false
+		}
+		minScore = f
+	}
+	return minScore, true
+}
+
+// findDuplicates compares participants pairwise, or only against the
+// participant id when it is given, and returns the pairs scoring at least
+// minScore.
+func findDuplicates(r *ParticipantDB, ctx context.Context, id *int, minScore float64) ([]duplicateResponse, error) {
+	rows, err := r.db.Query(ctx, `select id, email, first_name, last_name, dob, country from participant where erased_at is null and coalesce(deleted, false) = false order by id asc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []duplicateCandidate
+	for rows.Next() {
+		var d duplicateCandidate
+		if err := rows.Scan(&d.ID, &d.Email, &d.FirstName, &d.LastName, &d.DOB, &d.Country); err != nil {
+			return nil, err
+		}
+		all = append(all, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	u := []duplicateResponse{}
+	if id != nil {
+		var target *duplicateCandidate
+		for i := range all {
+			if *all[i].ID == *id {
+				target = &all[i]
+			}
+		}
+		if target == nil {
+			return nil, fmt.Errorf("not found")
+		}
+		for i := range all {
+			if *all[i].ID == *id {
+				continue
+			}
+			if score, reasons := compareParticipants(*target, all[i]); score >= minScore {
+				u = append(u, duplicateResponse{target.ID, all[i].ID, score, reasons, nil, &all[i]})
+			}
+		}
+	} else {
+		// Only participants sharing a blocking key are compared, which keeps
+		// the scan far below comparing every pair.
+		blocks := map[string][]int{}
+		for i := range all {
+			for _, key := range blockingKeys(all[i]) {
+				blocks[key] = append(blocks[key], i)
+			}
+		}
+		seen := map[[2]int]bool{}
+		for _, block := range blocks {
+			for x := range block {
+				for y := x + 1; y < len(block); y++ {
+					i, j := block[x], block[y]
+					if seen[[2]int{i, j}] {
+						continue
+					}
+					seen[[2]int{i, j}] = true
+					if score, reasons := compareParticipants(all[i], all[j]); score >= minScore {
+						u = append(u, duplicateResponse{all[i].ID, all[j].ID, score, reasons, &all[i], &all[j]})
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(u, func(i, j int) bool {
+		if u[i].Score != u[j].Score {
+			return u[i].Score > u[j].Score
+		}
+		if *u[i].ParticipantID != *u[j].ParticipantID {
+			return *u[i].ParticipantID < *u[j].ParticipantID
+		}
+		return *u[i].DuplicateID < *u[j].DuplicateID
+	})
+	return u, nil
+}
+
+// blockingKeys returns the keys under which a participant is grouped for the
+// global scan: its normalized email, its date of birth and the first letters
+// of each of its names.
+func blockingKeys(p duplicateCandidate) []string {
+	var keys []string
+	if p.Email != nil {
+		keys = append(keys, "email:"+NormalizeEmail(*p.Email))
+	}
+	if p.DOB != nil {
+		keys = append(keys, "dob:"+p.DOB.UTC().Format("2006-01-02"))
+	}
+	for _, name := range []*string{p.FirstName, p.LastName} {
+		if n := []rune(strings.ReplaceAll(normalizeName(deref(name)), " ", "")); len(n) >= 3 {
+			keys = append(keys, "name:"+string(n[:3]))
+		}
+	}
+	return keys
+}
+
+// compareParticipants scores how likely a and b are the same person, from 0
+// to 1, and explains the score. A shared normalized email alone is enough to
+// reach the default threshold; otherwise the names have to be close and the
+// date of birth has to agree.
+func compareParticipants(a duplicateCandidate, b duplicateCandidate) (float64, []string) {
+	var score float64
+	var reasons []string
+
+	if a.Email != nil && b.Email != nil && NormalizeEmail(*a.Email) == NormalizeEmail(*b.Email) {
+		score += 0.6
+		reasons = append(reasons, "same normalized email")
+	}
+
+	nameA := normalizeName(deref(a.FirstName) + " " + deref(a.LastName))
+	nameB := normalizeName(deref(b.FirstName) + " " + deref(b.LastName))
+	// Also try the names swapped, for first and last name entered the other
+	// way around.
+	swappedB := normalizeName(deref(b.LastName) + " " + deref(b.FirstName))
+	similarity := jaroWinkler(nameA, nameB)
+	if s := jaroWinkler(nameA, swappedB); s > similarity {
+		similarity = s
+	}
+	if similarity >= 0.85 {
+		score += 0.4 * similarity
+		reasons = append(reasons, "similar names ("+strconv.FormatFloat(similarity, 'f', 2, 64)+")")
+	}
+
+	if a.DOB != nil && b.DOB != nil && a.DOB.UTC().Format("2006-01-02") == b.DOB.UTC().Format("2006-01-02") {
+		score += 0.25
+		reasons = append(reasons, "same date of birth")
+	}
+
+	if a.Country != nil && b.Country != nil && strings.EqualFold(*a.Country, *b.Country) {
+		score += 0.1
+		reasons = append(reasons, "same country")
+	}
+
+	// A country match on its own says nothing.
+	if len(reasons) == 1 && reasons[0] == "same country" {
+		return 0, nil
+	}
+	if score > 1 {
+		score = 1
+	}
+	return score, reasons
+}
+
+// NormalizeEmail lowercases an email and strips what mail providers ignore:
+// the "+tag" of the local part everywhere, and dots in Gmail addresses, whose
+// googlemail.com domain is folded into gmail.com.
+func NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n", "ý", "y", "ÿ", "y", "ß", "ss",
+	"-", " ", "'", "", ".", "",
+)
+
+// normalizeName lowercases a name, folds common accents and collapses
+// whitespace.
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(accentReplacer.Replace(strings.ToLower(name))), " ")
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of a and b, from 0 to 1.
+func jaroWinkler(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	window := max(len(ra), len(rb))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i := range ra {
+		lo, hi := max(0, i-window), min(len(rb), i+window+1)
+		for j := lo; j < hi; j++ {
+			if !matchedB[j] && ra[i] == rb[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, min(len(ra), len(rb))) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
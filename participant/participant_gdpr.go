@@ -0,0 +1,245 @@
+package participant
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+type participantExport struct {
+	ExportedAt    time.Time                  `json:"exported_at"`
+	Participant   partResponse               `json:"participant"`
+	Registrations []registrationExport       `json:"registrations"`
+	Merges        []participantMergeResponse `json:"merges"`
+	ViewSessions  []viewSessionExport        `json:"view_sessions"`
+}
+
+type viewSessionExport struct {
+	ID             *int64     `json:"id" db:"id"`
+	ItemID         *int       `json:"item_id" db:"item_id"`
+	BroadcastURLID *int       `json:"broadcast_url_id" db:"broadcast_url_id"`
+	Language       *string    `json:"language" db:"language"`
+	StartedAt      *time.Time `json:"started_at" db:"started_at"`
+	EndedAt        *time.Time `json:"ended_at,omitempty" db:"ended_at"`
+	WatchedSeconds *int       `json:"watched_seconds" db:"watched_seconds"`
+}
+
+type registrationExport struct {
+	ID                  *int       `json:"id" db:"id"`
+	EventID             *int       `json:"event_id" db:"event_id"`
+	EventSlug           *string    `json:"event_slug" db:"event_slug"`
+	EventName           *string    `json:"event_name" db:"event_name"`
+	ParticipationOption *string    `json:"participation_option" db:"participation_option"`
+	Confirmed           *bool      `json:"confirmed" db:"confirmed"`
+	RegistrationDate    *time.Time `json:"registration_date" db:"registration_date"`
+	Deleted             *bool      `json:"deleted" db:"deleted"`
+	CreatedAt           *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt           *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ExportParticipantByID returns all the personal data held about the
+// participant: its profile, its registrations, deleted ones included, the
+// merges of duplicates into it and its view sessions.
+func (r *ParticipantDB) ExportParticipantByID(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	u, err := exportParticipant(r, ctx, id)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="participant-%s.json"`, id))
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+// EraseParticipantByID anonymizes the participant in place. Its email, names,
+// date of birth and keycloak id are overwritten, while the row and its
+// registrations are kept so that event statistics do not change.
+func (r *ParticipantDB) EraseParticipantByID(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	if err := eraseParticipant(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "participant already erased" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getPartById(r, ctx, strconv.Itoa(id), true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participant erased!", "data": u, "success": true})
+}
+
+func exportParticipant(r *ParticipantDB, ctx *gin.Context, id string) (participantExport, error) {
+	p, err := getPartById(r, ctx, id, true)
+	if err != nil {
+		return participantExport{}, err
+	}
+
+	registrations, err := getParticipantRegistrations(r, ctx, id)
+	if err != nil {
+		return participantExport{}, err
+	}
+
+	merges, err := getParticipantMerges(r, ctx, id)
+	if err != nil {
+		return participantExport{}, err
+	}
+
+	viewSessions, err := getParticipantViewSessions(r, ctx, id)
+	if err != nil {
+		return participantExport{}, err
+	}
+
+	return participantExport{time.Now().UTC(), p, registrations, merges, viewSessions}, nil
+}
+
+func getParticipantViewSessions(r *ParticipantDB, ctx context.Context, id string) ([]viewSessionExport, error) {
+	u := []viewSessionExport{}
+	rows, err := r.db.Query(ctx, `select
+	id,
+	item_id,
+	broadcast_url_id,
+	language,
+	started_at,
+	ended_at,
+	watched_seconds
+	from view_session where participant_id = $1 order by started_at asc, id asc`, id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d viewSessionExport
+		err := rows.Scan(&d.ID, &d.ItemID, &d.BroadcastURLID, &d.Language, &d.StartedAt, &d.EndedAt, &d.WatchedSeconds)
+		if err != nil {
+			return u, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
+
+func getParticipantRegistrations(r *ParticipantDB, ctx context.Context, id string) ([]registrationExport, error) {
+	u := []registrationExport{}
+	rows, err := r.db.Query(ctx, `select
+	ps.id,
+	ps.event_id,
+	e.slug,
+	e.name,
+	ps.participation_option,
+	ps.confirmed,
+	ps.registration_date,
+	ps.deleted,
+	ps.created_at,
+	ps.updated_at
+	from participation_status ps
+	join event e on e.id = ps.event_id
+	where ps.participant_id = $1 order by ps.registration_date asc, ps.id asc`, id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d registrationExport
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventSlug, &d.EventName, &d.ParticipationOption, &d.Confirmed, &d.RegistrationDate, &d.Deleted, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return u, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
+
+// eraseParticipant overwrites the personal data of the participant. The
+// unique email and keycloak_id get placeholders derived from the id. Gender,
+// country and languages are kept for aggregate statistics. The snapshots of
+// duplicates merged into the participant hold the same person's data and are
+// cleared too, as are the personal fields of their audit log entries.
+func eraseParticipant(r *ParticipantDB, ctx context.Context, id int) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var erasedAt *time.Time
+		if err := tx.QueryRow(ctx, `select erased_at from participant where id = $1 for update`, id).Scan(&erasedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if erasedAt != nil {
+			return fmt.Errorf("participant already erased")
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE participant SET
+		email = $2,
+		keycloak_id = $3,
+		first_name = 'Erased',
+		last_name = 'Erased',
+		dob = null,
+		erased_at = now(),
+		updated_at = now()
+		WHERE id = $1`, id, fmt.Sprintf("erased-%d@erased.invalid", id), fmt.Sprintf("erased-%d", id)); err != nil {
+			return fmt.Errorf("problem erasing participant: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE participant_merge SET merged_snapshot = json_build_object('id', merged_id, 'erased', true)
+		WHERE survivor_id = $1`, id); err != nil {
+			return fmt.Errorf("problem erasing participant merges: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE audit_log SET
+		before = before - 'email' - 'keycloak_id' - 'first_name' - 'last_name' - 'dob',
+		after = after - 'email' - 'keycloak_id' - 'first_name' - 'last_name' - 'dob'
+		WHERE entity = 'participant' AND entity_id IN (
+			select $1::text union select merged_id::text from participant_merge where survivor_id = $2
+		)`, strconv.Itoa(id), id); err != nil {
+			return fmt.Errorf("problem erasing participant audit log: %w", err)
+		}
+		return nil
+	})
+}
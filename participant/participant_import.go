@@ -0,0 +1,475 @@
+package participant
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"vh-srv-event/audit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+)
+
+// maxImportRows bounds the size of a single import, which runs in one
+// transaction.
+const maxImportRows = 5000
+
+// importColumns are the CSV columns understood by the import. The header row
+// names the columns present, in any order; unknown columns are an error.
+var importColumns = map[string]bool{
+	"keycloak_id":          true,
+	"first_language":       true,
+	"email_language":       true,
+	"dob":                  true,
+	"gender":               true,
+	"email":                true,
+	"country":              true,
+	"first_name":           true,
+	"last_name":            true,
+	"event_id":             true,
+	"participation_option": true,
+	"confirmed":            true,
+}
+
+type importReport struct {
+	DryRun     bool        `json:"dry_run"`
+	Total      int         `json:"total"`
+	Created    int         `json:"created"`
+	Updated    int         `json:"updated"`
+	Registered int         `json:"registered"`
+	Failed     int         `json:"failed"`
+	Rows       []importRow `json:"rows"`
+}
+
+type importRow struct {
+	Line          int      `json:"line"`
+	Email         *string  `json:"email,omitempty"`
+	Action        string   `json:"action"`
+	ParticipantID *int     `json:"participant_id,omitempty"`
+	Registration  string   `json:"registration,omitempty"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// importRegistration is the optional registration of an imported participant
+// to an event.
+type importRegistration struct {
+	EventID             int
+	ParticipationOption string
+	Confirmed           bool
+}
+
+// importLookups holds the values the foreign keys of an imported row are
+// checked against.
+type importLookups struct {
+	languages map[string]bool
+	countries map[string]bool
+	options   map[string]bool
+}
+
+// ImportParticipants creates or updates participants from a CSV file, sent as
+// the "file" field of a multipart form or as the request body. Each row is
+// validated like a participant creation and matched to an existing
+// participant by email or keycloak_id; a deleted participant is reported
+// rather than updated. Rows may register the participant to
+// event_id with participation_option; ?event_id and ?participation_option
+// set them for all rows. With ?dry_run=true nothing is saved. Registration
+// windows and audiences are not checked, the import being an admin tool,
+// but the event has to offer the option.
+func (r *ParticipantDB) ImportParticipants(ctx *gin.Context) {
+	dryRun := ctx.Query("dry_run") == "true"
+	upsert := ctx.Query("upsert") != "false"
+
+	var defaults importRegistration
+	if s := ctx.Query("event_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event_id value! Accepted value is INTEGER", "success": false})
+			return
+		}
+		defaults.EventID = id
+	}
+	defaults.ParticipationOption = ctx.Query("participation_option")
+
+	var body io.Reader = ctx.Request.Body
+	if strings.HasPrefix(ctx.ContentType(), "multipart/") {
+		file, err := ctx.FormFile("file")
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "success": false})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	header, records, err := readImportCSV(body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+		return
+	}
+
+	u, err := importParticipants(r, ctx, header, records, defaults, upsert, dryRun)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	status := http.StatusOK
+	if u.Failed != 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	ctx.JSON(status, gin.H{"message": "Imported!", "data": u, "success": u.Failed == 0})
+}
+
+func readImportCSV(body io.Reader) ([]string, [][]string, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("empty file")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := map[string]bool{}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if !importColumns[column] {
+			return nil, nil, fmt.Errorf("unknown column %q", column)
+		}
+		if seen[column] {
+			return nil, nil, fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+		header[i] = column
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) > maxImportRows {
+		return nil, nil, fmt.Errorf("too many rows, at most %d are accepted", maxImportRows)
+	}
+	return header, records, nil
+}
+
+// importParticipants imports all the rows in one transaction. Every row runs
+// in a savepoint so that a failing row is reported without aborting the
+// others. A dry run rolls the transaction back, after the database had the
+// chance to reject the rows.
+func importParticipants(r *ParticipantDB, ctx context.Context, header []string, records [][]string, defaults importRegistration, upsert bool, dryRun bool) (importReport, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return importReport{}, err
+	}
+	defer tx.Rollback(ctx)
+	if err := audit.Tag(ctx, tx); err != nil {
+		return importReport{}, err
+	}
+
+	lookups, err := loadImportLookups(ctx, tx)
+	if err != nil {
+		return importReport{}, err
+	}
+
+	u := importReport{DryRun: dryRun, Total: len(records), Rows: []importRow{}}
+	for i, record := range records {
+		// The header is line 1.
+		row := importRow{Line: i + 2}
+
+		req, reg, errs := parseImportRow(header, record, defaults, lookups)
+		row.Email = req.Email
+		if len(errs) == 0 {
+			errs = importRowInSavepoint(ctx, tx, req, reg, upsert, &row)
+		}
+
+		if len(errs) != 0 {
+			row.Action = "failed"
+			row.Errors = errs
+			row.ParticipantID = nil
+			row.Registration = ""
+			u.Failed++
+		}
+		switch row.Action {
+		case "created":
+			u.Created++
+		case "updated":
+			u.Updated++
+		}
+		if row.Registration == "created" {
+			u.Registered++
+		}
+		u.Rows = append(u.Rows, row)
+	}
+
+	if !dryRun {
+		if err := tx.Commit(ctx); err != nil {
+			return importReport{}, err
+		}
+	}
+	return u, nil
+}
+
+func importRowInSavepoint(ctx context.Context, tx pgx.Tx, req part, reg *importRegistration, upsert bool, row *importRow) []string {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer sp.Rollback(ctx)
+
+	if err := importRowTx(ctx, sp, req, reg, upsert, row); err != nil {
+		return []string{err.Error()}
+	}
+	if err := sp.Commit(ctx); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+func importRowTx(ctx context.Context, tx pgx.Tx, req part, reg *importRegistration, upsert bool, row *importRow) error {
+	var ids []int
+	var deleted []bool
+	rows, err := tx.Query(ctx, `select id, coalesce(deleted, false) from participant where email = $1 or keycloak_id = $2 order by id asc`, *req.Email, *req.KeycloakID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var d bool
+		if err := rows.Scan(&id, &d); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		deleted = append(deleted, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var id int
+	switch {
+	case len(ids) > 1:
+		return fmt.Errorf("email and keycloak_id belong to different participants (%d and %d)", ids[0], ids[1])
+	case len(ids) == 1 && deleted[0]:
+		// Updating it would leave the participant and its registration
+		// hidden; restoring it is left to the admin.
+		return fmt.Errorf("participant is deleted (%d)", ids[0])
+	case len(ids) == 1 && !upsert:
+		return fmt.Errorf("participant already exists (%d)", ids[0])
+	case len(ids) == 1:
+		id = ids[0]
+		toUpdate, toUpdateArgs := prepareParticipantUpdateQuery(req)
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE participant SET %s WHERE id=$%d`, toUpdate, len(toUpdateArgs)+1),
+			append(toUpdateArgs, id)...); err != nil {
+			return fmt.Errorf("problem updating participant: %w", err)
+		}
+		row.Action = "updated"
+	default:
+		createString, numString, createQueryArgs := prepareParticipantCreateQuery(req)
+		if err := tx.QueryRow(ctx, fmt.Sprintf(`INSERT INTO participant (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return fmt.Errorf("problem creating participant: %w", err)
+		}
+		row.Action = "created"
+	}
+	row.ParticipantID = &id
+
+	if reg == nil {
+		return nil
+	}
+
+	var eventExists bool
+	if err := tx.QueryRow(ctx, `select exists(select 1 from event where id = $1 and coalesce(deleted, false) = false)`, reg.EventID).Scan(&eventExists); err != nil {
+		return err
+	}
+	if !eventExists {
+		return fmt.Errorf("event_id: event %d not found", reg.EventID)
+	}
+
+	// Windows and audiences are not checked, but the event has to offer the
+	// option.
+	var offered bool
+	if err := tx.QueryRow(ctx, `select exists(select 1 from event_participation_option
+		where event_id = $1 and participation_option = $2 and coalesce(deleted, false) = false)`,
+		reg.EventID, reg.ParticipationOption).Scan(&offered); err != nil {
+		return err
+	}
+	if !offered {
+		return fmt.Errorf("participation_option: %q not offered for event %d", reg.ParticipationOption, reg.EventID)
+	}
+
+	var existing int
+	if err := tx.QueryRow(ctx, `select count(*) from participation_status where participant_id = $1 and event_id = $2 and coalesce(deleted, false) = false`,
+		id, reg.EventID).Scan(&existing); err != nil {
+		return err
+	}
+	if existing != 0 {
+		row.Registration = "existing"
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO participation_status (participation_option, participant_id, event_id, confirmed, registration_date) VALUES ($1, $2, $3, $4, $5)`,
+		reg.ParticipationOption, id, reg.EventID, reg.Confirmed, time.Now()); err != nil {
+		return fmt.Errorf("problem creating participation status: %w", err)
+	}
+	row.Registration = "created"
+	return nil
+}
+
+// parseImportRow turns a CSV record into a participant request and an
+// optional registration, and returns every problem found with the row.
+func parseImportRow(header []string, record []string, defaults importRegistration, lookups importLookups) (part, *importRegistration, []string) {
+	var errs []string
+	req := part{}
+	reg := defaults
+
+	if len(record) != len(header) {
+		return req, nil, []string{fmt.Sprintf("expected %d fields, got %d", len(header), len(record))}
+	}
+
+	for i, column := range header {
+		value := strings.TrimSpace(record[i])
+		if value == "" {
+			continue
+		}
+		v := value
+		switch column {
+		case "keycloak_id":
+			req.KeycloakID = &v
+		case "first_language":
+			req.FirstLanguage = &v
+		case "email_language":
+			req.EmailLanguage = &v
+		case "gender":
+			req.Gender = &v
+		case "email":
+			req.Email = &v
+		case "country":
+			req.Country = &v
+		case "first_name":
+			req.FirstName = &v
+		case "last_name":
+			req.LastName = &v
+		case "dob":
+			dob, err := parseImportDate(v)
+			if err != nil {
+				errs = append(errs, "dob: invalid date, expected YYYY-MM-DD")
+				continue
+			}
+			req.DOB = &dob
+		case "event_id":
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, "event_id: invalid value, expected INTEGER")
+				continue
+			}
+			reg.EventID = id
+		case "participation_option":
+			reg.ParticipationOption = v
+		case "confirmed":
+			confirmed, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, "confirmed: invalid value, expected true or false")
+				continue
+			}
+			reg.Confirmed = confirmed
+		}
+	}
+
+	// Report the fields by their column name rather than their Go name.
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return strings.Split(f.Tag.Get("json"), ",")[0]
+	})
+	if err := validate.Struct(req); err != nil {
+		if verrs, ok := err.(validator.ValidationErrors); ok {
+			for _, e := range verrs {
+				errs = append(errs, fmt.Sprintf("%s: failed on the '%s' rule", e.Field(), e.Tag()))
+			}
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if req.FirstLanguage != nil && !lookups.languages[*req.FirstLanguage] {
+		errs = append(errs, fmt.Sprintf("first_language: unknown language %q", *req.FirstLanguage))
+	}
+	if req.EmailLanguage != nil && !lookups.languages[*req.EmailLanguage] {
+		errs = append(errs, fmt.Sprintf("email_language: unknown language %q", *req.EmailLanguage))
+	}
+	if req.Country != nil && !lookups.countries[*req.Country] {
+		errs = append(errs, fmt.Sprintf("country: unknown country %q", *req.Country))
+	}
+
+	if reg.EventID == 0 && reg.ParticipationOption == "" {
+		return req, nil, errs
+	}
+	if reg.EventID == 0 {
+		errs = append(errs, "event_id: required with participation_option")
+	}
+	if reg.ParticipationOption == "" {
+		errs = append(errs, "participation_option: required with event_id")
+	} else if !lookups.options[reg.ParticipationOption] {
+		errs = append(errs, fmt.Sprintf("participation_option: unknown option %q", reg.ParticipationOption))
+	}
+	return req, &reg, errs
+}
+
+func parseImportDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func loadImportLookups(ctx context.Context, tx pgx.Tx) (importLookups, error) {
+	l := importLookups{}
+	var err error
+	if l.languages, err = loadNames(ctx, tx, `select code from language_list`); err != nil {
+		return l, err
+	}
+	if l.countries, err = loadNames(ctx, tx, `select code from country_list`); err != nil {
+		return l, err
+	}
+	if l.options, err = loadNames(ctx, tx, `select name from participation_option where coalesce(deleted, false) = false`); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+func loadNames(ctx context.Context, tx pgx.Tx, query string) (map[string]bool, error) {
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,106 @@
+package participant
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	header, records, err := readImportCSV(strings.NewReader("\ufeffEmail, First_Name\na@example.com, A\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header, []string{"email", "first_name"}) {
+		t.Errorf("header = %q", header)
+	}
+	if !reflect.DeepEqual(records, [][]string{{"a@example.com", "A"}}) {
+		t.Errorf("records = %q", records)
+	}
+
+	for body, want := range map[string]string{
+		"":              "empty file",
+		"email,phone\n": `unknown column "phone"`,
+		"email,EMAIL\n": `duplicate column "email"`,
+		"email\n" + strings.Repeat("a@example.com\n", maxImportRows+1): "too many rows, at most 5000 are accepted",
+	} {
+		if _, _, err := readImportCSV(strings.NewReader(body)); err == nil || err.Error() != want {
+			t.Errorf("readImportCSV(%.20q) = %v, want %s", body, err, want)
+		}
+	}
+}
+
+func TestParseImportRow(t *testing.T) {
+	lookups := importLookups{
+		languages: map[string]bool{"en": true},
+		countries: map[string]bool{"DE": true},
+		options:   map[string]bool{"online": true},
+	}
+	header := []string{"keycloak_id", "email", "first_name", "last_name", "country", "dob", "event_id", "participation_option", "confirmed"}
+	valid := []string{"0b8f2a3c-6d7e-4f10-9a1b-2c3d4e5f6a7b", "a@example.com", "A", "B", "DE", "2000-03-04", "", "", ""}
+	with := func(column string, value string) []string {
+		record := append([]string(nil), valid...)
+		for i, c := range header {
+			if c == column {
+				record[i] = value
+			}
+		}
+		return record
+	}
+
+	tests := []struct {
+		name     string
+		record   []string
+		defaults importRegistration
+		wantReg  *importRegistration
+		wantErrs []string
+	}{
+		{"valid", valid, importRegistration{}, nil, nil},
+		{
+			"registration",
+			with("event_id", "3"),
+			importRegistration{ParticipationOption: "online", Confirmed: true},
+			&importRegistration{3, "online", true},
+			nil,
+		},
+		{
+			"row overrides the defaults",
+			with("confirmed", "false"),
+			importRegistration{EventID: 3, ParticipationOption: "online", Confirmed: true},
+			&importRegistration{3, "online", false},
+			nil,
+		},
+		{"field count", valid[:2], importRegistration{}, nil, []string{"expected 9 fields, got 2"}},
+		{"missing email", with("email", ""), importRegistration{}, nil, []string{"email: failed on the 'required' rule"}},
+		{"invalid keycloak_id", with("keycloak_id", "user"), importRegistration{}, nil, []string{"keycloak_id: failed on the 'uuid' rule"}},
+		{"invalid dob", with("dob", "04.03.2000"), importRegistration{}, nil, []string{"dob: invalid date, expected YYYY-MM-DD"}},
+		{"unknown country", with("country", "XX"), importRegistration{}, nil, []string{`country: unknown country "XX"`}},
+		{"invalid event_id", with("event_id", "x"), importRegistration{}, nil, []string{"event_id: invalid value, expected INTEGER"}},
+		{
+			"option without event",
+			with("participation_option", "online"),
+			importRegistration{},
+			&importRegistration{0, "online", false},
+			[]string{"event_id: required with participation_option"},
+		},
+		{
+			"unknown option",
+			with("participation_option", "onsite"),
+			importRegistration{EventID: 3},
+			&importRegistration{3, "onsite", false},
+			[]string{`participation_option: unknown option "onsite"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reg, errs := parseImportRow(header, tt.record, tt.defaults, lookups)
+			if !reflect.DeepEqual(errs, tt.wantErrs) {
+				t.Errorf("errors = %q, want %q", errs, tt.wantErrs)
+			}
+			if !reflect.DeepEqual(reg, tt.wantReg) {
+				t.Errorf("registration = %+v, want %+v", reg, tt.wantReg)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package participant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+)
+
+type participantMerge struct {
+	DuplicateID *int    `json:"duplicate_id" validate:"required"`
+	MergedBy    *string `json:"merged_by,omitempty"`
+}
+
+type participantMergeResponse struct {
+	ID                *int            `json:"id" db:"id"`
+	SurvivorID        *int            `json:"survivor_id" db:"survivor_id"`
+	MergedID          *int            `json:"merged_id" db:"merged_id"`
+	MergedSnapshot    json.RawMessage `json:"merged_snapshot" db:"merged_snapshot"`
+	MovedStatuses     *int            `json:"moved_statuses" db:"moved_statuses"`
+	ResolvedConflicts []mergeConflict `json:"resolved_conflicts" db:"resolved_conflicts"`
+	MergedBy          *string         `json:"merged_by,omitempty" db:"merged_by"`
+	CreatedAt         *time.Time      `json:"created_at" db:"created_at"`
+	Survivor          *partResponse   `json:"survivor,omitempty"`
+}
+
+// mergeConflict records, for an event both participants were registered to,
+// which participation status was kept and which ones were soft deleted.
+type mergeConflict struct {
+	EventID    int   `json:"event_id"`
+	KeptID     int   `json:"kept_id"`
+	DeletedIDs []int `json:"deleted_ids"`
+}
+
+// MergeParticipantByID merges duplicate_id into the participant of the path:
+// its participation statuses and view sessions are moved over, the profile fields the survivor
+// is missing are copied and the duplicate is deleted. Everything happens in
+// one transaction and the merge is recorded in participant_merge.
+func (r *ParticipantDB) MergeParticipantByID(ctx *gin.Context) {
+	s := participantMerge{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	if id == *s.DuplicateID {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "a participant cannot be merged into itself", "success": false})
+		return
+	}
+
+	u, err := mergeParticipants(r, ctx, id, *s.DuplicateID, s.MergedBy)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	survivor, err := getPartById(r, ctx, strconv.Itoa(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	u.Survivor = &survivor
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participants merged!", "data": u, "success": true})
+}
+
+// GetParticipantMerges lists the merges into the participant, latest first.
+func (r *ParticipantDB) GetParticipantMerges(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	u, err := getParticipantMerges(r, ctx, id)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func mergeParticipants(r *ParticipantDB, ctx context.Context, survivorID int, duplicateID int, mergedBy *string) (participantMergeResponse, error) {
+	u := participantMergeResponse{}
+	var conflicts []mergeConflict
+	var movedStatuses int
+	var snapshot string
+	err := txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		// Lock both participants so no registration is added to the duplicate
+		// while it is being merged. Deleted participants are restored first.
+		var locked int
+		if err := tx.QueryRow(ctx, `select count(*) from (select id from participant where id in ($1, $2) and coalesce(deleted, false) = false for update) p`,
+			survivorID, duplicateID).Scan(&locked); err != nil {
+			return err
+		}
+		if locked != 2 {
+			return fmt.Errorf("not found")
+		}
+
+		if err := tx.QueryRow(ctx, `select row_to_json(p)::text from participant p where id = $1`, duplicateID).Scan(&snapshot); err != nil {
+			return err
+		}
+
+		var err error
+		conflicts, err = resolveMergeConflicts(ctx, tx, survivorID, duplicateID, mergedBy)
+		if err != nil {
+			return err
+		}
+
+		moved, err := tx.Exec(ctx, `UPDATE participation_status SET participant_id = $1, updated_at = now() WHERE participant_id = $2`,
+			survivorID, duplicateID)
+		if err != nil {
+			return fmt.Errorf("problem moving participation statuses: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE view_session SET participant_id = $1 WHERE participant_id = $2`, survivorID, duplicateID); err != nil {
+			return fmt.Errorf("problem moving view sessions: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE participant s SET
+		first_language = coalesce(s.first_language, d.first_language),
+		email_language = coalesce(s.email_language, d.email_language),
+		dob = coalesce(s.dob, d.dob),
+		gender = coalesce(s.gender, d.gender),
+		country = coalesce(s.country, d.country),
+		updated_at = now()
+		FROM participant d WHERE s.id = $1 AND d.id = $2`, survivorID, duplicateID); err != nil {
+			return fmt.Errorf("problem updating participant: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `delete from participant where id = $1`, duplicateID); err != nil {
+			return fmt.Errorf("problem deleting participant: %w", err)
+		}
+
+		conflictsJSON, err := json.Marshal(conflicts)
+		if err != nil {
+			return err
+		}
+
+		movedStatuses = int(moved.RowsAffected())
+		if err := tx.QueryRow(ctx, `INSERT INTO participant_merge (survivor_id, merged_id, merged_snapshot, moved_statuses, resolved_conflicts, merged_by)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+			survivorID, duplicateID, snapshot, movedStatuses, string(conflictsJSON), mergedBy).Scan(&u.ID, &u.CreatedAt); err != nil {
+			return fmt.Errorf("problem recording participant merge: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return participantMergeResponse{}, err
+	}
+
+	u.SurvivorID = &survivorID
+	u.MergedID = &duplicateID
+	u.MergedSnapshot = json.RawMessage(snapshot)
+	u.MovedStatuses = &movedStatuses
+	u.ResolvedConflicts = conflicts
+	u.MergedBy = mergedBy
+	return u, nil
+}
+
+// resolveMergeConflicts keeps a single participation status per event both
+// participants are registered to: the confirmed one, else the earliest
+// registration. The others are soft deleted.
+func resolveMergeConflicts(ctx context.Context, tx pgx.Tx, survivorID int, duplicateID int, mergedBy *string) ([]mergeConflict, error) {
+	rows, err := tx.Query(ctx, `select id, event_id from participation_status
+	where participant_id in ($1, $2) and coalesce(deleted, false) = false
+	and event_id in (
+		select event_id from participation_status where participant_id = $1 and coalesce(deleted, false) = false
+		intersect
+		select event_id from participation_status where participant_id = $2 and coalesce(deleted, false) = false
+	)
+	order by event_id asc, confirmed desc, registration_date asc, id asc`, survivorID, duplicateID)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []mergeConflict{}
+	for rows.Next() {
+		var id, eventID int
+		if err := rows.Scan(&id, &eventID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if n := len(conflicts); n != 0 && conflicts[n-1].EventID == eventID {
+			conflicts[n-1].DeletedIDs = append(conflicts[n-1].DeletedIDs, id)
+			continue
+		}
+		conflicts = append(conflicts, mergeConflict{eventID, id, []int{}})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range conflicts {
+		if _, err := tx.Exec(ctx, `UPDATE participation_status SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() WHERE id = any($1)`, c.DeletedIDs, mergedBy); err != nil {
+			return nil, fmt.Errorf("problem resolving participation conflicts: %w", err)
+		}
+	}
+	return conflicts, nil
+}
+
+func getParticipantMerges(r *ParticipantDB, ctx context.Context, id string) ([]participantMergeResponse, error) {
+	u := []participantMergeResponse{}
+	rows, err := r.db.Query(ctx, `select
+	id,
+	survivor_id,
+	merged_id,
+	merged_snapshot::text,
+	moved_statuses,
+	resolved_conflicts::text,
+	merged_by,
+	created_at
+	from participant_merge where survivor_id = $1 order by created_at desc, id desc`, id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d participantMergeResponse
+		var snapshot, conflicts string
+		err := rows.Scan(&d.ID, &d.SurvivorID, &d.MergedID, &snapshot, &d.MovedStatuses, &conflicts, &d.MergedBy, &d.CreatedAt)
+		if err != nil {
+			return u, err
+		}
+		d.MergedSnapshot = json.RawMessage(snapshot)
+		if err := json.Unmarshal([]byte(conflicts), &d.ResolvedConflicts); err != nil {
+			return u, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
@@ -0,0 +1,192 @@
+package participant
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// participantSorts maps the accepted ?sort values to their order by clause.
+var participantSorts = map[string]string{
+	"name":        "lower(last_name) asc, lower(first_name) asc, id asc",
+	"-name":       "lower(last_name) desc, lower(first_name) desc, id desc",
+	"email":       "lower(email) asc, id asc",
+	"-email":      "lower(email) desc, id desc",
+	"created_at":  "created_at asc, id asc",
+	"-created_at": "created_at desc, id desc",
+	"relevance":   "relevance desc, id asc",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchParticipants finds participants by partial name or email (?q), or by
+// similar name or email with ?fuzzy=true, email domain, country,
+// first_language, creation date (created_after and created_before, RFC 3339)
+// and registration to event_id, optionally with participation_option. Erased
+// and deleted participants are left out unless ?include_erased=true and
+// ?include_deleted=true respectively. ?sort accepts name, email, created_at,
+// prefixed with - for descending order, and relevance, the default when q is
+// given.
+func (r *ParticipantDB) SearchParticipants(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	relevance := "0::real"
+	q := strings.ToLower(strings.TrimSpace(ctx.Query("q")))
+	if q != "" {
+		n := arg(q)
+		if ctx.Query("fuzzy") == "true" {
+			conditions = append(conditions, fmt.Sprintf("(lower(first_name || ' ' || last_name) %% %[1]s or lower(email) %% %[1]s)", n))
+		} else {
+			like := arg("%" + likeEscaper.Replace(q) + "%")
+			conditions = append(conditions, fmt.Sprintf("(lower(first_name || ' ' || last_name) like %[1]s or lower(email) like %[1]s)", like))
+		}
+		relevance = fmt.Sprintf("greatest(similarity(lower(first_name || ' ' || last_name), %[1]s), similarity(lower(email), %[1]s))", n)
+	}
+
+	if domain := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ctx.Query("email_domain"))), "@"); domain != "" {
+		conditions = append(conditions, "lower(split_part(email, '@', 2)) = "+arg(domain))
+	}
+	if country := ctx.Query("country"); country != "" {
+		conditions = append(conditions, "country = "+arg(country))
+	}
+	if firstLanguage := ctx.Query("first_language"); firstLanguage != "" {
+		conditions = append(conditions, "first_language = "+arg(firstLanguage))
+	}
+	for _, bound := range []struct{ param, op string }{{"created_after", ">="}, {"created_before", "<"}} {
+		s := ctx.Query(bound.param)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.param + " value! Accepted value is an RFC 3339 date", "success": false})
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("created_at %s %s", bound.op, arg(t)))
+	}
+
+	option := ctx.Query("participation_option")
+	if s := ctx.Query("event_id"); s != "" {
+		eventID, err := strconv.Atoi(s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event_id value! Accepted value is INTEGER", "success": false})
+			return
+		}
+		registered := "ps.participant_id = participant.id and ps.event_id = " + arg(eventID) + " and coalesce(ps.deleted, false) = false"
+		if option != "" {
+			registered += " and ps.participation_option = " + arg(option)
+		}
+		conditions = append(conditions, "exists (select 1 from participation_status ps where "+registered+")")
+	} else if option != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "participation_option requires event_id", "success": false})
+		return
+	}
+
+	if ctx.Query("include_erased") != "true" {
+		conditions = append(conditions, "erased_at is null")
+	}
+	if ctx.Query("include_deleted") != "true" {
+		conditions = append(conditions, "coalesce(deleted, false) = false")
+	}
+
+	sort := ctx.Query("sort")
+	if sort == "" {
+		sort = "-created_at"
+		if q != "" {
+			sort = "relevance"
+		}
+	}
+	orderBy, ok := participantSorts[sort]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort value! Accepted values are name, email, created_at, their - prefixed forms and relevance", "success": false})
+		return
+	}
+
+	u, err := searchParticipants(r, ctx, conditions, args, relevance, orderBy, intSkip, intLimit)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func searchParticipants(r *ParticipantDB, ctx context.Context, conditions []string, args []interface{}, relevance string, orderBy string, skip int, limit int) ([]partResponse, error) {
+	where := ""
+	if len(conditions) != 0 {
+		where = "where " + strings.Join(conditions, " and ")
+	}
+
+	u := []partResponse{}
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select
+	id,
+	keycloak_id,
+	first_language,
+	email_language,
+	dob,
+	gender,
+	email,
+	country,
+	first_name,
+	last_name,
+	erased_at,
+	deleted_at,
+	deleted_by,
+	created_at,
+	updated_at,
+	%s as relevance
+	from participant %s order by %s LIMIT %d OFFSET %d`, relevance, where, orderBy, limit, skip), args...)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d partResponse
+		var relevance float64
+		err := rows.Scan(&d.ID, &d.KeycloakID, &d.FirstLanguage, &d.EmailLanguage, &d.DOB, &d.Gender, &d.Email, &d.Country, &d.FirstName, &d.LastName, &d.ErasedAt, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt, &relevance)
+		if err != nil {
+			return u, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
@@ -4,7 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"time"
+
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -13,7 +20,10 @@ import (
 )
 
 type partOptionResponse struct {
-	Name *string `json:"name" db:"name"`
+	Name      *string    `json:"name" db:"name"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy *string    `json:"deleted_by,omitempty" db:"deleted_by"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type partOption struct {
@@ -26,6 +36,7 @@ type ParticipationOption interface {
 	CreateNewParticipationOption(ctx *gin.Context)
 	UpdateParticipationOptionByName(ctx *gin.Context)
 	DeleteParticipationOptionByName(ctx *gin.Context)
+	RestoreParticipationOptionByName(ctx *gin.Context)
 }
 
 type ParticipationOptionDB struct {
@@ -38,10 +49,12 @@ func NewParticipationOption(db *pgxpool.Pool) ParticipationOption {
 	}
 }
 
+// GetParticipationOptionByName returns the participation option, or 404 when
+// it is deleted unless ?include_deleted=true.
 func (r *ParticipationOptionDB) GetParticipationOptionByName(ctx *gin.Context) {
 	name := ctx.Param("name")
 
-	u, err := getPartOptionByName(r, ctx, name)
+	u, err := getPartOptionByName(r, ctx, name, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -57,9 +70,14 @@ func (r *ParticipationOptionDB) GetParticipationOptionByName(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllParticipationOption lists the participation options, leaving deleted
+// ones out unless ?include_deleted=true.
 func (r *ParticipationOptionDB) GetAllParticipationOption(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -86,7 +104,7 @@ func (r *ParticipationOptionDB) GetAllParticipationOption(ctx *gin.Context) {
 		return
 	}
 
-	u, err := GetAllPartOption(r, ctx, intSkip, intLimit)
+	u, err := GetAllPartOption(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -118,7 +136,17 @@ func (r *ParticipationOptionDB) CreateNewParticipationOption(ctx *gin.Context) {
 		return
 	}
 
-	if err := CreateNewPartOption(r, ctx, s); err != nil {
+	name, err := CreateNewPartOption(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getPartOptionByName(r, ctx, name, false)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -126,7 +154,9 @@ func (r *ParticipationOptionDB) CreateNewParticipationOption(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new participation option!", "data": s, "success": true})
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, url.PathEscape(name)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new participation option!", "data": u, "success": true})
 }
 
 func (r *ParticipationOptionDB) UpdateParticipationOptionByName(ctx *gin.Context) {
@@ -141,7 +171,7 @@ func (r *ParticipationOptionDB) UpdateParticipationOptionByName(ctx *gin.Context
 
 	name := ctx.Param("name")
 
-	if err := UpdatePartOptionByName(r, ctx, u, name); err != nil {
+	if err := UpdatePartOptionByName(r, ctx, u, name, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -151,6 +181,14 @@ func (r *ParticipationOptionDB) UpdateParticipationOptionByName(ctx *gin.Context
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -165,14 +203,44 @@ func (r *ParticipationOptionDB) UpdateParticipationOptionByName(ctx *gin.Context
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Participation option updated successfully", "data": u, "success": true})
+
+	if u.Name != nil {
+		name = *u.Name
+	}
+	updated, err := getPartOptionByName(r, ctx, name, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participation option updated successfully", "data": updated, "success": true})
 }
 
+// DeleteParticipationOptionByName soft deletes the participation option. The
+// events offering it and the registrations made with it keep referring to it.
 func (r *ParticipationOptionDB) DeleteParticipationOptionByName(ctx *gin.Context) {
 
 	name := ctx.Param("name")
 
-	if err := DeletePartOptionByName(r, ctx, name); err != nil {
+	if err := DeletePartOptionByName(r, ctx, name, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -183,12 +251,47 @@ func (r *ParticipationOptionDB) DeleteParticipationOptionByName(ctx *gin.Context
 	ctx.JSON(http.StatusOK, gin.H{"message": "Participation option deleted successfully!", "success": true})
 }
 
-func getPartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, name string) (partOptionResponse, error) {
+func (r *ParticipationOptionDB) RestoreParticipationOptionByName(ctx *gin.Context) {
+
+	name := ctx.Param("name")
+
+	if err := RestorePartOptionByName(r, ctx, name); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participation option restored successfully!", "success": true})
+}
+
+func getPartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, name string, includeDeleted bool) (partOptionResponse, error) {
 	u := partOptionResponse{}
 	if err := r.db.QueryRow(ctx, `select 
-	name 
-	from participation_option where name = $1`, name).Scan(
+	name,
+	deleted_at,
+	deleted_by,
+	updated_at 
+	from participation_option where name = $1 and ($2 or coalesce(deleted, false) = false)`, name, includeDeleted).Scan(
 		&u.Name,
+		&u.DeletedAt,
+		&u.DeletedBy,
+		&u.UpdatedAt,
 	); err != nil {
 		if err == pgx.ErrNoRows {
 			return partOptionResponse{}, fmt.Errorf("not found")
@@ -198,15 +301,18 @@ func getPartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, name string
 	return u, nil
 }
 
-func GetAllPartOption(r *ParticipationOptionDB, ctx *gin.Context, skip int, limit int) (*[]partOptionResponse, error) {
+func GetAllPartOption(r *ParticipationOptionDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]partOptionResponse, error) {
 
 	u := []partOptionResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
-	name 
-	from participation_option LIMIT %d OFFSET %d`, limit, skip))
+	name,
+	deleted_at,
+	deleted_by,
+	updated_at 
+	from participation_option where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d partOptionResponse
-		err := rows.Scan(&d.Name)
+		err := rows.Scan(&d.Name, &d.DeletedAt, &d.DeletedBy, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -215,15 +321,15 @@ func GetAllPartOption(r *ParticipationOptionDB, ctx *gin.Context, skip int, limi
 	return &u, rows.Err()
 }
 
-func UpdatePartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, req partOption, name string) error {
+func UpdatePartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, req partOption, name string, ifMatch []time.Time) error {
 	if req.Name != nil {
-		updateRes, err := r.db.Exec(ctx, `UPDATE participation_option SET name=$1 WHERE name=$2`, req.Name, name)
+		updateRes, err := audit.Exec(ctx, r.db, `UPDATE participation_option SET name=$1, updated_at = now() WHERE name=$2 AND `+etag.Condition(3), req.Name, name, ifMatch)
 		if err != nil {
 			return fmt.Errorf("problem updating participation_option: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from participation_option where name = $1)`, name)
 		}
 
 		return nil
@@ -232,18 +338,43 @@ func UpdatePartOptionByName(r *ParticipationOptionDB, ctx *gin.Context, req part
 	}
 }
 
-func CreateNewPartOption(r *ParticipationOptionDB, ctx *gin.Context, req partOption) error {
-	_, err := r.db.Exec(ctx,
+func CreateNewPartOption(r *ParticipationOptionDB, ctx *gin.Context, req partOption) (string, error) {
+	var name string
+	err := audit.QueryRow(ctx, r.db,
 		`INSERT INTO participation_option (
 			name)
 		VALUES (
-			$1)  `,
-		*req.Name)
+			$1)
+		RETURNING name`,
+		*req.Name).Scan(&name)
 
-	return err
+	return name, err
 }
 
-func DeletePartOptionByName(r *ParticipationOptionDB, ctx context.Context, name string) error {
-	_, err := r.db.Exec(ctx, "delete from participation_option where name=$1", name)
+func DeletePartOptionByName(r *ParticipationOptionDB, ctx context.Context, name string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE participation_option SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE name = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), name, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from participation_option where name = $1 and coalesce(deleted, false) = false)`, name)
+	}
+	return nil
+}
+
+func RestorePartOptionByName(r *ParticipationOptionDB, ctx context.Context, name string) error {
+	var deleted bool
+	if err := r.db.QueryRow(ctx, `select coalesce(deleted, false) from participation_option where name = $1`, name).Scan(&deleted); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("not found")
+		}
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("not deleted")
+	}
+
+	_, err := audit.Exec(ctx, r.db, `UPDATE participation_option SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE name = $1`, name)
 	return err
 }
@@ -0,0 +1,282 @@
+package partstatus
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+// attendeeFlushEvery is the number of rows written between two flushes of
+// the response.
+const attendeeFlushEvery = 500
+
+var attendeeColumns = []string{
+	"participation_status_id",
+	"participant_id",
+	"email",
+	"first_name",
+	"last_name",
+	"country",
+	"first_language",
+	"email_language",
+	"participation_option",
+	"confirmed",
+	"registration_date",
+	"deleted",
+}
+
+type attendeeResponse struct {
+	ParticipationStatusID *int       `json:"participation_status_id"`
+	ParticipantID         *int       `json:"participant_id"`
+	Email                 *string    `json:"email"`
+	FirstName             *string    `json:"first_name"`
+	LastName              *string    `json:"last_name"`
+	Country               *string    `json:"country"`
+	FirstLanguage         *string    `json:"first_language"`
+	EmailLanguage         *string    `json:"email_language"`
+	ParticipationOption   *string    `json:"participation_option"`
+	Confirmed             *bool      `json:"confirmed"`
+	RegistrationDate      *time.Time `json:"registration_date"`
+	Deleted               *bool      `json:"deleted"`
+}
+
+// ExportEventAttendees writes the attendee list of an event as CSV or JSON
+// Lines (?format=csv|jsonl, csv by default). It can be filtered by
+// participation_option and confirmed, and includes deleted registrations with
+// ?deleted=true or ?deleted=all. Rows are written as pgx reads them from the
+// connection, so the list is never held in memory as a whole.
+func (r *ParticipationStatusDB) ExportEventAttendees(ctx *gin.Context) {
+	eventID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	format := ctx.DefaultQuery("format", "csv")
+	if format != "csv" && format != "jsonl" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format value! Accepted values are csv and jsonl", "success": false})
+		return
+	}
+
+	conditions := []string{"ps.event_id = $1"}
+	args := []interface{}{eventID}
+
+	if option := ctx.Query("participation_option"); option != "" {
+		args = append(args, option)
+		conditions = append(conditions, fmt.Sprintf("ps.participation_option = $%d", len(args)))
+	}
+	if s := ctx.Query("confirmed"); s != "" {
+		confirmed, err := strconv.ParseBool(s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid confirmed value! Accepted value is BOOLEAN", "success": false})
+			return
+		}
+		args = append(args, confirmed)
+		conditions = append(conditions, fmt.Sprintf("ps.confirmed = $%d", len(args)))
+	}
+	switch ctx.DefaultQuery("deleted", "false") {
+	case "all":
+	case "true":
+		conditions = append(conditions, "coalesce(ps.deleted, false) = true")
+	case "false":
+		conditions = append(conditions, "coalesce(ps.deleted, false) = false")
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deleted value! Accepted values are true, false and all", "success": false})
+		return
+	}
+
+	var exists bool
+	if err := r.db.QueryRow(ctx, `select exists(select 1 from event where id = $1)`, eventID).Scan(&exists); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if !exists {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error":   "not found",
+			"success": false,
+		})
+		return
+	}
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select
+	ps.id,
+	p.id,
+	p.email,
+	p.first_name,
+	p.last_name,
+	p.country,
+	p.first_language,
+	p.email_language,
+	ps.participation_option,
+	ps.confirmed,
+	ps.registration_date,
+	coalesce(ps.deleted, false)
+	from participation_status ps
+	join participant p on p.id = ps.participant_id
+	where %s
+	order by ps.registration_date asc, ps.id asc`, strings.Join(conditions, " and ")), args...)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("event-%d-attendees.%s", eventID, format)
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// Once the first row is written the status can no longer change, so a
+	// failure past this point has to show in the body: JSON Lines ends with an
+	// error line, and CSV, which has no room for one, loses its connection.
+	if format == "jsonl" {
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Status(http.StatusOK)
+		err = writeAttendeesJSONL(ctx, rows)
+	} else {
+		ctx.Header("Content-Type", "text/csv; charset=utf-8")
+		ctx.Status(http.StatusOK)
+		err = writeAttendeesCSV(ctx, rows)
+	}
+	if err != nil {
+		log.Printf("attendee export of event %d: %v", eventID, err)
+		if format != "jsonl" || writeExportError(ctx, err) != nil {
+			abortExport(ctx)
+		}
+	}
+}
+
+// writeExportError ends a JSON Lines export with a line in the shape of the
+// other error responses.
+func writeExportError(ctx *gin.Context, err error) error {
+	if err := json.NewEncoder(ctx.Writer).Encode(gin.H{"error": err.Error(), "success": false}); err != nil {
+		return err
+	}
+	ctx.Writer.Flush()
+	return nil
+}
+
+// abortExport closes the connection under a started export, so the client
+// sees a truncated transfer instead of a complete file. The recovery
+// middleware answers panic(http.ErrAbortHandler) like any other panic, hence
+// the hijack. Connections that cannot be hijacked (HTTP/2) are left as they
+// are, the failure is then only in the log.
+func abortExport(ctx *gin.Context) {
+	conn, _, err := ctx.Writer.Hijack()
+	if err != nil {
+		log.Printf("attendee export: cannot abort the response: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func scanAttendee(rows pgx.Rows) (attendeeResponse, error) {
+	var d attendeeResponse
+	err := rows.Scan(&d.ParticipationStatusID, &d.ParticipantID, &d.Email, &d.FirstName, &d.LastName, &d.Country,
+		&d.FirstLanguage, &d.EmailLanguage, &d.ParticipationOption, &d.Confirmed, &d.RegistrationDate, &d.Deleted)
+	return d, err
+}
+
+func writeAttendeesJSONL(ctx *gin.Context, rows pgx.Rows) error {
+	encoder := json.NewEncoder(ctx.Writer)
+	n := 0
+	for rows.Next() {
+		d, err := scanAttendee(rows)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(d); err != nil {
+			return err
+		}
+		if n++; n%attendeeFlushEvery == 0 {
+			ctx.Writer.Flush()
+		}
+	}
+	return rows.Err()
+}
+
+func writeAttendeesCSV(ctx *gin.Context, rows pgx.Rows) error {
+	w := csv.NewWriter(ctx.Writer)
+	if err := w.Write(attendeeColumns); err != nil {
+		return err
+	}
+
+	n := 0
+	for rows.Next() {
+		d, err := scanAttendee(rows)
+		if err != nil {
+			return err
+		}
+		record := []string{
+			csvInt(d.ParticipationStatusID),
+			csvInt(d.ParticipantID),
+			csvString(d.Email),
+			csvString(d.FirstName),
+			csvString(d.LastName),
+			csvString(d.Country),
+			csvString(d.FirstLanguage),
+			csvString(d.EmailLanguage),
+			csvString(d.ParticipationOption),
+			csvBool(d.Confirmed),
+			csvTime(d.RegistrationDate),
+			csvBool(d.Deleted),
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+		if n++; n%attendeeFlushEvery == 0 {
+			w.Flush()
+			ctx.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvString returns s, prefixed with a quote when a spreadsheet would read it
+// as a formula, which includes cells starting with a tab or carriage return.
+func csvString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	if *s != "" && strings.ContainsRune("=+-@\t\r", rune((*s)[0])) {
+		return "'" + *s
+	}
+	return *s
+}
+
+func csvInt(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+func csvBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
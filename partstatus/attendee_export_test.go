@@ -0,0 +1,69 @@
+package partstatus
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSVString(t *testing.T) {
+	for in, want := range map[string]string{
+		"":           "",
+		"Ada":        "Ada",
+		"=1+1":       "'=1+1",
+		"+33":        "'+33",
+		"-1":         "'-1",
+		"@SUM(A1)":   "'@SUM(A1)",
+		"\t=1+1":     "'\t=1+1",
+		"\r=1+1":     "'\r=1+1",
+		"a=1":        "a=1",
+		"ada@x.test": "ada@x.test",
+	} {
+		in := in
+		if got := csvString(&in); got != want {
+			t.Errorf("csvString(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := csvString(nil); got != "" {
+		t.Errorf("csvString(nil) = %q", got)
+	}
+}
+
+func TestWriteExportError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+
+	if err := writeExportError(ctx, errors.New("conn closed")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"error\":\"conn closed\",\"success\":false}\n"; w.Body.String() != want {
+		t.Errorf("body = %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestAbortExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/export", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+		ctx.Writer.WriteString("participation_status_id\n1\n")
+		ctx.Writer.Flush()
+		abortExport(ctx)
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Error("aborted export read without error")
+	}
+}
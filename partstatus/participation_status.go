@@ -4,10 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"vh-srv-event/actor"
+	"vh-srv-event/audience"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+	"vh-srv-event/txn"
+
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jackc/pgx/v4"
@@ -22,6 +29,8 @@ type participationStatusResponse struct {
 	Confirmed           *bool      `json:"confirmed" db:"confirmed"`
 	RegistrationDate    *time.Time `json:"registration_date" db:"registration_date"`
 	Deleted             *bool      `json:"deleted" db:"deleted"`
+	DeletedAt           *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy           *string    `json:"deleted_by,omitempty" db:"deleted_by"`
 	CreatedAt           *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt           *time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -32,7 +41,6 @@ type participationStatus struct {
 	EventID             *int       `json:"event_id" db:"event_id" validate:"required"`
 	Confirmed           *bool      `json:"confirmed" db:"confirmed"`
 	RegistrationDate    *time.Time `json:"registration_date" db:"registration_date" validate:"required"`
-	Deleted             *bool      `json:"deleted" db:"deleted"`
 }
 
 type ParticipationStatus interface {
@@ -41,22 +49,28 @@ type ParticipationStatus interface {
 	CreateNewParticipationStatus(ctx *gin.Context)
 	UpdateParticipationStatusByID(ctx *gin.Context)
 	DeleteParticipationStatusByID(ctx *gin.Context)
+	RestoreParticipationStatusByID(ctx *gin.Context)
+	ExportEventAttendees(ctx *gin.Context)
 }
 
 type ParticipationStatusDB struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	audiences *audience.Evaluator
 }
 
-func NewParticipationStatus(db *pgxpool.Pool) ParticipationStatus {
+func NewParticipationStatus(db *pgxpool.Pool, audiences *audience.Evaluator) ParticipationStatus {
 	return &ParticipationStatusDB{
 		db,
+		audiences,
 	}
 }
 
+// GetParticipationStatusByID returns the participation status, or 404 when it
+// is deleted unless ?include_deleted=true.
 func (r *ParticipationStatusDB) GetParticipationStatusByID(ctx *gin.Context) {
 	id := ctx.Param("id")
 
-	u, err := getParticipationStatusByID(r, ctx, id)
+	u, err := getParticipationStatusByID(r, ctx, id, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -72,9 +86,14 @@ func (r *ParticipationStatusDB) GetParticipationStatusByID(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllParticipationStatus lists the participation statuses, optionally of
+// one event, leaving deleted ones out unless ?include_deleted=true.
 func (r *ParticipationStatusDB) GetAllParticipationStatus(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -102,7 +121,7 @@ func (r *ParticipationStatusDB) GetAllParticipationStatus(ctx *gin.Context) {
 		return
 	}
 
-	u, err := getAllParticipationStatus(r, ctx, intSkip, intLimit, eventID)
+	u, err := getAllParticipationStatus(r, ctx, intSkip, intLimit, eventID, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -134,15 +153,61 @@ func (r *ParticipationStatusDB) CreateNewParticipationStatus(ctx *gin.Context) {
 		return
 	}
 
-	if err := createNewParticipationStatus(r, ctx, s); err != nil {
+	if err := checkRegistrationOpen(r, ctx, *s.EventID, *s.ParticipationOption); err != nil {
+		if !respondRegistrationRefused(ctx, err) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+		}
+		return
+	}
+
+	eligibility, err := checkAudience(r, ctx, *s.EventID, *s.ParticipantID)
+	if err != nil {
+		if err.Error() == "event not found" || err.Error() == "participant not found" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
 		})
 		return
 	}
+	if !eligibility.Eligible {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":        "participant is not in the audience of this event",
+			"failed_rules": eligibility.FailedRules,
+			"success":      false,
+		})
+		return
+	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Participation Status!", "data": s, "success": true})
+	id, err := createNewParticipationStatus(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getParticipationStatusByID(r, ctx, fmt.Sprint(id), false)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, fmt.Sprint(id)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new Participation Status!", "data": u, "success": true})
 }
 
 func (r *ParticipationStatusDB) UpdateParticipationStatusByID(ctx *gin.Context) {
@@ -157,7 +222,52 @@ func (r *ParticipationStatusDB) UpdateParticipationStatusByID(ctx *gin.Context)
 
 	id := ctx.Param("id")
 
-	if err := updateParticipationStatusByID(r, ctx, u, id); err != nil {
+	// Moving the registration to another event, option or participant needs
+	// the checks registering there would: that registration is open and
+	// that the participant is in the audience of the event.
+	if u.EventID != nil || u.ParticipationOption != nil || u.ParticipantID != nil {
+		move, err := moveOf(r, ctx, id, u)
+		if err == nil && move.toOtherWindow {
+			err = checkRegistrationOpen(r, ctx, move.eventID, move.option)
+		}
+		if err == nil && move.toOtherAudience {
+			var eligibility audience.Result
+			eligibility, err = checkAudience(r, ctx, move.eventID, move.participantID)
+			if err == nil && !eligibility.Eligible {
+				ctx.JSON(http.StatusForbidden, gin.H{
+					"error":        "participant is not in the audience of this event",
+					"failed_rules": eligibility.FailedRules,
+					"success":      false,
+				})
+				return
+			}
+		}
+		if err != nil {
+			if err.Error() == "not found" {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"error":   err.Error(),
+					"success": false,
+				})
+				return
+			}
+			if err.Error() == "participant not found" {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"error":   err.Error(),
+					"success": false,
+				})
+				return
+			}
+			if !respondRegistrationRefused(ctx, err) {
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"error":   err.Error(),
+					"success": false,
+				})
+			}
+			return
+		}
+	}
+
+	if err := updateParticipationStatusByID(r, ctx, u, id, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -167,6 +277,14 @@ func (r *ParticipationStatusDB) UpdateParticipationStatusByID(ctx *gin.Context)
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -181,14 +299,39 @@ func (r *ParticipationStatusDB) UpdateParticipationStatusByID(ctx *gin.Context)
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Participation Status updated successfully", "data": u, "success": true})
+
+	updated, err := getParticipationStatusByID(r, ctx, id, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participation Status updated successfully", "data": updated, "success": true})
 }
 
 func (r *ParticipationStatusDB) DeleteParticipationStatusByID(ctx *gin.Context) {
 
 	id := ctx.Param("id")
 
-	if err := deleteParticipationStatusByID(r, ctx, id); err != nil {
+	if err := deleteParticipationStatusByID(r, ctx, id, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -199,7 +342,61 @@ func (r *ParticipationStatusDB) DeleteParticipationStatusByID(ctx *gin.Context)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Participation Status deleted successfully!", "success": true})
 }
 
-func getParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, id string) (participationStatusResponse, error) {
+// RestoreParticipationStatusByID restores the participation status, as long as
+// neither its event nor its participant is deleted.
+func (r *ParticipationStatusDB) RestoreParticipationStatusByID(ctx *gin.Context) {
+
+	id := ctx.Param("id")
+
+	if err := restoreParticipationStatusByID(r, ctx, id); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" || err.Error() == "event or participant deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Participation Status restored successfully!", "success": true})
+}
+
+// respondRegistrationRefused answers the errors of checkRegistrationOpen
+// that refuse the registration, and reports whether err was one of them.
+func respondRegistrationRefused(ctx *gin.Context, err error) bool {
+	if rerr, ok := err.(registrationError); ok {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":                  rerr.Message,
+			"registration_status":    rerr.Status,
+			"registration_opens_at":  rerr.OpensAt,
+			"registration_closes_at": rerr.ClosesAt,
+			"success":                false,
+		})
+		return true
+	}
+	if err.Error() == "event not found" || err.Error() == "participation option not offered for this event" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return true
+	}
+	return false
+}
+
+func getParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, id string, includeDeleted bool) (participationStatusResponse, error) {
 	u := participationStatusResponse{}
 	if err := r.db.QueryRow(ctx, `select 
 	id,
@@ -209,9 +406,11 @@ func getParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, id s
 	confirmed,
 	registration_date,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
-	from participation_status where id = $1`, id).Scan(
+	from participation_status where id = $1 and ($2 or coalesce(deleted, false) = false)`, id, includeDeleted).Scan(
 		&u.ID,
 		&u.ParticipationOption,
 		&u.ParticipantID,
@@ -219,6 +418,8 @@ func getParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, id s
 		&u.Confirmed,
 		&u.RegistrationDate,
 		&u.Deleted,
+		&u.DeletedAt,
+		&u.DeletedBy,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	); err != nil {
@@ -230,11 +431,11 @@ func getParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, id s
 	return u, nil
 }
 
-func getAllParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, skip int, limit int, eventID string) (*[]participationStatusResponse, error) {
+func getAllParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, skip int, limit int, eventID string, includeDeleted bool) (*[]participationStatusResponse, error) {
 
 	u := []participationStatusResponse{}
 
-	userDbWhereQuery, orderByQuery := buildAndGetWhereQuery(eventID)
+	userDbWhereQuery, orderByQuery, whereArgs := buildAndGetWhereQuery(eventID, includeDeleted)
 
 	rows, err := r.db.Query(ctx, `select 
 	id,
@@ -244,11 +445,13 @@ func getAllParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, skip
 	confirmed,
 	registration_date,
 	deleted,
+	deleted_at,
+	deleted_by,
 	created_at,
 	updated_at 
 	from participation_status`+userDbWhereQuery+
 		orderByQuery+
-		" LIMIT $1 OFFSET $2", limit, skip)
+		" LIMIT $1 OFFSET $2", append([]interface{}{limit, skip}, whereArgs...)...)
 	if err != nil {
 		fmt.Println("--error-while-executing-query", err)
 		return &u, err
@@ -256,7 +459,7 @@ func getAllParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, skip
 	defer rows.Close()
 	for rows.Next() {
 		var d participationStatusResponse
-		err := rows.Scan(&d.ID, &d.ParticipationOption, &d.ParticipantID, &d.EventID, &d.Confirmed, &d.RegistrationDate, &d.Deleted, &d.CreatedAt, &d.UpdatedAt)
+		err := rows.Scan(&d.ID, &d.ParticipationOption, &d.ParticipantID, &d.EventID, &d.Confirmed, &d.RegistrationDate, &d.Deleted, &d.DeletedAt, &d.DeletedBy, &d.CreatedAt, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -265,19 +468,19 @@ func getAllParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, skip
 	return &u, rows.Err()
 }
 
-func updateParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, req participationStatus, id string) error {
+func updateParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, req participationStatus, id string, ifMatch []time.Time) error {
 
 	toUpdate, toUpdateArgs := prepareParticipationStatusUpdateQuery(req)
 
 	if len(toUpdateArgs) != 0 {
-		updateRes, err := r.db.Exec(ctx, fmt.Sprintf(`UPDATE participation_status SET %s WHERE id=%s`, toUpdate, id),
-			toUpdateArgs...)
+		updateRes, err := audit.Exec(ctx, r.db, fmt.Sprintf(`UPDATE participation_status SET %s WHERE id=$%d AND %s`, toUpdate, len(toUpdateArgs)+1, etag.Condition(len(toUpdateArgs)+2)),
+			append(toUpdateArgs, id, ifMatch)...)
 		if err != nil {
 			return fmt.Errorf("problem updating Participation Status: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from participation_status where id = $1)`, id)
 		}
 
 		return nil
@@ -286,26 +489,59 @@ func updateParticipationStatusByID(r *ParticipationStatusDB, ctx *gin.Context, r
 	}
 }
 
-func createNewParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, req participationStatus) error {
+func createNewParticipationStatus(r *ParticipationStatusDB, ctx *gin.Context, req participationStatus) (int, error) {
 
 	createString, numString, createQueryArgs := prepareParticipationStatusCreateQuery(req)
 
 	if len(createQueryArgs) != 0 {
-		_, err := r.db.Exec(ctx, fmt.Sprintf(`INSERT INTO participation_status (%s) VALUES (%s)`, createString, numString),
-			createQueryArgs...)
-		if err != nil {
-			return fmt.Errorf("problem creating participation status: %w", err)
+		var id int
+		if err := audit.QueryRow(ctx, r.db, fmt.Sprintf(`INSERT INTO participation_status (%s) VALUES (%s) RETURNING id`, createString, numString),
+			createQueryArgs...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("problem creating participation status: %w", err)
 		}
 
-		return nil
+		return id, nil
 	} else {
-		return fmt.Errorf("invalid values")
+		return 0, fmt.Errorf("invalid values")
 	}
 }
 
-func deleteParticipationStatusByID(r *ParticipationStatusDB, ctx context.Context, id string) error {
-	_, err := r.db.Exec(ctx, "delete from participation_status where id=$1", id)
-	return err
+func deleteParticipationStatusByID(r *ParticipationStatusDB, ctx context.Context, id string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE participation_status SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE id = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), id, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from participation_status where id = $1 and coalesce(deleted, false) = false)`, id)
+	}
+	return nil
+}
+
+func restoreParticipationStatusByID(r *ParticipationStatusDB, ctx context.Context, id string) error {
+	return txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		var deleted, parentDeleted bool
+		if err := tx.QueryRow(ctx, `select coalesce(ps.deleted, false), coalesce(e.deleted, false) or coalesce(p.deleted, false) 
+		from participation_status ps 
+		join event e on e.id = ps.event_id 
+		join participant p on p.id = ps.participant_id 
+		where ps.id = $1
+		for update of ps for share of e, p`, id).Scan(&deleted, &parentDeleted); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("not deleted")
+		}
+		if parentDeleted {
+			return fmt.Errorf("event or participant deleted")
+		}
+
+		_, err := tx.Exec(ctx, `UPDATE participation_status SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE id = $1`, id)
+		return err
+	})
 }
 
 func prepareParticipationStatusUpdateQuery(req participationStatus) (string, []interface{}) {
@@ -332,10 +568,6 @@ func prepareParticipationStatusUpdateQuery(req participationStatus) (string, []i
 		updateStrings = append(updateStrings, fmt.Sprintf("registration_date=$%d", len(updateStrings)+1))
 		args = append(args, *req.RegistrationDate)
 	}
-	if req.Deleted != nil {
-		updateStrings = append(updateStrings, fmt.Sprintf("deleted=$%d", len(updateStrings)+1))
-		args = append(args, *req.Deleted)
-	}
 	if len(args) != 0 {
 		updateStrings = append(updateStrings, fmt.Sprintf("updated_at=$%d", len(updateStrings)+1))
 		args = append(args, time.Now())
@@ -376,11 +608,6 @@ func prepareParticipationStatusCreateQuery(req participationStatus) (string, str
 		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
 		args = append(args, *req.RegistrationDate)
 	}
-	if req.Deleted != nil {
-		createStrings = append(createStrings, "deleted")
-		numString = append(numString, fmt.Sprintf("$%d", len(numString)+1))
-		args = append(args, *req.Deleted)
-	}
 
 	concatedCreateString := strings.Join(createStrings, ",")
 	concatedNumString := strings.Join(numString, ",")
@@ -388,17 +615,27 @@ func prepareParticipationStatusCreateQuery(req participationStatus) (string, str
 	return concatedCreateString, concatedNumString, args
 }
 
-func buildAndGetWhereQuery(eventID string) (string, string) {
+// buildAndGetWhereQuery returns the WHERE and ORDER BY clauses of the list
+// query, and the arguments of the WHERE clause, which follow LIMIT and OFFSET.
+func buildAndGetWhereQuery(eventID string, includeDeleted bool) (string, string, []interface{}) {
 
 	var whereString strings.Builder
 	var orderBy strings.Builder
 	var whereCondition strings.Builder
+	var args []interface{}
 	whereString.WriteString(" WHERE")
 	whereCondition.WriteString("")
 
 	// WHERE query generation based on parameters
 	if eventID != "" {
-		whereCondition.WriteString(fmt.Sprintf(" event_id=%s", eventID))
+		args = append(args, eventID)
+		whereCondition.WriteString(fmt.Sprintf(" event_id=$%d", len(args)+2))
+	}
+	if !includeDeleted {
+		if whereCondition.String() != "" {
+			whereCondition.WriteString(" AND")
+		}
+		whereCondition.WriteString(" coalesce(deleted, false)=false")
 	}
 
 	orderBy.WriteString(fmt.Sprintf(" ORDER BY created_at %s", "asc"))
@@ -408,5 +645,5 @@ func buildAndGetWhereQuery(eventID string) (string, string) {
 	} else {
 		whereString.Reset()
 	}
-	return whereString.String(), orderBy.String()
+	return whereString.String(), orderBy.String(), args
 }
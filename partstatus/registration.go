@@ -0,0 +1,125 @@
+package partstatus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"vh-srv-event/audience"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// registrationError explains why a registration is refused, with the status
+// and window that caused it.
+type registrationError struct {
+	Message  string
+	Status   string
+	OpensAt  *time.Time
+	ClosesAt *time.Time
+}
+
+func (e registrationError) Error() string {
+	return e.Message
+}
+
+// checkRegistrationOpen refuses registrations to a deleted event, to an
+// option the event does not offer, and to an event or option whose
+// registration is not open or whose window does not contain the current time.
+func checkRegistrationOpen(r *ParticipationStatusDB, ctx context.Context, eventID int, option string) error {
+	var deleted bool
+	var eventStatus string
+	var eventOpensAt, eventClosesAt *time.Time
+	if err := r.db.QueryRow(ctx, `select coalesce(deleted, false), registration_status, registration_opens_at, registration_closes_at
+		from event where id = $1`, eventID).Scan(&deleted, &eventStatus, &eventOpensAt, &eventClosesAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("event not found")
+		}
+		return err
+	}
+	if deleted {
+		return fmt.Errorf("event not found")
+	}
+	if err := checkWindow("event", eventStatus, eventOpensAt, eventClosesAt); err != nil {
+		return err
+	}
+
+	var optionStatus string
+	var optionOpensAt, optionClosesAt *time.Time
+	if err := r.db.QueryRow(ctx, `select registration_status, registration_opens_at, registration_closes_at
+		from event_participation_option
+		where event_id = $1 and participation_option = $2 and coalesce(deleted, false) = false
+		order by id desc limit 1`, eventID, option).Scan(&optionStatus, &optionOpensAt, &optionClosesAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("participation option not offered for this event")
+		}
+		return err
+	}
+	return checkWindow("participation option", optionStatus, optionOpensAt, optionClosesAt)
+}
+
+// registrationMove is where an update takes a registration.
+type registrationMove struct {
+	eventID       int
+	participantID int
+	option        string
+	// toOtherWindow is set when the update changes the event or the option,
+	// whose registration then has to be open, and toOtherAudience when it
+	// changes the event or the participant, who then has to be in the
+	// audience of the event.
+	toOtherWindow   bool
+	toOtherAudience bool
+}
+
+// moveOf returns where req takes the registration id, keeping the values of
+// the fields req leaves out.
+func moveOf(r *ParticipationStatusDB, ctx context.Context, id string, req participationStatus) (registrationMove, error) {
+	m := registrationMove{}
+	if err := r.db.QueryRow(ctx, `select event_id, participant_id, participation_option from participation_status where id = $1`, id).Scan(&m.eventID, &m.participantID, &m.option); err != nil {
+		if err == pgx.ErrNoRows {
+			return registrationMove{}, fmt.Errorf("not found")
+		}
+		return registrationMove{}, err
+	}
+	if req.EventID != nil && *req.EventID != m.eventID {
+		m.eventID = *req.EventID
+		m.toOtherWindow = true
+		m.toOtherAudience = true
+	}
+	if req.ParticipantID != nil && *req.ParticipantID != m.participantID {
+		m.participantID = *req.ParticipantID
+		m.toOtherAudience = true
+	}
+	if req.ParticipationOption != nil && *req.ParticipationOption != m.option {
+		m.option = *req.ParticipationOption
+		m.toOtherWindow = true
+	}
+	return m, nil
+}
+
+func checkWindow(subject string, status string, opensAt *time.Time, closesAt *time.Time) error {
+	now := time.Now()
+	switch {
+	case status == "cancelled":
+		return registrationError{"registration for this " + subject + " is cancelled", status, opensAt, closesAt}
+	case opensAt != nil && now.Before(*opensAt):
+		return registrationError{"registration for this " + subject + " opens at " + opensAt.UTC().Format(time.RFC3339), status, opensAt, closesAt}
+	case closesAt != nil && !now.Before(*closesAt):
+		return registrationError{"registration for this " + subject + " closed at " + closesAt.UTC().Format(time.RFC3339), status, opensAt, closesAt}
+	case status != "open":
+		return registrationError{"registration for this " + subject + " is closed", status, opensAt, closesAt}
+	}
+	return nil
+}
+
+// checkAudience evaluates the audience of the event for the participant.
+func checkAudience(r *ParticipationStatusDB, ctx context.Context, eventID int, participantID int) (audience.Result, error) {
+	var name string
+	if err := r.db.QueryRow(ctx, `select audience from event where id = $1`, eventID).Scan(&name); err != nil {
+		if err == pgx.ErrNoRows {
+			return audience.Result{}, fmt.Errorf("event not found")
+		}
+		return audience.Result{}, err
+	}
+	return r.audiences.Check(ctx, name, fmt.Sprint(participantID))
+}
@@ -4,7 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"time"
+
+	"vh-srv-event/actor"
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -13,7 +20,10 @@ import (
 )
 
 type platformResponse struct {
-	Name *string `json:"name" db:"name"`
+	Name      *string    `json:"name" db:"name"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	DeletedBy *string    `json:"deleted_by,omitempty" db:"deleted_by"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type platform struct {
@@ -26,6 +36,7 @@ type Platform interface {
 	CreateNewPlatform(ctx *gin.Context)
 	UpdatePlatformByName(ctx *gin.Context)
 	DeletePlatformByName(ctx *gin.Context)
+	RestorePlatformByName(ctx *gin.Context)
 }
 
 type PlatformDB struct {
@@ -38,10 +49,12 @@ func NewPlatform(db *pgxpool.Pool) Platform {
 	}
 }
 
+// GetPlatformByName returns the platform, or 404 when it is deleted unless
+// ?include_deleted=true.
 func (r *PlatformDB) GetPlatformByName(ctx *gin.Context) {
 	name := ctx.Param("name")
 
-	u, err := getPlatformByName(r, ctx, name)
+	u, err := getPlatformByName(r, ctx, name, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		if err.Error() == "not found" {
@@ -57,9 +70,14 @@ func (r *PlatformDB) GetPlatformByName(ctx *gin.Context) {
 		})
 		return
 	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
 }
 
+// GetAllPlatform lists the platforms, leaving deleted ones out unless
+// ?include_deleted=true.
 func (r *PlatformDB) GetAllPlatform(ctx *gin.Context) {
 	skip := ctx.Query("skip")
 	limit := ctx.Query("limit")
@@ -86,7 +104,7 @@ func (r *PlatformDB) GetAllPlatform(ctx *gin.Context) {
 		return
 	}
 
-	u, err := GetAllPlatform(r, ctx, intSkip, intLimit)
+	u, err := GetAllPlatform(r, ctx, intSkip, intLimit, ctx.Query("include_deleted") == "true")
 
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -118,7 +136,17 @@ func (r *PlatformDB) CreateNewPlatform(ctx *gin.Context) {
 		return
 	}
 
-	if err := CreateNewPlatform(r, ctx, s); err != nil {
+	name, err := CreateNewPlatform(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getPlatformByName(r, ctx, name, false)
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -126,7 +154,9 @@ func (r *PlatformDB) CreateNewPlatform(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new platform!", "data": s, "success": true})
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, url.PathEscape(name)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new platform!", "data": u, "success": true})
 }
 
 func (r *PlatformDB) UpdatePlatformByName(ctx *gin.Context) {
@@ -141,7 +171,7 @@ func (r *PlatformDB) UpdatePlatformByName(ctx *gin.Context) {
 
 	name := ctx.Param("name")
 
-	if err := UpdatePlatformByName(r, ctx, u, name); err != nil {
+	if err := UpdatePlatformByName(r, ctx, u, name, etag.IfMatch(ctx)); err != nil {
 
 		if err.Error() == "not found" {
 			ctx.JSON(http.StatusNotFound, gin.H{
@@ -151,6 +181,14 @@ func (r *PlatformDB) UpdatePlatformByName(ctx *gin.Context) {
 			return
 		}
 
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
 		if err.Error() == "invalid values" {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error":   err.Error(),
@@ -165,14 +203,44 @@ func (r *PlatformDB) UpdatePlatformByName(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "platform updated successfully", "data": u, "success": true})
+
+	if u.Name != nil {
+		name = *u.Name
+	}
+	updated, err := getPlatformByName(r, ctx, name, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "platform updated successfully", "data": updated, "success": true})
 }
 
+// DeletePlatformByName soft deletes the platform. Its broadcast urls keep
+// referring to it.
 func (r *PlatformDB) DeletePlatformByName(ctx *gin.Context) {
 
 	name := ctx.Param("name")
 
-	if err := DeletePlatformByName(r, ctx, name); err != nil {
+	if err := DeletePlatformByName(r, ctx, name, actor.FromContext(ctx), etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error":   err.Error(),
 			"success": false,
@@ -183,12 +251,47 @@ func (r *PlatformDB) DeletePlatformByName(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "platform deleted successfully!", "success": true})
 }
 
-func getPlatformByName(r *PlatformDB, ctx *gin.Context, name string) (platformResponse, error) {
+func (r *PlatformDB) RestorePlatformByName(ctx *gin.Context) {
+
+	name := ctx.Param("name")
+
+	if err := RestorePlatformByName(r, ctx, name); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "not deleted" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "platform restored successfully!", "success": true})
+}
+
+func getPlatformByName(r *PlatformDB, ctx *gin.Context, name string, includeDeleted bool) (platformResponse, error) {
 	u := platformResponse{}
 	if err := r.db.QueryRow(ctx, `select 
-	name 
-	from platform where name = $1`, name).Scan(
+	name,
+	deleted_at,
+	deleted_by,
+	updated_at 
+	from platform where name = $1 and ($2 or coalesce(deleted, false) = false)`, name, includeDeleted).Scan(
 		&u.Name,
+		&u.DeletedAt,
+		&u.DeletedBy,
+		&u.UpdatedAt,
 	); err != nil {
 		if err == pgx.ErrNoRows {
 			return platformResponse{}, fmt.Errorf("not found")
@@ -198,15 +301,18 @@ func getPlatformByName(r *PlatformDB, ctx *gin.Context, name string) (platformRe
 	return u, nil
 }
 
-func GetAllPlatform(r *PlatformDB, ctx *gin.Context, skip int, limit int) (*[]platformResponse, error) {
+func GetAllPlatform(r *PlatformDB, ctx *gin.Context, skip int, limit int, includeDeleted bool) (*[]platformResponse, error) {
 
 	u := []platformResponse{}
 	rows, _ := r.db.Query(ctx, fmt.Sprintf(`select 
-	name 
-	from platform LIMIT %d OFFSET %d`, limit, skip))
+	name,
+	deleted_at,
+	deleted_by,
+	updated_at 
+	from platform where $1 or coalesce(deleted, false) = false LIMIT %d OFFSET %d`, limit, skip), includeDeleted)
 	for rows.Next() {
 		var d platformResponse
-		err := rows.Scan(&d.Name)
+		err := rows.Scan(&d.Name, &d.DeletedAt, &d.DeletedBy, &d.UpdatedAt)
 		if err != nil {
 			return &u, err
 		}
@@ -215,15 +321,15 @@ func GetAllPlatform(r *PlatformDB, ctx *gin.Context, skip int, limit int) (*[]pl
 	return &u, rows.Err()
 }
 
-func UpdatePlatformByName(r *PlatformDB, ctx *gin.Context, req platform, name string) error {
+func UpdatePlatformByName(r *PlatformDB, ctx *gin.Context, req platform, name string, ifMatch []time.Time) error {
 	if req.Name != nil {
-		updateRes, err := r.db.Exec(ctx, `UPDATE platform SET name=$1 WHERE name=$2`, req.Name, name)
+		updateRes, err := audit.Exec(ctx, r.db, `UPDATE platform SET name=$1, updated_at = now() WHERE name=$2 AND `+etag.Condition(3), req.Name, name, ifMatch)
 		if err != nil {
 			return fmt.Errorf("problem updating platform: %w", err)
 		}
 
 		if updateRes.RowsAffected() == 0 {
-			return fmt.Errorf("not found")
+			return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from platform where name = $1)`, name)
 		}
 
 		return nil
@@ -232,18 +338,43 @@ func UpdatePlatformByName(r *PlatformDB, ctx *gin.Context, req platform, name st
 	}
 }
 
-func CreateNewPlatform(r *PlatformDB, ctx *gin.Context, req platform) error {
-	_, err := r.db.Exec(ctx,
+func CreateNewPlatform(r *PlatformDB, ctx *gin.Context, req platform) (string, error) {
+	var name string
+	err := audit.QueryRow(ctx, r.db,
 		`INSERT INTO platform (
 			name)
 		VALUES (
-			$1)  `,
-		*req.Name)
+			$1)
+		RETURNING name`,
+		*req.Name).Scan(&name)
 
-	return err
+	return name, err
 }
 
-func DeletePlatformByName(r *PlatformDB, ctx context.Context, name string) error {
-	_, err := r.db.Exec(ctx, "delete from platform where name=$1", name)
+func DeletePlatformByName(r *PlatformDB, ctx context.Context, name string, by *string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, `UPDATE platform SET deleted = true, deleted_at = now(), deleted_by = $2, updated_at = now() 
+	WHERE name = $1 AND coalesce(deleted, false) = false AND `+etag.Condition(3), name, by, ifMatch)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from platform where name = $1 and coalesce(deleted, false) = false)`, name)
+	}
+	return nil
+}
+
+func RestorePlatformByName(r *PlatformDB, ctx context.Context, name string) error {
+	var deleted bool
+	if err := r.db.QueryRow(ctx, `select coalesce(deleted, false) from platform where name = $1`, name).Scan(&deleted); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("not found")
+		}
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("not deleted")
+	}
+
+	_, err := audit.Exec(ctx, r.db, `UPDATE platform SET deleted = false, deleted_at = null, deleted_by = null, updated_at = now() WHERE name = $1`, name)
 	return err
 }
@@ -0,0 +1,333 @@
+package recurrence
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxOccurrences bounds how many dates a single expansion may produce, so
+// that an unbounded rule cannot materialize an unbounded number of events.
+const MaxOccurrences = 1000
+
+// maxPeriods stops the expansion of rules that never match (e.g. the 31st of
+// every second month starting in February).
+const maxPeriods = 10000
+
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	Yearly  Frequency = "YEARLY"
+)
+
+// WeekdayNum is a BYDAY entry. N is the ordinal within the month (1TU is the
+// first Tuesday, -1FR the last Friday); 0 means every such weekday.
+type WeekdayNum struct {
+	Day time.Weekday
+	N   int
+}
+
+// Rule is the subset of RFC 5545 recurrence rules supported for event
+// series: FREQ, INTERVAL, COUNT, UNTIL, BYDAY and BYMONTHDAY. Weeks start on
+// Monday.
+type Rule struct {
+	Freq       Frequency
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+}
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH;COUNT=10".
+// A leading "RRULE:" is accepted.
+func Parse(s string) (*Rule, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	r := &Rule{Interval: 1}
+
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		switch key {
+		case "FREQ":
+			switch f := Frequency(value); f {
+			case Daily, Weekly, Monthly, Yearly:
+				r.Freq = f
+			default:
+				return nil, fmt.Errorf("unsupported FREQ %q", value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid COUNT %q", value)
+			}
+			r.Count = n
+		case "UNTIL":
+			t, err := parseUntil(value)
+			if err != nil {
+				return nil, err
+			}
+			r.Until = &t
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				wd, err := parseWeekdayNum(d)
+				if err != nil {
+					return nil, err
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %q", d)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "WKST":
+			if value != "MO" {
+				return nil, fmt.Errorf("unsupported WKST %q", value)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported rule part %q", key)
+		}
+	}
+
+	if r.Freq == "" {
+		return nil, fmt.Errorf("FREQ is required")
+	}
+	if r.Count != 0 && r.Until != nil {
+		return nil, fmt.Errorf("COUNT and UNTIL cannot be combined")
+	}
+	if len(r.ByMonthDay) != 0 && r.Freq != Monthly {
+		return nil, fmt.Errorf("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	for _, wd := range r.ByDay {
+		if wd.N != 0 && r.Freq != Monthly {
+			return nil, fmt.Errorf("BYDAY ordinals are only supported with FREQ=MONTHLY")
+		}
+	}
+	if len(r.ByDay) != 0 && r.Freq == Yearly {
+		return nil, fmt.Errorf("BYDAY is not supported with FREQ=YEARLY")
+	}
+	return r, nil
+}
+
+func parseUntil(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			if layout == "20060102" {
+				// A date-only UNTIL includes the whole day.
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", s)
+}
+
+func parseWeekdayNum(s string) (WeekdayNum, error) {
+	if len(s) < 2 {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", s)
+	}
+	day, ok := weekdays[s[len(s)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", s)
+	}
+	n := 0
+	if prefix := s[:len(s)-2]; prefix != "" {
+		var err error
+		n, err = strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", s)
+		}
+	}
+	return WeekdayNum{day, n}, nil
+}
+
+// Occurrences expands the rule from dtstart and returns the start times up to
+// and including until, at most MaxOccurrences of them. Dates are computed in
+// dtstart's location so that the wall-clock time is kept across DST changes.
+// COUNT is always counted from dtstart, whatever until is.
+func (r *Rule) Occurrences(dtstart time.Time, until time.Time) []time.Time {
+	var out []time.Time
+	r.each(dtstart, until, func(t time.Time) bool {
+		out = append(out, t)
+		return len(out) < MaxOccurrences
+	})
+	return out
+}
+
+// Includes reports whether t is an occurrence of the rule expanded from
+// dtstart. Unlike Occurrences it is not bounded by MaxOccurrences.
+func (r *Rule) Includes(dtstart time.Time, t time.Time) bool {
+	found := false
+	r.each(dtstart, t, func(o time.Time) bool {
+		found = o.Equal(t)
+		return true
+	})
+	return found
+}
+
+// each calls yield with the occurrences of the rule from dtstart up to and
+// including until, in order, until it returns false.
+func (r *Rule) each(dtstart time.Time, until time.Time, yield func(time.Time) bool) {
+	if r.Until != nil && r.Until.Before(until) {
+		until = *r.Until
+	}
+
+	produced := 0
+	for period := 0; period < maxPeriods; period++ {
+		for _, t := range r.candidates(dtstart, period*r.Interval) {
+			if t.Before(dtstart) {
+				continue
+			}
+			if t.After(until) {
+				return
+			}
+			if r.Count != 0 && produced >= r.Count {
+				return
+			}
+			produced++
+			if !yield(t) {
+				return
+			}
+		}
+	}
+}
+
+// candidates returns the sorted dates of the period that lies offset units of
+// the rule frequency after the one containing dtstart.
+func (r *Rule) candidates(dtstart time.Time, offset int) []time.Time {
+	loc := dtstart.Location()
+	h, m, s := dtstart.Clock()
+	ns := dtstart.Nanosecond()
+	at := func(y int, mo time.Month, d int) time.Time {
+		return time.Date(y, mo, d, h, m, s, ns, loc)
+	}
+
+	var out []time.Time
+	switch r.Freq {
+	case Daily:
+		t := at(dtstart.Year(), dtstart.Month(), dtstart.Day()+offset)
+		if r.matchesWeekday(t.Weekday()) {
+			out = append(out, t)
+		}
+	case Weekly:
+		// Monday of the week containing dtstart, moved by offset weeks.
+		monday := dtstart.Day() - (int(dtstart.Weekday())+6)%7 + offset*7
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []WeekdayNum{{Day: dtstart.Weekday()}}
+		}
+		for _, wd := range days {
+			out = append(out, at(dtstart.Year(), dtstart.Month(), monday+(int(wd.Day)+6)%7))
+		}
+	case Monthly:
+		first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(offset), 1, 0, 0, 0, 0, loc)
+		y, mo := first.Year(), first.Month()
+		last := daysIn(y, mo)
+		switch {
+		case len(r.ByMonthDay) != 0:
+			for _, d := range r.ByMonthDay {
+				if d < 0 {
+					d = last + 1 + d
+				}
+				if d >= 1 && d <= last {
+					out = append(out, at(y, mo, d))
+				}
+			}
+		case len(r.ByDay) != 0:
+			for _, wd := range r.ByDay {
+				days := weekdaysInMonth(y, mo, wd.Day, loc)
+				switch {
+				case wd.N == 0:
+					for _, d := range days {
+						out = append(out, at(y, mo, d))
+					}
+				case wd.N > 0 && wd.N <= len(days):
+					out = append(out, at(y, mo, days[wd.N-1]))
+				case wd.N < 0 && -wd.N <= len(days):
+					out = append(out, at(y, mo, days[len(days)+wd.N]))
+				}
+			}
+		default:
+			// Months without dtstart's day of month are skipped, as in RFC 5545.
+			if dtstart.Day() <= last {
+				out = append(out, at(y, mo, dtstart.Day()))
+			}
+		}
+	case Yearly:
+		y := dtstart.Year() + offset
+		if dtstart.Day() <= daysIn(y, dtstart.Month()) {
+			out = append(out, at(y, dtstart.Month(), dtstart.Day()))
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Before(out[j]) })
+	return dedupe(out)
+}
+
+func (r *Rule) matchesWeekday(d time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day == d {
+			return true
+		}
+	}
+	return false
+}
+
+func daysIn(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// weekdaysInMonth returns the days of the month that fall on weekday d.
+func weekdaysInMonth(y int, m time.Month, d time.Weekday, loc *time.Location) []int {
+	first := time.Date(y, m, 1, 0, 0, 0, 0, loc).Weekday()
+	var days []int
+	for day := 1 + (int(d)-int(first)+7)%7; day <= daysIn(y, m); day += 7 {
+		days = append(days, day)
+	}
+	return days
+}
+
+func dedupe(ts []time.Time) []time.Time {
+	var out []time.Time
+	for i, t := range ts {
+		if i == 0 || !t.Equal(ts[i-1]) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
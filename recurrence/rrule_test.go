@@ -0,0 +1,211 @@
+package recurrence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccurrences(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name    string
+		rule    string
+		dtstart time.Time
+		until   time.Time
+		want    []time.Time
+	}{
+		{
+			name:    "weekly BYDAY",
+			rule:    "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=4",
+			dtstart: utc("2024-03-04T10:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-05T10:00:00Z"),
+				utc("2024-03-07T10:00:00Z"),
+				utc("2024-03-12T10:00:00Z"),
+				utc("2024-03-14T10:00:00Z"),
+			},
+		},
+		{
+			name:    "monthly last Friday",
+			rule:    "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			dtstart: utc("2024-01-01T18:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-01-26T18:00:00Z"),
+				utc("2024-02-23T18:00:00Z"),
+				utc("2024-03-29T18:00:00Z"),
+			},
+		},
+		{
+			name:    "monthly on the 31st skips shorter months",
+			rule:    "FREQ=MONTHLY;COUNT=4",
+			dtstart: utc("2024-01-31T09:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-01-31T09:00:00Z"),
+				utc("2024-03-31T09:00:00Z"),
+				utc("2024-05-31T09:00:00Z"),
+				utc("2024-07-31T09:00:00Z"),
+			},
+		},
+		{
+			name:    "monthly on the last day",
+			rule:    "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			dtstart: utc("2024-01-15T09:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-01-31T09:00:00Z"),
+				utc("2024-02-29T09:00:00Z"),
+				utc("2024-03-31T09:00:00Z"),
+			},
+		},
+		{
+			name:    "every second week",
+			rule:    "FREQ=WEEKLY;INTERVAL=2",
+			dtstart: utc("2024-03-04T10:00:00Z"),
+			until:   utc("2024-04-01T10:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-04T10:00:00Z"),
+				utc("2024-03-18T10:00:00Z"),
+				utc("2024-04-01T10:00:00Z"),
+			},
+		},
+		{
+			name:    "COUNT stops before until",
+			rule:    "FREQ=DAILY;COUNT=3",
+			dtstart: utc("2024-03-04T10:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-04T10:00:00Z"),
+				utc("2024-03-05T10:00:00Z"),
+				utc("2024-03-06T10:00:00Z"),
+			},
+		},
+		{
+			name:    "until stops before COUNT",
+			rule:    "FREQ=DAILY;COUNT=10",
+			dtstart: utc("2024-03-04T10:00:00Z"),
+			until:   utc("2024-03-05T10:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-04T10:00:00Z"),
+				utc("2024-03-05T10:00:00Z"),
+			},
+		},
+		{
+			name:    "date-only UNTIL includes the whole day",
+			rule:    "FREQ=DAILY;UNTIL=20240306",
+			dtstart: utc("2024-03-04T18:00:00Z"),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-04T18:00:00Z"),
+				utc("2024-03-05T18:00:00Z"),
+				utc("2024-03-06T18:00:00Z"),
+			},
+		},
+		{
+			name:    "wall-clock time is kept across DST",
+			rule:    "FREQ=WEEKLY;COUNT=2",
+			dtstart: time.Date(2024, time.March, 24, 10, 0, 0, 0, berlin),
+			until:   utc("2025-01-01T00:00:00Z"),
+			want: []time.Time{
+				utc("2024-03-24T09:00:00Z"),
+				utc("2024-03-31T08:00:00Z"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rule.Occurrences(tt.dtstart, tt.until)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d occurrences %v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("occurrence %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOccurrencesMax(t *testing.T) {
+	rule, err := Parse("FREQ=DAILY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtstart := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	got := rule.Occurrences(dtstart, dtstart.AddDate(10, 0, 0))
+	if len(got) != MaxOccurrences {
+		t.Errorf("got %d occurrences, want %d", len(got), MaxOccurrences)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dtstart := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		rule string
+		t    time.Time
+		want bool
+	}{
+		{"dtstart", "FREQ=DAILY", dtstart, true},
+		{"past MaxOccurrences", "FREQ=DAILY", dtstart.AddDate(0, 0, 1500), true},
+		{"other time of day", "FREQ=DAILY", dtstart.AddDate(0, 0, 3).Add(time.Hour), false},
+		{"before dtstart", "FREQ=DAILY", dtstart.AddDate(0, 0, -1), false},
+		{"other weekday", "FREQ=WEEKLY;BYDAY=MO", dtstart.AddDate(0, 0, 1), false},
+		{"after COUNT", "FREQ=DAILY;COUNT=3", dtstart.AddDate(0, 0, 3), false},
+		{"last of COUNT", "FREQ=DAILY;COUNT=3", dtstart.AddDate(0, 0, 2), true},
+		{"after UNTIL", "FREQ=DAILY;UNTIL=20240105", dtstart.AddDate(0, 0, 5), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.Includes(dtstart, tt.t); got != tt.want {
+				t.Errorf("Includes(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;COUNT=3;UNTIL=20240101",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=YEARLY;BYDAY=MO",
+		"FREQ=MONTHLY;BYDAY=6MO",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=WEEKLY;WKST=SU",
+		"FREQ=DAILY;BYHOUR=9",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Job is a unit of background work. It should be safe to run repeatedly.
+type Job interface {
+	Run(ctx context.Context) error
+}
+
+// Every runs job once immediately and then at each interval until ctx is
+// done. Errors are logged and do not stop the schedule. It blocks, so it is
+// meant to be started in its own goroutine.
+func Every(ctx context.Context, name string, interval time.Duration, job Job) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job.Run(ctx); err != nil {
+			log.Printf("%s: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
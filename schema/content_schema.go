@@ -0,0 +1,424 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"vh-srv-event/audit"
+	"vh-srv-event/etag"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type contentSchemaResponse struct {
+	Name      *string          `json:"name" db:"name"`
+	Schema    *json.RawMessage `json:"schema" db:"schema"`
+	CreatedAt *time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+type contentSchema struct {
+	Name   *string          `json:"name" db:"name" validate:"required"`
+	Schema *json.RawMessage `json:"schema" db:"schema" validate:"required"`
+}
+
+type ContentSchema interface {
+	GetContentSchemaByName(ctx *gin.Context)
+	GetAllContentSchema(ctx *gin.Context)
+	CreateNewContentSchema(ctx *gin.Context)
+	UpdateContentSchemaByName(ctx *gin.Context)
+	DeleteContentSchemaByName(ctx *gin.Context)
+}
+
+type ContentSchemaDB struct {
+	db *pgxpool.Pool
+}
+
+func NewContentSchema(db *pgxpool.Pool) ContentSchema {
+	return &ContentSchemaDB{
+		db,
+	}
+}
+
+// Registry validates event and item content against the schema registered
+// for their content type.
+type Registry struct {
+	db       *pgxpool.Pool
+	compiled *compiledSchemas
+}
+
+func NewRegistry(db *pgxpool.Pool) *Registry {
+	return &Registry{
+		db,
+		&compiledSchemas{schemas: map[string]compiledSchema{}},
+	}
+}
+
+// compiledSchemas keeps the last compiled version of each registered schema,
+// which is compiled again only once the registered one changes.
+type compiledSchemas struct {
+	mu      sync.Mutex
+	schemas map[string]compiledSchema
+}
+
+type compiledSchema struct {
+	raw    string
+	schema *Schema
+}
+
+func (c *compiledSchemas) get(name string, raw []byte) (*Schema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.schemas[name]; ok && cached.raw == string(raw) {
+		return cached.schema, nil
+	}
+	compiled, err := Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	c.schemas[name] = compiledSchema{string(raw), compiled}
+	return compiled, nil
+}
+
+// Validate checks content against the schema registered as contentType. It
+// returns ValidationErrors when the content does not conform and
+// "unknown content type" when nothing is registered under that name. A nil
+// content only checks that the content type exists.
+func (s *Registry) Validate(ctx context.Context, contentType string, content []byte) error {
+	var raw []byte
+	if err := s.db.QueryRow(ctx, `select schema from content_schema where name = $1`, contentType).Scan(&raw); err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("unknown content type")
+		}
+		return err
+	}
+	if content == nil {
+		return nil
+	}
+
+	compiled, err := s.compiled.get(contentType, raw)
+	if err != nil {
+		return fmt.Errorf("registered schema %q is invalid: %w", contentType, err)
+	}
+	return compiled.Validate(content)
+}
+
+func (r *ContentSchemaDB) GetContentSchemaByName(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	u, err := getContentSchemaByName(r, ctx, name)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	if etag.NotModified(ctx, u.UpdatedAt) {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func (r *ContentSchemaDB) GetAllContentSchema(ctx *gin.Context) {
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	u, err := getAllContentSchema(r, ctx, intSkip, intLimit)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func (r *ContentSchemaDB) CreateNewContentSchema(ctx *gin.Context) {
+	s := contentSchema{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if _, err := Compile(*s.Schema); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	name, err := createNewContentSchema(r, ctx, s)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := getContentSchemaByName(r, ctx, name)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.Header("Location", path.Join(ctx.Request.URL.Path, url.PathEscape(name)))
+	etag.Set(ctx, u.UpdatedAt)
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new content schema!", "data": u, "success": true})
+}
+
+func (r *ContentSchemaDB) UpdateContentSchemaByName(ctx *gin.Context) {
+	u := contentSchema{}
+	if err := ctx.ShouldBindJSON(&u); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	if u.Schema == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   "invalid values",
+			"success": false,
+		})
+		return
+	}
+
+	if _, err := Compile(*u.Schema); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	name := ctx.Param("name")
+
+	if err := updateContentSchemaByName(r, ctx, u, name, etag.IfMatch(ctx)); err != nil {
+
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	updated, err := getContentSchemaByName(r, ctx, name)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	etag.Set(ctx, updated.UpdatedAt)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Content schema updated successfully", "data": updated, "success": true})
+}
+
+func (r *ContentSchemaDB) DeleteContentSchemaByName(ctx *gin.Context) {
+
+	name := ctx.Param("name")
+
+	if err := deleteContentSchemaByName(r, ctx, name, etag.IfMatch(ctx)); err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "precondition failed" {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "content schema is in use" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Content schema deleted successfully!", "success": true})
+}
+
+func getContentSchemaByName(r *ContentSchemaDB, ctx *gin.Context, name string) (contentSchemaResponse, error) {
+	u := contentSchemaResponse{}
+	if err := r.db.QueryRow(ctx, `select
+	name,
+	schema,
+	created_at,
+	updated_at
+	from content_schema where name = $1`, name).Scan(
+		&u.Name,
+		&u.Schema,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return contentSchemaResponse{}, fmt.Errorf("not found")
+		}
+		return contentSchemaResponse{}, err
+	}
+	return u, nil
+}
+
+func getAllContentSchema(r *ContentSchemaDB, ctx *gin.Context, skip int, limit int) (*[]contentSchemaResponse, error) {
+
+	u := []contentSchemaResponse{}
+	rows, err := r.db.Query(ctx, `select
+	name,
+	schema,
+	created_at,
+	updated_at
+	from content_schema order by name asc LIMIT $1 OFFSET $2`, limit, skip)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d contentSchemaResponse
+		err := rows.Scan(&d.Name, &d.Schema, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return &u, err
+		}
+		u = append(u, d)
+	}
+	return &u, rows.Err()
+}
+
+func updateContentSchemaByName(r *ContentSchemaDB, ctx *gin.Context, req contentSchema, name string, ifMatch []time.Time) error {
+	updateRes, err := audit.Exec(ctx, r.db, `UPDATE content_schema SET schema=$1, updated_at=$2 WHERE name=$3 AND `+etag.Condition(4),
+		*req.Schema, time.Now(), name, ifMatch)
+	if err != nil {
+		return fmt.Errorf("problem updating content schema: %w", err)
+	}
+
+	if updateRes.RowsAffected() == 0 {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from content_schema where name = $1)`, name)
+	}
+
+	return nil
+}
+
+func createNewContentSchema(r *ContentSchemaDB, ctx *gin.Context, req contentSchema) (string, error) {
+	var name string
+	if err := audit.QueryRow(ctx, r.db,
+		`INSERT INTO content_schema (
+			name,
+			schema)
+		VALUES (
+			$1,
+			$2)
+		RETURNING name`,
+		*req.Name,
+		*req.Schema).Scan(&name); err != nil {
+		return "", fmt.Errorf("problem creating content schema: %w", err)
+	}
+	return name, nil
+}
+
+func deleteContentSchemaByName(r *ContentSchemaDB, ctx context.Context, name string, ifMatch []time.Time) error {
+	res, err := audit.Exec(ctx, r.db, "delete from content_schema where name=$1 and "+etag.Condition(2), name, ifMatch)
+	if err != nil {
+		// foreign_key_violation, from the events and items of that type.
+		var pgErr interface{ SQLState() string }
+		if errors.As(err, &pgErr) && pgErr.SQLState() == "23503" {
+			return fmt.Errorf("content schema is in use")
+		}
+		return err
+	}
+	if res.RowsAffected() == 0 && ifMatch != nil {
+		return etag.Missed(ctx, r.db, ifMatch, `select exists(select 1 from content_schema where name = $1)`, name)
+	}
+	return nil
+}
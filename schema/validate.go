@@ -0,0 +1,490 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is a compiled JSON Schema. The supported keywords are the ones
+// content blobs need: type, enum, const, properties, required,
+// additionalProperties, items, min/maxItems, min/maxLength, pattern, format,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf
+// and not. Annotations (title, description, $schema...) are ignored, and any
+// other keyword is rejected when compiling, so that a schema never passes
+// content that it was meant to reject.
+type Schema struct {
+	types                []string
+	enum                 []interface{}
+	constant             interface{}
+	hasConst             bool
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	noAdditional         bool
+	items                *Schema
+	minItems             *int
+	maxItems             *int
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	format               string
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	allOf                []*Schema
+	anyOf                []*Schema
+	oneOf                []*Schema
+	not                  *Schema
+}
+
+// ValidationError reports a single violation, located by a JSON Pointer into
+// the validated document.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var messages []string
+	for _, v := range e {
+		messages = append(messages, v.Path+": "+v.Message)
+	}
+	return "invalid content: " + strings.Join(messages, "; ")
+}
+
+// keywords are the keywords compile accepts: the ones it enforces, then the
+// annotations it ignores.
+var keywords = map[string]bool{
+	"type":                 true,
+	"enum":                 true,
+	"const":                true,
+	"properties":           true,
+	"required":             true,
+	"additionalProperties": true,
+	"items":                true,
+	"minItems":             true,
+	"maxItems":             true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"format":               true,
+	"minimum":              true,
+	"maximum":              true,
+	"exclusiveMinimum":     true,
+	"exclusiveMaximum":     true,
+	"allOf":                true,
+	"anyOf":                true,
+	"oneOf":                true,
+	"not":                  true,
+
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"deprecated":  true,
+	"readOnly":    true,
+	"writeOnly":   true,
+}
+
+// Compile parses a JSON Schema document.
+func Compile(raw []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	return compile(doc, "#")
+}
+
+func compile(doc interface{}, at string) (*Schema, error) {
+	s := &Schema{}
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		b, ok := doc.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s: schema must be an object or a boolean", at)
+		}
+		// true accepts everything, false accepts nothing.
+		if !b {
+			s.not = &Schema{}
+		}
+		return s, nil
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !keywords[name] {
+			return nil, fmt.Errorf("%s/%s: unsupported keyword", at, escape(name))
+		}
+	}
+
+	var err error
+	if t, ok := m["type"]; ok {
+		switch tv := t.(type) {
+		case string:
+			s.types = []string{tv}
+		case []interface{}:
+			for _, e := range tv {
+				str, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s/type: must be a string or an array of strings", at)
+				}
+				s.types = append(s.types, str)
+			}
+		default:
+			return nil, fmt.Errorf("%s/type: must be a string or an array of strings", at)
+		}
+		for _, typ := range s.types {
+			switch typ {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fmt.Errorf("%s/type: unknown type %q", at, typ)
+			}
+		}
+	}
+
+	if e, ok := m["enum"]; ok {
+		arr, ok := e.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/enum: must be an array", at)
+		}
+		s.enum = arr
+	}
+	if c, ok := m["const"]; ok {
+		s.constant = c
+		s.hasConst = true
+	}
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be an object", at)
+		}
+		s.properties = map[string]*Schema{}
+		for name, sub := range props {
+			if s.properties[name], err = compile(sub, at+"/properties/"+escape(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r, ok := m["required"]; ok {
+		arr, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be an array of strings", at)
+		}
+		for _, e := range arr {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: must be an array of strings", at)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+
+	if a, ok := m["additionalProperties"]; ok {
+		if b, isBool := a.(bool); isBool {
+			s.noAdditional = !b
+		} else if s.additionalProperties, err = compile(a, at+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+
+	if i, ok := m["items"]; ok {
+		if s.items, err = compile(i, at+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, dst := range map[string]**int{
+		"minItems":  &s.minItems,
+		"maxItems":  &s.maxItems,
+		"minLength": &s.minLength,
+		"maxLength": &s.maxLength,
+	} {
+		if v, ok := m[keyword]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 0 || f != math.Trunc(f) {
+				return nil, fmt.Errorf("%s/%s: must be a non-negative integer", at, keyword)
+			}
+			n := int(f)
+			*dst = &n
+		}
+	}
+
+	for keyword, dst := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+	} {
+		if v, ok := m[keyword]; ok {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s/%s: must be a number", at, keyword)
+			}
+			*dst = &f
+		}
+	}
+
+	if p, ok := m["pattern"]; ok {
+		str, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be a string", at)
+		}
+		if s.pattern, err = regexp.Compile(str); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %w", at, err)
+		}
+	}
+
+	if f, ok := m["format"]; ok {
+		str, ok := f.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/format: must be a string", at)
+		}
+		s.format = str
+	}
+
+	for keyword, dst := range map[string]*[]*Schema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	} {
+		if v, ok := m[keyword]; ok {
+			arr, ok := v.([]interface{})
+			if !ok || len(arr) == 0 {
+				return nil, fmt.Errorf("%s/%s: must be a non-empty array", at, keyword)
+			}
+			for i, sub := range arr {
+				c, err := compile(sub, fmt.Sprintf("%s/%s/%d", at, keyword, i))
+				if err != nil {
+					return nil, err
+				}
+				*dst = append(*dst, c)
+			}
+		}
+	}
+
+	if n, ok := m["not"]; ok {
+		if s.not, err = compile(n, at+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Validate checks a JSON document against the schema and returns every
+// violation found, or nil when the document is valid.
+func (s *Schema) Validate(raw []byte) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if err := decoder.Decode(&doc); err != nil {
+		return ValidationErrors{{Path: "", Message: "content is not valid JSON: " + err.Error()}}
+	}
+	if decoder.More() {
+		return ValidationErrors{{Path: "", Message: "content is not valid JSON: unexpected data after top-level value"}}
+	}
+
+	if errs := s.validate(doc, ""); len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Schema) validate(v interface{}, path string) ValidationErrors {
+	var errs ValidationErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.types) != 0 && !matchesAnyType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		return errs
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		fail("value does not match the constant")
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + escape(name)
+			if sub, ok := s.properties[name]; ok {
+				errs = append(errs, sub.validate(val[name], child)...)
+			} else if s.noAdditional {
+				errs = append(errs, ValidationError{Path: child, Message: "additional property is not allowed"})
+			} else if s.additionalProperties != nil {
+				errs = append(errs, s.additionalProperties.validate(val[name], child)...)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("expected at least %d items, got %d", *s.minItems, len(val))
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("expected at most %d items, got %d", *s.maxItems, len(val))
+		}
+		if s.items != nil {
+			for i, e := range val {
+				errs = append(errs, s.items.validate(e, path+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case string:
+		length := len([]rune(val))
+		if s.minLength != nil && length < *s.minLength {
+			fail("expected at least %d characters, got %d", *s.minLength, length)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("expected at most %d characters, got %d", *s.maxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("does not match pattern %q", s.pattern.String())
+		}
+		if s.format != "" && !matchesFormat(val, s.format) {
+			fail("is not a valid %s", s.format)
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && val > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && val <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && val >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		errs = append(errs, sub.validate(v, path)...)
+	}
+	if len(s.anyOf) != 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(v, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("does not match any of the allowed schemas")
+		}
+	}
+	if len(s.oneOf) != 0 {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(v, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("must match exactly one of the allowed schemas, matched %d", matches)
+		}
+	}
+	if s.not != nil && len(s.not.validate(v, path)) == 0 {
+		fail("matches a schema it must not match")
+	}
+
+	return errs
+}
+
+func matchesAnyType(v interface{}, types []string) bool {
+	for _, t := range types {
+		if t == typeOf(v) || (t == "number" && typeOf(v) == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func matchesFormat(v string, format string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, v)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", v)
+		return err == nil
+	case "email":
+		a, err := mail.ParseAddress(v)
+		return err == nil && a.Address == v
+	case "uri":
+		u, err := url.Parse(v)
+		return err == nil && u.Scheme != ""
+	}
+	// Unknown formats are annotations only.
+	return true
+}
+
+// escape encodes a property name as a JSON Pointer reference token.
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
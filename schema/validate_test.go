@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"not JSON", `{`, ""},
+		{"not an object", `"string"`, "#: schema must be an object or a boolean"},
+		{"unknown type", `{"type": "text"}`, `#/type: unknown type "text"`},
+		{"$ref", `{"$ref": "#/definitions/a"}`, "#/$ref: unsupported keyword"},
+		{"patternProperties", `{"patternProperties": {"^a": {}}}`, "#/patternProperties: unsupported keyword"},
+		{"uniqueItems", `{"type": "array", "uniqueItems": true}`, "#/uniqueItems: unsupported keyword"},
+		{"nested minProperties", `{"properties": {"a/b": {"minProperties": 1}}}`, "#/properties/a~1b/minProperties: unsupported keyword"},
+		{"negative minLength", `{"minLength": -1}`, "#/minLength: must be a non-negative integer"},
+		{"invalid pattern", `{"pattern": "("}`, ""},
+		{"empty anyOf", `{"anyOf": []}`, "#/anyOf: must be a non-empty array"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.schema))
+			if err == nil {
+				t.Fatal("Compile succeeded, want an error")
+			}
+			if tt.want != "" && err.Error() != tt.want {
+				t.Errorf("error = %q, want %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileAnnotations(t *testing.T) {
+	if _, err := Compile([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id": "https://example.com/event",
+		"$comment": "test",
+		"title": "Event",
+		"description": "An event",
+		"type": "object",
+		"properties": {"a": {"type": "string", "default": "x", "examples": ["y"], "deprecated": true, "readOnly": true, "writeOnly": false}}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		content string
+		want    ValidationErrors
+	}{
+		{"empty schema", `{}`, `{"a": [1, "b"]}`, nil},
+		{"true", `true`, `1`, nil},
+		{"false", `false`, `1`, ValidationErrors{{"", "matches a schema it must not match"}}},
+		{"invalid JSON", `{}`, `{`, ValidationErrors{{"", "content is not valid JSON: unexpected EOF"}}},
+		{"trailing data", `{}`, `{} {}`, ValidationErrors{{"", "content is not valid JSON: unexpected data after top-level value"}}},
+		{"type", `{"type": "string"}`, `1`, ValidationErrors{{"", "expected string, got integer"}}},
+		{"integer is a number", `{"type": "number"}`, `1`, nil},
+		{"number is not an integer", `{"type": "integer"}`, `1.5`, ValidationErrors{{"", "expected integer, got number"}}},
+		{"type list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"enum", `{"enum": ["a", 1]}`, `"b"`, ValidationErrors{{"", "value is not one of the allowed values"}}},
+		{"const", `{"const": {"a": 1}}`, `{"a": 1}`, nil},
+		{
+			"required and properties",
+			`{"type": "object", "required": ["name"], "properties": {"age": {"type": "integer", "minimum": 0}}}`,
+			`{"age": -1}`,
+			ValidationErrors{{"", `missing required property "name"`}, {"/age", "must be >= 0"}},
+		},
+		{
+			"additionalProperties false",
+			`{"properties": {"a": {}}, "additionalProperties": false}`,
+			`{"a": 1, "b": 2, "c~": 3}`,
+			ValidationErrors{{"/b", "additional property is not allowed"}, {"/c~0", "additional property is not allowed"}},
+		},
+		{
+			"additionalProperties schema",
+			`{"additionalProperties": {"type": "string"}}`,
+			`{"a": "x", "b": 2}`,
+			ValidationErrors{{"/b", "expected string, got integer"}},
+		},
+		{
+			"items",
+			`{"type": "array", "items": {"type": "string", "maxLength": 2}, "maxItems": 2}`,
+			`["ab", "abc", "a"]`,
+			ValidationErrors{{"", "expected at most 2 items, got 3"}, {"/1", "expected at most 2 characters, got 3"}},
+		},
+		{"minLength counts characters", `{"minLength": 3}`, `"éé"`, ValidationErrors{{"", "expected at least 3 characters, got 2"}}},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, `"A"`, ValidationErrors{{"", `does not match pattern "^[a-z]+$"`}}},
+		{"exclusiveMaximum", `{"exclusiveMaximum": 10}`, `10`, ValidationErrors{{"", "must be < 10"}}},
+		{"format date-time", `{"format": "date-time"}`, `"2024-03-04T10:00:00Z"`, nil},
+		{"format date", `{"format": "date"}`, `"2024-13-04"`, ValidationErrors{{"", "is not a valid date"}}},
+		{"format email", `{"format": "email"}`, `"Jane <jane@example.com>"`, ValidationErrors{{"", "is not a valid email"}}},
+		{"format uri", `{"format": "uri"}`, `"example.com"`, ValidationErrors{{"", "is not a valid uri"}}},
+		{"unknown format", `{"format": "color"}`, `"red"`, nil},
+		{
+			"anyOf",
+			`{"anyOf": [{"type": "string"}, {"type": "integer"}]}`,
+			`true`,
+			ValidationErrors{{"", "does not match any of the allowed schemas"}},
+		},
+		{
+			"oneOf",
+			`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`,
+			`1`,
+			ValidationErrors{{"", "must match exactly one of the allowed schemas, matched 2"}},
+		},
+		{
+			"allOf",
+			`{"allOf": [{"minimum": 1}, {"maximum": 2}]}`,
+			`3`,
+			ValidationErrors{{"", "must be <= 2"}},
+		},
+		{"not", `{"not": {"type": "null"}}`, `null`, ValidationErrors{{"", "matches a schema it must not match"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Validate([]byte(tt.content))
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			got, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("Validate = %v, want ValidationErrors", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompiledSchemas(t *testing.T) {
+	c := &compiledSchemas{schemas: map[string]compiledSchema{}}
+
+	first, err := c.get("event", []byte(`{"type": "object"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.get("event", []byte(`{"type": "object"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("unchanged schema was compiled again")
+	}
+
+	changed, err := c.get("event", []byte(`{"type": "array"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first {
+		t.Error("changed schema was not compiled again")
+	}
+	if changed.Validate([]byte(`[]`)) != nil {
+		t.Error("changed schema is not the one in use")
+	}
+
+	if _, err := c.get("item", []byte(`{"uniqueItems": true}`)); err == nil {
+		t.Error("invalid schema was accepted")
+	}
+}
@@ -0,0 +1,243 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// searchConfigs are the text search configurations text_search_config_name
+// in db/initial.sql maps languages to.
+var searchConfigs = []string{
+	"danish", "dutch", "english", "finnish", "french", "german", "hungarian", "italian",
+	"norwegian", "portuguese", "romanian", "russian", "spanish", "swedish", "turkish", "simple",
+}
+
+const headlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2"
+
+type searchResult struct {
+	Type     string     `json:"type"`
+	ID       int        `json:"id"`
+	Slug     *string    `json:"slug,omitempty"`
+	Name     *string    `json:"name"`
+	Language *string    `json:"language"`
+	StartsOn *time.Time `json:"starts_on"`
+	Audience *string    `json:"audience,omitempty"`
+	Rank     float64    `json:"rank"`
+	Headline *string    `json:"headline"`
+	Snippet  *string    `json:"snippet"`
+}
+
+type Search interface {
+	SearchAll(ctx *gin.Context)
+}
+
+type SearchDB struct {
+	db *pgxpool.Pool
+}
+
+func NewSearch(db *pgxpool.Pool) Search {
+	return &SearchDB{
+		db,
+	}
+}
+
+// SearchAll searches events and items, with their translations, for the
+// words of ?q, best match first. The words are stemmed with the configuration
+// of ?language, or with every configuration when it is not given, so that a
+// query matches content in any language. Results can be restricted by
+// ?type=event|item, by date with ?from and ?to (RFC 3339) and by ?audience.
+// Deleted events and templates are left out, and so are the events that are
+// not published and the items only found in such events, unless
+// ?include_unpublished=true.
+func (r *SearchDB) SearchAll(ctx *gin.Context) {
+	q := strings.TrimSpace(ctx.Query("q"))
+	if q == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "q is required", "success": false})
+		return
+	}
+
+	skip := ctx.Query("skip")
+	limit := ctx.Query("limit")
+
+	if skip == "" {
+		skip = "0"
+	}
+
+	if limit == "" {
+		limit = "10"
+	}
+
+	// String conversion to int
+	intSkip, err := strconv.Atoi(skip)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	// String conversion to int
+	intLimit, err := strconv.Atoi(limit)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	kind := ctx.Query("type")
+	if kind != "" && kind != "event" && kind != "item" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type value! Accepted values are event and item", "success": false})
+		return
+	}
+
+	filter := searchFilter{
+		Query:              q,
+		Language:           ctx.Query("language"),
+		Audience:           ctx.Query("audience"),
+		IncludeUnpublished: ctx.Query("include_unpublished") == "true",
+	}
+	for _, bound := range []struct {
+		param string
+		dest  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		s := ctx.Query(bound.param)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.param + " value! Accepted value is an RFC 3339 date", "success": false})
+			return
+		}
+		*bound.dest = &t
+	}
+
+	u, err := search(r, ctx, filter, kind, intSkip, intLimit)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+type searchFilter struct {
+	Query              string
+	Language           string
+	Audience           string
+	From               *time.Time
+	To                 *time.Time
+	IncludeUnpublished bool
+}
+
+func search(r *SearchDB, ctx context.Context, filter searchFilter, kind string, skip int, limit int) ([]searchResult, error) {
+	args := []interface{}{filter.Query}
+
+	// The query is built with constant configurations, rather than with the
+	// one of each row, so that the expression indexes can be used.
+	var queries []string
+	if filter.Language != "" {
+		args = append(args, filter.Language)
+		queries = append(queries, "plainto_tsquery(text_search_config($2), $1)")
+	} else {
+		for _, c := range searchConfigs {
+			queries = append(queries, fmt.Sprintf("plainto_tsquery('%s', $1)", c))
+		}
+	}
+	tsquery := strings.Join(queries, " || ")
+
+	var eventConditions, itemConditions []string
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		eventConditions = append(eventConditions, fmt.Sprintf("e.ends_on >= $%d", len(args)))
+		itemConditions = append(itemConditions, fmt.Sprintf("i.start_date >= $%d", len(args)))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		eventConditions = append(eventConditions, fmt.Sprintf("e.starts_on < $%d", len(args)))
+		itemConditions = append(itemConditions, fmt.Sprintf("i.start_date < $%d", len(args)))
+	}
+	if filter.Audience != "" {
+		args = append(args, filter.Audience)
+		eventConditions = append(eventConditions, fmt.Sprintf("e.audience = $%d", len(args)))
+		itemConditions = append(itemConditions, fmt.Sprintf(`exists (select 1 from event_item ei join event e on e.id = ei.event_id
+		where ei.item_id = i.id and coalesce(ei.deleted, false) = false and e.audience = $%d)`, len(args)))
+	}
+	if !filter.IncludeUnpublished {
+		eventConditions = append(eventConditions, "e.publication_status = 'published'")
+		itemConditions = append(itemConditions, `exists (select 1 from event_item ei join event e on e.id = ei.event_id
+		where ei.item_id = i.id and coalesce(ei.deleted, false) = false and coalesce(e.deleted, false) = false
+		and e.is_template = false and e.publication_status = 'published')`)
+	}
+	eventWhere := strings.Join(append(eventConditions, "coalesce(e.deleted, false) = false", "e.is_template = false"), " and ")
+	itemWhere := strings.Join(append(itemConditions, "coalesce(i.deleted, false) = false"), " and ")
+
+	// Every branch matches its table through its own expression index, with
+	// the query inlined so that the planner sees a constant.
+	branch := func(columns string, from string, doc string, where string) string {
+		document := fmt.Sprintf("search_document(%s)", doc)
+		return fmt.Sprintf(`select %s, ts_rank_cd(%s, %s) as rank
+		from %s where %s @@ %s and %s`, columns, document, tsquery, from, document, tsquery, where)
+	}
+
+	var branches []string
+	if kind == "" || kind == "event" {
+		branches = append(branches,
+			branch(`'event' as type, e.id, e.slug, e.name, e.original_language as language, e.starts_on, e.audience,
+			e.name as doc_name, e.content as doc_content, e.original_language as doc_language`,
+				"event e", "e.name, e.content, e.original_language", eventWhere),
+			branch(`'event', e.id, e.slug, coalesce(t.name, e.name), t.language, e.starts_on, e.audience,
+			t.name, t.content, t.language`,
+				"event_translation t join event e on e.id = t.event_id", "t.name, t.content, t.language", eventWhere))
+	}
+	if kind == "" || kind == "item" {
+		branches = append(branches,
+			branch(`'item' as type, i.id, null as slug, i.name, i.original_language as language, i.start_date as starts_on, null as audience,
+			i.name as doc_name, i.content as doc_content, i.original_language as doc_language`,
+				"item i", "i.name, i.content, i.original_language", itemWhere),
+			branch(`'item', i.id, null, coalesce(t.name, i.name), t.language, i.start_date, null,
+			t.name, t.content, t.language`,
+				"item_translation t join item i on i.id = t.item_id", "t.name, t.content, t.language", itemWhere))
+	}
+
+	// An event or item found in several languages is returned once, in its
+	// best ranked language. Highlighting is costly and only done for the page
+	// returned.
+	query := fmt.Sprintf(`select type, id, slug, name, language, starts_on, audience, rank,
+	ts_headline(text_search_config(doc_language), coalesce(doc_name, ''), %[1]s, '%[3]s'),
+	ts_headline(text_search_config(doc_language), json_plain_text(doc_content), %[1]s, '%[3]s')
+	from (
+		select * from (
+			select distinct on (type, id) * from (%[2]s) docs
+			order by type, id, rank desc
+		) matches
+		order by rank desc, starts_on asc, type asc, id asc LIMIT %[4]d OFFSET %[5]d
+	) page
+	order by rank desc, starts_on asc, type asc, id asc`,
+		tsquery, strings.Join(branches, "\nunion all\n"), headlineOptions, limit, skip)
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := []searchResult{}
+	for rows.Next() {
+		var d searchResult
+		var rank float32
+		if err := rows.Scan(&d.Type, &d.ID, &d.Slug, &d.Name, &d.Language, &d.StartsOn, &d.Audience, &rank, &d.Headline, &d.Snippet); err != nil {
+			return nil, err
+		}
+		d.Rank = float64(rank)
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
@@ -0,0 +1,96 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// cache keeps computed values for a while. Concurrent requests for a missing
+// key wait for a single computation instead of each running it, which is
+// what keeps a registration rush from piling up identical aggregate queries.
+type cache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	ready   chan struct{}
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{
+		ttl:     ttl,
+		entries: map[string]*cacheEntry{},
+	}
+}
+
+// get returns the value cached under key, computing it with load when it is
+// missing or expired. Errors are not cached.
+func (c *cache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) || e.err != nil {
+				ok = false
+			}
+		default:
+			// Being computed by another request.
+		}
+	}
+	if !ok {
+		for k, old := range c.entries {
+			select {
+			case <-old.ready:
+				if now.After(old.expires) {
+					delete(c.entries, k)
+				}
+			default:
+			}
+		}
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		c.fill(key, e, load)
+		return e.value, e.err
+	}
+	c.mu.Unlock()
+
+	<-e.ready
+	return e.value, e.err
+}
+
+// fill computes e with load and releases the requests waiting on it. A failed
+// entry is removed so the next request computes it again; a panic in load is
+// recorded as the entry's error for the waiters before it is passed on.
+func (c *cache) fill(key string, e *cacheEntry, load func() (interface{}, error)) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			e.err = fmt.Errorf("computing %s: %v", key, p)
+		}
+		if e.err != nil {
+			c.mu.Lock()
+			if c.entries[key] == e {
+				delete(c.entries, key)
+			}
+			c.mu.Unlock()
+		}
+		close(e.ready)
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	e.value, e.err = load()
+	e.expires = time.Now().Add(c.ttl)
+}
@@ -0,0 +1,51 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheGetAfterPanic(t *testing.T) {
+	c := newCache(time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.get("event:1", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		_, err := c.get("event:1", func() (interface{}, error) {
+			t.Error("waiter computed the entry itself")
+			return nil, nil
+		})
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the waiter block on the entry
+	close(release)
+
+	if p := <-panicked; p != "boom" {
+		t.Errorf("recovered %v, want the panic of load", p)
+	}
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("waiter got no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the panic")
+	}
+
+	v, err := c.get("event:1", func() (interface{}, error) { return 42, nil })
+	if err != nil || v != 42 {
+		t.Errorf("get after panic = %v, %v, want 42, nil", v, err)
+	}
+}
@@ -0,0 +1,210 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type eventStatsResponse struct {
+	EventID               int               `json:"event_id"`
+	Bucket                string            `json:"bucket"`
+	Timezone              string            `json:"timezone"`
+	GeneratedAt           time.Time         `json:"generated_at"`
+	Totals                statsTotals       `json:"totals"`
+	RegistrationsOverTime []statsTimeBucket `json:"registrations_over_time"`
+	ByParticipationOption []statsBreakdown  `json:"by_participation_option"`
+	ByCountry             []statsBreakdown  `json:"by_country"`
+	ByFirstLanguage       []statsBreakdown  `json:"by_first_language"`
+}
+
+// statsTotals counts the registrations of the event. Cancelled registrations
+// are the deleted ones and the waitlist is made of the registrations still
+// waiting for a confirmation.
+type statsTotals struct {
+	Registrations    int     `json:"registrations"`
+	Confirmed        int     `json:"confirmed"`
+	Waitlist         int     `json:"waitlist"`
+	Cancelled        int     `json:"cancelled"`
+	ConfirmationRate float64 `json:"confirmation_rate"`
+}
+
+type statsTimeBucket struct {
+	Start         time.Time `json:"start"`
+	Registrations int       `json:"registrations"`
+	Confirmed     int       `json:"confirmed"`
+	Cancelled     int       `json:"cancelled"`
+	Cumulative    int       `json:"cumulative"`
+}
+
+type statsBreakdown struct {
+	Key           *string `json:"key"`
+	Registrations int     `json:"registrations"`
+	Confirmed     int     `json:"confirmed"`
+}
+
+type Stats interface {
+	GetEventStats(ctx *gin.Context)
+}
+
+type StatsDB struct {
+	db    *pgxpool.Pool
+	cache *cache
+}
+
+// NewStats returns the statistics controller. Statistics are cached for ttl,
+// so they can lag that much behind the registrations.
+func NewStats(db *pgxpool.Pool, ttl time.Duration) Stats {
+	return &StatsDB{
+		db,
+		newCache(ttl),
+	}
+}
+
+// GetEventStats returns the registration statistics of an event. Registrations
+// over time are bucketed by ?bucket=day|hour (day by default) in the timezone
+// of the event. Totals and breakdowns leave cancelled registrations out.
+func (r *StatsDB) GetEventStats(ctx *gin.Context) {
+	eventID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	bucket := ctx.DefaultQuery("bucket", "day")
+	if bucket != "day" && bucket != "hour" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket value! Accepted values are day and hour", "success": false})
+		return
+	}
+
+	v, err := r.cache.get(fmt.Sprintf("%d:%s", eventID, bucket), func() (interface{}, error) {
+		// Not bound to the request, whose cancellation would otherwise fail
+		// the other requests waiting for this computation.
+		c, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return getEventStats(r, c, eventID, bucket)
+	})
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": v, "success": true})
+}
+
+func getEventStats(r *StatsDB, ctx context.Context, eventID int, bucket string) (eventStatsResponse, error) {
+	u := eventStatsResponse{EventID: eventID, Bucket: bucket, GeneratedAt: time.Now().UTC()}
+
+	if err := r.db.QueryRow(ctx, `select e.timezone,
+	count(ps.id) filter (where coalesce(ps.deleted, false) = false),
+	count(ps.id) filter (where coalesce(ps.deleted, false) = false and ps.confirmed),
+	count(ps.id) filter (where coalesce(ps.deleted, false) = false and not ps.confirmed),
+	count(ps.id) filter (where coalesce(ps.deleted, false) = true)
+	from event e
+	left join participation_status ps on ps.event_id = e.id
+	where e.id = $1
+	group by e.id, e.timezone`, eventID).Scan(
+		&u.Timezone,
+		&u.Totals.Registrations,
+		&u.Totals.Confirmed,
+		&u.Totals.Waitlist,
+		&u.Totals.Cancelled,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return eventStatsResponse{}, fmt.Errorf("not found")
+		}
+		return eventStatsResponse{}, err
+	}
+	if u.Totals.Registrations != 0 {
+		u.Totals.ConfirmationRate = float64(u.Totals.Confirmed) / float64(u.Totals.Registrations)
+	}
+
+	var err error
+	if u.RegistrationsOverTime, err = getRegistrationsOverTime(r, ctx, eventID, bucket, u.Timezone); err != nil {
+		return eventStatsResponse{}, err
+	}
+	if u.ByParticipationOption, err = getStatsBreakdown(r, ctx, eventID, "ps.participation_option"); err != nil {
+		return eventStatsResponse{}, err
+	}
+	if u.ByCountry, err = getStatsBreakdown(r, ctx, eventID, "p.country"); err != nil {
+		return eventStatsResponse{}, err
+	}
+	if u.ByFirstLanguage, err = getStatsBreakdown(r, ctx, eventID, "p.first_language"); err != nil {
+		return eventStatsResponse{}, err
+	}
+	return u, nil
+}
+
+// getRegistrationsOverTime counts the registrations by registration date.
+// Registrations cancelled since then still count in their bucket, and in
+// Cancelled.
+func getRegistrationsOverTime(r *StatsDB, ctx context.Context, eventID int, bucket string, timezone string) ([]statsTimeBucket, error) {
+	rows, err := r.db.Query(ctx, `select date_trunc($2, ps.registration_date at time zone $3) at time zone $3 as start,
+	count(*),
+	count(*) filter (where ps.confirmed and coalesce(ps.deleted, false) = false),
+	count(*) filter (where coalesce(ps.deleted, false) = true)
+	from participation_status ps
+	where ps.event_id = $1
+	group by start
+	order by start asc`, eventID, bucket, timezone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := []statsTimeBucket{}
+	cumulative := 0
+	for rows.Next() {
+		var d statsTimeBucket
+		if err := rows.Scan(&d.Start, &d.Registrations, &d.Confirmed, &d.Cancelled); err != nil {
+			return nil, err
+		}
+		cumulative += d.Registrations - d.Cancelled
+		d.Cumulative = cumulative
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
+
+// getStatsBreakdown counts the registrations that are not cancelled by
+// column, largest first. column is one of a fixed set of expressions.
+func getStatsBreakdown(r *StatsDB, ctx context.Context, eventID int, column string) ([]statsBreakdown, error) {
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select %s as key,
+	count(*),
+	count(*) filter (where ps.confirmed)
+	from participation_status ps
+	join participant p on p.id = ps.participant_id
+	where ps.event_id = $1 and coalesce(ps.deleted, false) = false
+	group by key
+	order by count(*) desc, key asc`, column), eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := []statsBreakdown{}
+	for rows.Next() {
+		var d statsBreakdown
+		if err := rows.Scan(&d.Key, &d.Registrations, &d.Confirmed); err != nil {
+			return nil, err
+		}
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
@@ -0,0 +1,251 @@
+// Package translation serves the translations of the events and items. The
+// translations of the rows of a table are kept in the table named after it
+// with a _translation suffix, which refers to its owner by <table>_id.
+package translation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"vh-srv-event/language"
+	"vh-srv-event/schema"
+	"vh-srv-event/txn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type translationResponse struct {
+	ID        *int             `json:"id" db:"id"`
+	OwnerID   *int             `json:"-"`
+	Language  *string          `json:"language" db:"language"`
+	Name      *string          `json:"name,omitempty" db:"name"`
+	Content   *json.RawMessage `json:"content,omitempty" db:"content"`
+	CreatedAt *time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time       `json:"updated_at" db:"updated_at"`
+
+	ownerColumn string
+}
+
+// MarshalJSON names the owner id after its column, event_id or item_id.
+func (t translationResponse) MarshalJSON() ([]byte, error) {
+	type fields translationResponse
+	b, err := json.Marshal(fields(t))
+	if err != nil {
+		return nil, err
+	}
+	ownerID, err := json.Marshal(t.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf(`{%q:%s,%s`, t.ownerColumn, ownerID, b[1:])), nil
+}
+
+type translation struct {
+	Name    *string          `json:"name,omitempty" db:"name" validate:"required_without=Content"`
+	Content *json.RawMessage `json:"content,omitempty" db:"content"`
+}
+
+// Translations serves the translations of the rows of one table.
+type Translations struct {
+	db      *pgxpool.Pool
+	schemas *schema.Registry
+	owner   string
+}
+
+func New(db *pgxpool.Pool, schemas *schema.Registry, owner string) *Translations {
+	return &Translations{
+		db,
+		schemas,
+		owner,
+	}
+}
+
+func (r *Translations) GetAll(ctx *gin.Context) {
+	id := ctx.Param("id")
+
+	u, err := getAllTranslation(r, ctx, id)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func (r *Translations) Upsert(ctx *gin.Context) {
+	s := translation{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	id := ctx.Param("id")
+	lang := language.Normalize(ctx.Param("lang"))
+
+	u, err := upsertTranslation(r, ctx, id, lang, s)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
+		if verrs, ok := err.(schema.ValidationErrors); ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid content",
+				"details": verrs,
+				"success": false,
+			})
+			return
+		}
+
+		if err.Error() == "invalid language" || err.Error() == "unknown content type" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": strings.ToUpper(r.owner[:1]) + r.owner[1:] + " translation saved!", "data": u, "success": true})
+}
+
+func getAllTranslation(r *Translations, ctx *gin.Context, ownerID string) (*[]translationResponse, error) {
+
+	var exists bool
+	if err := r.db.QueryRow(ctx, fmt.Sprintf(`select exists(select 1 from %s where id = $1 and coalesce(deleted, false) = false)`, r.owner), ownerID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("not found")
+	}
+
+	u := []translationResponse{}
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select
+	id,
+	%[1]s_id,
+	language,
+	name,
+	content,
+	created_at,
+	updated_at
+	from %[1]s_translation where %[1]s_id = $1 order by language asc`, r.owner), ownerID)
+	if err != nil {
+		return &u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := translationResponse{ownerColumn: r.owner + "_id"}
+		err := rows.Scan(&d.ID, &d.OwnerID, &d.Language, &d.Name, &d.Content, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return &u, err
+		}
+		u = append(u, d)
+	}
+	return &u, rows.Err()
+}
+
+func upsertTranslation(r *Translations, ctx *gin.Context, ownerID string, lang string, req translation) (translationResponse, error) {
+	u := translationResponse{ownerColumn: r.owner + "_id"}
+	err := txn.Run(ctx, r.db, func(tx pgx.Tx) error {
+		// The owner is locked, as its tag changes with the translation.
+		var contentType string
+		if err := tx.QueryRow(ctx, fmt.Sprintf(`select content_type from %s where id = $1 and coalesce(deleted, false) = false for update`, r.owner),
+			ownerID).Scan(&contentType); err != nil {
+			if err == pgx.ErrNoRows {
+				return fmt.Errorf("not found")
+			}
+			return err
+		}
+
+		var languageExists bool
+		if err := tx.QueryRow(ctx, `select exists(select 1 from language_list where code = $1)`, lang).Scan(&languageExists); err != nil {
+			return err
+		}
+		if !languageExists {
+			return fmt.Errorf("invalid language")
+		}
+
+		// Translated content must follow the same schema as the original.
+		if req.Content != nil {
+			if err := r.schemas.Validate(ctx, contentType, *req.Content); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.QueryRow(ctx, fmt.Sprintf(`INSERT INTO %[1]s_translation (
+				%[1]s_id,
+				language,
+				name,
+				content)
+			VALUES (
+				$1,
+				$2,
+				$3,
+				$4)
+			ON CONFLICT (%[1]s_id, language) DO UPDATE SET
+				name = EXCLUDED.name,
+				content = EXCLUDED.content,
+				updated_at = now()
+			RETURNING id, %[1]s_id, language, name, content, created_at, updated_at`, r.owner),
+			ownerID, lang, req.Name, req.Content).Scan(
+			&u.ID,
+			&u.OwnerID,
+			&u.Language,
+			&u.Name,
+			&u.Content,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("problem saving %s translation: %w", r.owner, err)
+		}
+
+		// The translation is part of what GET /<owner>/:id returns, so its tag
+		// has to change as well.
+		_, err := tx.Exec(ctx, fmt.Sprintf(`UPDATE %s SET updated_at = now() WHERE id = $1`, r.owner), ownerID)
+		return err
+	})
+	if err != nil {
+		return translationResponse{}, err
+	}
+	return u, nil
+}
@@ -0,0 +1,135 @@
+package translation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"vh-srv-event/schema"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testDB connects to the database at TEST_DATABASE_URL, which must have
+// db/initial.sql applied. Tests that need it are skipped when it is not set.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := pgxpool.Connect(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func testContext(body string, id string, lang string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPut, "/v1/item/"+id+"/translations/"+lang, strings.NewReader(body))
+	ctx.Params = gin.Params{{Key: "id", Value: id}, {Key: "lang", Value: lang}}
+	return ctx, w
+}
+
+func TestTranslationResponseJSON(t *testing.T) {
+	id, ownerID := 2, 7
+	lang, name := "de", "Vortrag"
+	b, err := json.Marshal(translationResponse{ID: &id, OwnerID: &ownerID, Language: &lang, Name: &name, ownerColumn: "item_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("%s is not valid JSON: %v", b, err)
+	}
+	want := map[string]interface{}{"item_id": 7.0, "id": 2.0, "language": "de", "name": "Vortrag", "created_at": nil, "updated_at": nil}
+	if len(got) != len(want) {
+		t.Fatalf("got %s, want the fields %v", b, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestUpsertNeedsNameOrContent(t *testing.T) {
+	ctx, w := testContext(`{}`, "1", "de")
+	New(nil, nil, "item").Upsert(ctx)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestUpsertAndList(t *testing.T) {
+	db := testDB(t)
+	bg := context.Background()
+	r := New(db, schema.NewRegistry(db), "item")
+
+	var itemID int
+	var updatedAt time.Time
+	if err := db.QueryRow(bg, `INSERT INTO item (start_date, duration, name, original_language)
+		VALUES (now(), 30, 'Talk', 'en') RETURNING id, updated_at`).Scan(&itemID, &updatedAt); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(bg, `DELETE FROM item_translation WHERE item_id = $1`, itemID)
+		db.Exec(bg, `DELETE FROM item WHERE id = $1`, itemID)
+	})
+	id := fmt.Sprint(itemID)
+
+	for _, name := range []string{"Vortrag", "Referat"} {
+		ctx, w := testContext(`{"name": "`+name+`"}`, id, "DE")
+		r.Upsert(ctx)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upsert %s: status %d, %s", name, w.Code, w.Body)
+		}
+	}
+
+	var bumped time.Time
+	if err := db.QueryRow(bg, `select updated_at from item where id = $1`, itemID).Scan(&bumped); err != nil {
+		t.Fatal(err)
+	}
+	if !bumped.After(updatedAt) {
+		t.Error("updated_at of the item was not bumped")
+	}
+
+	ctx, w := testContext("", id, "")
+	r.GetAll(ctx)
+	var res struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 1 || res.Data[0]["name"] != "Referat" || res.Data[0]["language"] != "de" || res.Data[0]["item_id"] != float64(itemID) {
+		t.Errorf("translations = %v, want the one in de named Referat", res.Data)
+	}
+
+	ctx, w = testContext(`{"name": "x"}`, id, "xx-unknown")
+	r.Upsert(ctx)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown language: status %d, want 400", w.Code)
+	}
+
+	if _, err := db.Exec(bg, `UPDATE item SET deleted = true, deleted_at = now() WHERE id = $1`, itemID); err != nil {
+		t.Fatal(err)
+	}
+	ctx, w = testContext(`{"name": "x"}`, id, "de")
+	r.Upsert(ctx)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleted item: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,50 @@
+// Package txn runs the operations that write to several tables as one unit
+// of work.
+package txn
+
+import (
+	"context"
+	"errors"
+
+	"vh-srv-event/audit"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// maxAttempts bounds how many times a unit of work is run when postgres
+// aborts it in favour of a concurrent transaction.
+const maxAttempts = 3
+
+// Run calls fn inside a serializable transaction and commits it when fn
+// returns nil. An error, or a panic, rolls back everything fn did. When
+// postgres aborts the transaction on a serialization failure or a deadlock
+// it is run again from the start, so fn must only change the database and
+// the values it returns. The transaction is tagged with the actor and request
+// id of ctx for the audit log.
+func Run(ctx context.Context, db *pgxpool.Pool, fn func(tx pgx.Tx) error) error {
+	tagged := func(tx pgx.Tx) error {
+		if err := audit.Tag(ctx, tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = db.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable}, tagged)
+		if !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func retryable(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// serialization_failure and deadlock_detected
+	return pgErr.SQLState() == "40001" || pgErr.SQLState() == "40P01"
+}
@@ -0,0 +1,369 @@
+package viewing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type viewSessionResponse struct {
+	ID              *int64     `json:"id" db:"id"`
+	ParticipantID   *int       `json:"participant_id" db:"participant_id"`
+	ItemID          *int       `json:"item_id" db:"item_id"`
+	BroadcastURLID  *int       `json:"broadcast_url_id" db:"broadcast_url_id"`
+	Language        *string    `json:"language" db:"language"`
+	StartedAt       *time.Time `json:"started_at" db:"started_at"`
+	LastHeartbeatAt *time.Time `json:"last_heartbeat_at" db:"last_heartbeat_at"`
+	EndedAt         *time.Time `json:"ended_at,omitempty" db:"ended_at"`
+	WatchedSeconds  *int       `json:"watched_seconds" db:"watched_seconds"`
+}
+
+type viewSession struct {
+	ParticipantID  *int    `json:"participant_id" validate:"required"`
+	ItemID         *int    `json:"item_id" validate:"required"`
+	BroadcastURLID *int    `json:"broadcast_url_id" validate:"required"`
+	Language       *string `json:"language,omitempty"`
+}
+
+type viewingReportRow struct {
+	ItemID         *int    `json:"item_id,omitempty"`
+	ItemName       *string `json:"item_name,omitempty"`
+	Language       *string `json:"language,omitempty"`
+	Platform       *string `json:"platform,omitempty"`
+	Sessions       int     `json:"sessions"`
+	UniqueViewers  int     `json:"unique_viewers"`
+	WatchedMinutes float64 `json:"watched_minutes"`
+}
+
+// reportDimensions are the columns a viewing report can be grouped by.
+var reportDimensions = map[string]string{
+	"item":     "i.id, i.name",
+	"language": "v.language",
+	"platform": "b.platform",
+}
+
+type Viewing interface {
+	CreateNewViewSession(ctx *gin.Context)
+	HeartbeatViewSessionByID(ctx *gin.Context)
+	EndViewSessionByID(ctx *gin.Context)
+	GetViewingReport(ctx *gin.Context)
+}
+
+type ViewingDB struct {
+	db     *pgxpool.Pool
+	maxGap time.Duration
+}
+
+// NewViewing returns the viewing controller. At most maxGap of watch time is
+// counted between two heartbeats of a session, so that a player that went
+// away without ending its session does not count as watching.
+func NewViewing(db *pgxpool.Pool, maxGap time.Duration) Viewing {
+	return &ViewingDB{
+		db,
+		maxGap,
+	}
+}
+
+// CreateNewViewSession is called by the player when a participant opens a
+// broadcast URL of an item. The language defaults to the one of the
+// broadcast URL.
+func (r *ViewingDB) CreateNewViewSession(ctx *gin.Context) {
+	s := viewSession{}
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	err := validator.New().Struct(s)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	u, err := createNewViewSession(r, ctx, s)
+
+	if err != nil {
+		if err.Error() == "broadcast url is not linked to this item" || err.Error() == "participant not found" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{"message": "Created new view session!", "data": u, "success": true})
+}
+
+// HeartbeatViewSessionByID is called periodically by the player while the
+// participant is watching.
+func (r *ViewingDB) HeartbeatViewSessionByID(ctx *gin.Context) {
+	r.touchViewSession(ctx, false)
+}
+
+// EndViewSessionByID is called by the player when the participant stops
+// watching. Later heartbeats are refused.
+func (r *ViewingDB) EndViewSessionByID(ctx *gin.Context) {
+	r.touchViewSession(ctx, true)
+}
+
+func (r *ViewingDB) touchViewSession(ctx *gin.Context, end bool) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id value! Accepted value is INTEGER", "success": false})
+		return
+	}
+
+	u, err := touchViewSession(r, ctx, id, end)
+
+	if err != nil {
+		if err.Error() == "not found" {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if err.Error() == "view session ended" {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "View session updated!", "data": u, "success": true})
+}
+
+// GetViewingReport aggregates the view sessions into unique viewers and
+// watched minutes. ?group_by takes a comma separated list of item, language
+// and platform, all three by default. The sessions can be filtered by
+// event_id, item_id and by their start with from and to (RFC 3339).
+func (r *ViewingDB) GetViewingReport(ctx *gin.Context) {
+	var groups []string
+	groupBy := ctx.DefaultQuery("group_by", "item,language,platform")
+	for _, g := range strings.Split(groupBy, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if _, ok := reportDimensions[g]; !ok {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group_by value! Accepted values are item, language and platform", "success": false})
+			return
+		}
+		if !contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+
+	var conditions []string
+	var args []interface{}
+	if s := ctx.Query("event_id"); s != "" {
+		eventID, err := strconv.Atoi(s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event_id value! Accepted value is INTEGER", "success": false})
+			return
+		}
+		args = append(args, eventID)
+		conditions = append(conditions, fmt.Sprintf("v.item_id in (select item_id from event_item where event_id = $%d and coalesce(deleted, false) = false)", len(args)))
+	}
+	if s := ctx.Query("item_id"); s != "" {
+		itemID, err := strconv.Atoi(s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item_id value! Accepted value is INTEGER", "success": false})
+			return
+		}
+		args = append(args, itemID)
+		conditions = append(conditions, fmt.Sprintf("v.item_id = $%d", len(args)))
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		s := ctx.Query(bound.param)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.param + " value! Accepted value is an RFC 3339 date", "success": false})
+			return
+		}
+		args = append(args, t)
+		conditions = append(conditions, fmt.Sprintf("v.started_at %s $%d", bound.op, len(args)))
+	}
+
+	u, err := getViewingReport(r, ctx, groups, conditions, args)
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fetched!", "data": u, "success": true})
+}
+
+func createNewViewSession(r *ViewingDB, ctx context.Context, req viewSession) (viewSessionResponse, error) {
+	var urlLanguage string
+	if err := r.db.QueryRow(ctx, `select b.language from item_broadcast_url ib
+	join broadcast_url b on b.id = ib.broadcast_url_id
+	where ib.item_id = $1 and ib.broadcast_url_id = $2
+	and coalesce(ib.deleted, false) = false and coalesce(b.deleted, false) = false limit 1`, *req.ItemID, *req.BroadcastURLID).Scan(&urlLanguage); err != nil {
+		if err == pgx.ErrNoRows {
+			return viewSessionResponse{}, fmt.Errorf("broadcast url is not linked to this item")
+		}
+		return viewSessionResponse{}, err
+	}
+
+	var exists bool
+	if err := r.db.QueryRow(ctx, `select exists(select 1 from participant where id = $1 and coalesce(deleted, false) = false)`, *req.ParticipantID).Scan(&exists); err != nil {
+		return viewSessionResponse{}, err
+	}
+	if !exists {
+		return viewSessionResponse{}, fmt.Errorf("participant not found")
+	}
+
+	language := urlLanguage
+	if req.Language != nil && *req.Language != "" {
+		language = *req.Language
+	}
+
+	u := viewSessionResponse{}
+	if err := r.db.QueryRow(ctx, `INSERT INTO view_session (participant_id, item_id, broadcast_url_id, language)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, participant_id, item_id, broadcast_url_id, language, started_at, last_heartbeat_at, ended_at, watched_seconds`,
+		*req.ParticipantID, *req.ItemID, *req.BroadcastURLID, language).Scan(
+		&u.ID,
+		&u.ParticipantID,
+		&u.ItemID,
+		&u.BroadcastURLID,
+		&u.Language,
+		&u.StartedAt,
+		&u.LastHeartbeatAt,
+		&u.EndedAt,
+		&u.WatchedSeconds,
+	); err != nil {
+		return viewSessionResponse{}, fmt.Errorf("problem creating view session: %w", err)
+	}
+	return u, nil
+}
+
+// touchViewSession adds the time since the last heartbeat, capped to maxGap,
+// to the watched time of the session, and ends it when end is set. Sessions
+// are a single row updated in place, so heartbeats do not grow the table.
+func touchViewSession(r *ViewingDB, ctx context.Context, id int64, end bool) (viewSessionResponse, error) {
+	u := viewSessionResponse{}
+	err := r.db.QueryRow(ctx, `UPDATE view_session SET
+	watched_seconds = watched_seconds + least(extract(epoch from now() - last_heartbeat_at), extract(epoch from $2::interval))::int,
+	last_heartbeat_at = now(),
+	ended_at = case when $3 then now() else null end
+	WHERE id = $1 AND ended_at IS NULL
+	RETURNING id, participant_id, item_id, broadcast_url_id, language, started_at, last_heartbeat_at, ended_at, watched_seconds`,
+		id, r.maxGap, end).Scan(
+		&u.ID,
+		&u.ParticipantID,
+		&u.ItemID,
+		&u.BroadcastURLID,
+		&u.Language,
+		&u.StartedAt,
+		&u.LastHeartbeatAt,
+		&u.EndedAt,
+		&u.WatchedSeconds,
+	)
+	if err == pgx.ErrNoRows {
+		var exists bool
+		if err := r.db.QueryRow(ctx, `select exists(select 1 from view_session where id = $1)`, id).Scan(&exists); err != nil {
+			return viewSessionResponse{}, err
+		}
+		if exists {
+			return viewSessionResponse{}, fmt.Errorf("view session ended")
+		}
+		return viewSessionResponse{}, fmt.Errorf("not found")
+	}
+	if err != nil {
+		return viewSessionResponse{}, err
+	}
+	return u, nil
+}
+
+func getViewingReport(r *ViewingDB, ctx context.Context, groups []string, conditions []string, args []interface{}) ([]viewingReportRow, error) {
+	columns := []string{}
+	for _, g := range groups {
+		columns = append(columns, reportDimensions[g])
+	}
+
+	selected := "count(*), count(distinct v.participant_id), coalesce(sum(v.watched_seconds), 0)"
+	grouping := ""
+	if len(columns) != 0 {
+		selected = strings.Join(columns, ", ") + ", " + selected
+		grouping = " group by " + strings.Join(columns, ", ") + " order by " + strings.Join(columns, ", ")
+	}
+	where := ""
+	if len(conditions) != 0 {
+		where = " where " + strings.Join(conditions, " and ")
+	}
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`select %s from view_session v
+	join item i on i.id = v.item_id
+	join broadcast_url b on b.id = v.broadcast_url_id%s%s`, selected, where, grouping), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := []viewingReportRow{}
+	for rows.Next() {
+		var d viewingReportRow
+		var seconds int64
+		dest := []interface{}{}
+		for _, g := range groups {
+			switch g {
+			case "item":
+				dest = append(dest, &d.ItemID, &d.ItemName)
+			case "language":
+				dest = append(dest, &d.Language)
+			case "platform":
+				dest = append(dest, &d.Platform)
+			}
+		}
+		dest = append(dest, &d.Sessions, &d.UniqueViewers, &seconds)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		d.WatchedMinutes = float64(seconds) / 60
+		u = append(u, d)
+	}
+	return u, rows.Err()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}